@@ -0,0 +1,169 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
+)
+
+type explainResponse struct {
+	Line   string             `json:"line"`
+	Events []eventExplanation `json:"events"`
+}
+
+type eventExplanation struct {
+	MetricName string            `json:"metric_name"`
+	MetricType string            `json:"metric_type"`
+	Value      float64           `json:"value"`
+	Tags       map[string]string `json:"tags"`
+	Matched    bool              `json:"matched"`
+	Cached     bool              `json:"cached"`
+	Mapping    *mappingReference `json:"mapping,omitempty"`
+	Captures   []string          `json:"captures,omitempty"`
+	FSMPath    []string          `json:"fsm_path,omitempty"`
+	Dropped    bool              `json:"dropped"`
+	Results    []expectedMetric  `json:"results,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type mappingReference struct {
+	Index     int    `json:"index"`
+	Match     string `json:"match"`
+	MatchType string `json:"match_type"`
+	Action    string `json:"action"`
+}
+
+// explainHandler parses the StatsD line given in the "line" query parameter
+// and reports how each resulting event is mapped by the live configuration.
+// It does not record any metrics and does not populate the mapping cache.
+func explainHandler(m *mapper.MetricMapper, parser listener.Parser, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		line := r.URL.Query().Get("line")
+		if line == "" {
+			http.Error(w, "Missing line parameter", http.StatusBadRequest)
+			return
+		}
+
+		sampleErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"})
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "discard"})
+		events := parser.LineToEvents(line, *sampleErrors, counter, counter, counter, logger)
+		if len(events) == 0 {
+			http.Error(w, "Line did not produce any events", http.StatusBadRequest)
+			return
+		}
+
+		resp := explainResponse{Line: line, Events: make([]eventExplanation, 0, len(events))}
+		// The sender is unknown, so source labels are not added.
+		resolver := newLineResolver(m, "")
+		for _, e := range events {
+			x := m.ExplainMapping(e.MetricName(), e.MetricType())
+			ee := eventExplanation{
+				MetricName: e.MetricName(),
+				MetricType: string(e.MetricType()),
+				Value:      e.Value(),
+				Tags:       e.Labels(),
+				Matched:    x.Matched,
+				Cached:     x.Cached,
+				Captures:   x.Captures,
+				FSMPath:    x.FSMPath,
+			}
+			if x.Matched {
+				ee.Mapping = &mappingReference{
+					Index:     x.Index,
+					Match:     x.Mapping.Match,
+					MatchType: string(x.Mapping.MatchType),
+					Action:    string(x.Mapping.Action),
+				}
+			}
+
+			res := resolver.resolveMapping(e, x.Mapping, x.Labels, x.Matched)
+			switch {
+			case res.err != nil:
+				ee.Error = res.err.Error()
+			case res.dropped:
+				ee.Dropped = true
+			case len(res.metrics) == 0:
+				ee.Error = "discarded because of a metric type conflict"
+			default:
+				ee.Results = res.metrics
+			}
+			resp.Events = append(resp.Events, ee)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			level.Debug(logger).Log("msg", "Failed to write explain response", "error", err)
+		}
+	}
+}
+
+type unmappedResponse struct {
+	Metrics   []unmapped.Entry    `json:"metrics"`
+	Proposals []unmapped.Proposal `json:"proposals,omitempty"`
+}
+
+// unmappedHandler reports the most frequent metrics that did not match any
+// mapping. Metrics that are covered by the current configuration, e.g. after
+// a reload, are left out. With propose=true, it also suggests glob mappings
+// that would cover them.
+func unmappedHandler(tracker *unmapped.Tracker, m *mapper.MetricMapper, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 0
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid limit: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp := unmappedResponse{Metrics: []unmapped.Entry{}}
+		for _, e := range tracker.Top(0) {
+			if m.ExplainMapping(e.Name, e.MetricType).Matched {
+				continue
+			}
+			resp.Metrics = append(resp.Metrics, e)
+			if limit > 0 && len(resp.Metrics) >= limit {
+				break
+			}
+		}
+		if propose, _ := strconv.ParseBool(r.URL.Query().Get("propose")); propose {
+			resp.Proposals = unmapped.Propose(resp.Metrics)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			level.Debug(logger).Log("msg", "Failed to write unmapped metrics response", "error", err)
+		}
+	}
+}
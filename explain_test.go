@@ -0,0 +1,76 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+func TestExplainHandler(t *testing.T) {
+	m := &mapper.MetricMapper{}
+	if err := m.InitFromYAMLString(mappingTestConfig); err != nil {
+		t.Fatal(err)
+	}
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+	handler := explainHandler(m, parser, log.NewNopLogger())
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/mapping/explain?line="+url.QueryEscape("test.timer.backup:20|ms|#env:prod"), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp explainResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(resp.Events))
+	}
+	e := resp.Events[0]
+	if !e.Matched || e.Mapping == nil || e.Mapping.Index != 1 || e.Mapping.Match != "test.timer.*" {
+		t.Fatalf("unexpected mapping in %+v", e)
+	}
+	if !reflect.DeepEqual(e.Captures, []string{"backup"}) {
+		t.Fatalf("unexpected captures %v", e.Captures)
+	}
+	if !reflect.DeepEqual(e.FSMPath, []string{"observer", "test", "timer", "*"}) {
+		t.Fatalf("unexpected FSM path %v", e.FSMPath)
+	}
+	expected := []expectedMetric{{
+		Name:   "test_timer_seconds",
+		Type:   "histogram",
+		Labels: map[string]string{"job": "backup", "env": "prod"},
+	}}
+	if !reflect.DeepEqual(e.Results, expected) {
+		t.Fatalf("expected results %v, got %v", expected, e.Results)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/mapping/explain?line=garbage", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for bad line, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
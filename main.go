@@ -15,14 +15,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"os/signal"
 	"strconv"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,98 +38,18 @@ import (
 	"github.com/prometheus/common/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	"github.com/prometheus/statsd_exporter/pkg/address"
+	"github.com/prometheus/statsd_exporter/pkg/activation"
 	"github.com/prometheus/statsd_exporter/pkg/event"
-	"github.com/prometheus/statsd_exporter/pkg/exporter"
 	"github.com/prometheus/statsd_exporter/pkg/level"
 	"github.com/prometheus/statsd_exporter/pkg/line"
-	"github.com/prometheus/statsd_exporter/pkg/listener"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
-	"github.com/prometheus/statsd_exporter/pkg/mappercache/lru"
-	"github.com/prometheus/statsd_exporter/pkg/mappercache/randomreplacement"
-	"github.com/prometheus/statsd_exporter/pkg/relay"
+	"github.com/prometheus/statsd_exporter/pkg/server"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
+	"github.com/prometheus/statsd_exporter/pkg/upgrade"
 )
 
 var (
-	eventStats = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_total",
-			Help: "The total number of StatsD events seen.",
-		},
-		[]string{"type"},
-	)
-	eventsFlushed = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_event_queue_flushed_total",
-			Help: "Number of times events were flushed to exporter",
-		},
-	)
-	eventsUnmapped = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_unmapped_total",
-			Help: "The total number of StatsD events no mapping was found for.",
-		})
-	udpPackets = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_udp_packets_total",
-			Help: "The total number of StatsD packets received over UDP.",
-		},
-	)
-	tcpConnections = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connections_total",
-			Help: "The total number of TCP connections handled.",
-		},
-	)
-	tcpErrors = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connection_errors_total",
-			Help: "The number of errors encountered reading from TCP.",
-		},
-	)
-	tcpLineTooLong = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_too_long_lines_total",
-			Help: "The number of lines discarded due to being too long.",
-		},
-	)
-	unixgramPackets = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_unixgram_packets_total",
-			Help: "The total number of StatsD packets received over Unixgram.",
-		},
-	)
-	linesReceived = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_lines_total",
-			Help: "The total number of StatsD lines received.",
-		},
-	)
-	samplesReceived = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_samples_total",
-			Help: "The total number of StatsD samples received.",
-		},
-	)
-	sampleErrors = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_sample_errors_total",
-			Help: "The total number of errors parsing StatsD samples.",
-		},
-		[]string{"reason"},
-	)
-	tagsReceived = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tags_total",
-			Help: "The total number of DogStatsD tags processed.",
-		},
-	)
-	tagErrors = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tag_errors_total",
-			Help: "The number of errors parsing DogStatsD tags.",
-		},
-	)
 	configLoads = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_config_reloads_total",
@@ -132,69 +57,114 @@ var (
 		},
 		[]string{"outcome"},
 	)
-	mappingsCount = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "statsd_exporter_loaded_mappings",
-		Help: "The current number of configured metric mappings.",
-	})
-	conflictingEventStats = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_conflict_total",
-			Help: "The total number of StatsD events with conflicting names.",
-		},
-		[]string{"type"},
-	)
-	errorEventStats = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_error_total",
-			Help: "The total number of StatsD events discarded due to errors.",
-		},
-		[]string{"reason"},
-	)
-	eventsActions = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_actions_total",
-			Help: "The total number of StatsD events by action.",
-		},
-		[]string{"action"},
-	)
-	metricsCount = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "statsd_exporter_metrics_total",
-			Help: "The total number of metrics.",
-		},
-		[]string{"type"},
-	)
 )
 
-func serveHTTP(mux http.Handler, listenAddress string, logger log.Logger) {
-	level.Error(logger).Log("msg", http.ListenAndServe(listenAddress, mux))
-	os.Exit(1)
+// maxConfigSize limits the size of a mapping configuration accepted over HTTP.
+const maxConfigSize = 10 << 20
+
+func serveHTTP(server *http.Server, l net.Listener, logger log.Logger) {
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		level.Error(logger).Log("msg", err)
+		os.Exit(1)
+	}
 }
 
-func sighupConfigReloader(fileName string, mapper *mapper.MetricMapper, logger log.Logger) {
+func sighupConfigReloader(fileName string, mapper *mapper.MetricMapper, tracker *unmapped.Tracker, loadACL aclLoader, logger log.Logger) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP)
 
 	for s := range signals {
-		if fileName == "" {
-			level.Warn(logger).Log("msg", "Received signal but no mapping config to reload", "signal", s)
+		if fileName == "" && loadACL == nil {
+			level.Warn(logger).Log("msg", "Received signal but no mapping or ACL config to reload", "signal", s)
 			continue
 		}
 
 		level.Info(logger).Log("msg", "Received signal, attempting reload", "signal", s)
 
-		reloadConfig(fileName, mapper, logger)
+		reloadConfig(fileName, mapper, tracker, loadACL, logger)
 	}
 }
 
-func reloadConfig(fileName string, mapper *mapper.MetricMapper, logger log.Logger) {
-	err := mapper.InitFromFile(fileName)
+// aclLoader loads the ACL configuration and returns a function that applies
+// it.
+type aclLoader func() (apply func(), err error)
+
+// reloadConfig reloads the mapping configuration from fileName, if set, and
+// the ACL configuration with loadACL, if not nil. Nothing is applied unless
+// both load: the ACL is loaded first, and only applied once the mapper took
+// the mapping configuration, which it only does if the configuration parses.
+// The unmapped metrics tracker, if not nil, is reset after the mappings
+// changed, as the metrics it holds may be mapped now.
+func reloadConfig(fileName string, mapper *mapper.MetricMapper, tracker *unmapped.Tracker, loadACL aclLoader, logger log.Logger) error {
+	var (
+		applyACL func()
+		err      error
+	)
+	if loadACL != nil {
+		applyACL, err = loadACL()
+	}
+	if err == nil && fileName != "" {
+		err = mapper.InitFromFile(fileName)
+		if err == nil && tracker != nil {
+			tracker.Reset()
+		}
+	}
+	if err == nil && applyACL != nil {
+		applyACL()
+	}
 	if err != nil {
-		level.Info(logger).Log("msg", "Error reloading config", "error", err)
+		level.Error(logger).Log("msg", "Error reloading config", "error", err)
 		configLoads.WithLabelValues("failure").Inc()
-	} else {
-		level.Info(logger).Log("msg", "Config reloaded successfully")
-		configLoads.WithLabelValues("success").Inc()
+		return err
+	}
+	level.Info(logger).Log("msg", "Config reloaded successfully")
+	configLoads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// reloadHandler reloads the mapping configuration from fileName and the ACL
+// configuration, and reports the outcome to the client. A failed reload
+// leaves the previous configuration in place and is answered with a 500
+// carrying the parse error.
+func reloadHandler(fileName string, mapper *mapper.MetricMapper, tracker *unmapped.Tracker, loadACL aclLoader, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			return
+		}
+		if fileName == "" && loadACL == nil {
+			level.Warn(logger).Log("msg", "Received lifecycle api reload but no mapping or ACL config to reload")
+			fmt.Fprintf(w, "No mapping or ACL config to reload")
+			return
+		}
+		level.Info(logger).Log("msg", "Received lifecycle api reload, attempting reload")
+		if err := reloadConfig(fileName, mapper, tracker, loadACL, logger); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Config reloaded successfully")
+	}
+}
+
+// validateConfigHandler parses a mapping configuration from the request body
+// into a scratch mapper. The running configuration is never touched, so this
+// can be used to check a config before deploying it.
+func validateConfigHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read config: %s", err), http.StatusBadRequest)
+			return
+		}
+		scratch := &mapper.MetricMapper{Logger: logger}
+		if err := scratch.InitFromYAMLString(string(body)); err != nil {
+			level.Debug(logger).Log("msg", "Received invalid config for validation", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid config: %s", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "Config is valid, %d mappings\n", len(scratch.Mappings))
 	}
 }
 
@@ -212,47 +182,52 @@ func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string, logger log.Logger
 	return nil
 }
 
-func getCache(cacheSize int, cacheType string, registerer prometheus.Registerer) (mapper.MetricMapperCache, error) {
-	var cache mapper.MetricMapperCache
-	var err error
-	if cacheSize == 0 {
-		return nil, nil
-	} else {
-		switch cacheType {
-		case "lru":
-			cache, err = lru.NewMetricMapperLRUCache(registerer, cacheSize)
-		case "random":
-			cache, err = randomreplacement.NewMetricMapperRRCache(registerer, cacheSize)
-		default:
-			err = fmt.Errorf("unsupported cache type %q", cacheType)
-		}
-
-		if err != nil {
-			return nil, err
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
 		}
 	}
-
-	return cache, nil
+	return false
 }
 
 func main() {
 	var (
 		listenAddress        = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics.").Default(":9102").String()
 		enableLifecycle      = kingpin.Flag("web.enable-lifecycle", "Enable shutdown and reload via HTTP request.").Default("false").Bool()
+		shutdownGracePeriod  = kingpin.Flag("web.shutdown-grace-period", "How long to keep serving metrics on shutdown after all received events have been processed, so that they can be scraped one last time.").Default("0s").Duration()
 		metricsEndpoint      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
 		statsdListenUDP      = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
 		statsdListenTCP      = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
 		statsdListenUnixgram = kingpin.Flag("statsd.listen-unixgram", "The Unixgram socket path to receive statsd metric lines in datagram. \"\" disables it.").Default("").String()
+		statsdListenUnix     = kingpin.Flag("statsd.listen-unix", "The Unix stream socket path to receive statsd metric lines. \"\" disables it.").Default("").String()
 		// not using Int here because flag displays default in decimal, 0755 will show as 493
 		statsdUnixSocketMode = kingpin.Flag("statsd.unixsocket-mode", "The permission mode of the unix socket.").Default("755").String()
 		mappingConfig        = kingpin.Flag("statsd.mapping-config", "Metric mapping configuration file name.").String()
 		readBuffer           = kingpin.Flag("statsd.read-buffer", "Size (in bytes) of the operating system's transmit read buffer associated with the UDP or Unixgram connection. Please make sure the kernel parameters net.core.rmem_max is set to a value greater than the value specified.").Int()
+		maxLineLength        = kingpin.Flag("statsd.max-line-length", "Maximum length (in bytes) of lines on TCP and Unix stream connections. Longer lines are skipped.").Default("4096").Int()
+		tcpMaxConnections    = kingpin.Flag("statsd.tcp.max-connections", "Maximum number of open TCP connections. Further connections are closed right away. 0 means no limit.").Default("0").Int()
+		tcpIdleTimeout       = kingpin.Flag("statsd.tcp.idle-timeout", "Close TCP connections that send nothing for this long. 0 disables the timeout.").Default("0s").Duration()
+		tcpKeepAlive         = kingpin.Flag("statsd.tcp.keepalive", "Period of keepalive probes on TCP connections. A negative value disables them.").Default("15s").Duration()
+		compressionEnabled   = kingpin.Flag("statsd.compression", "Accept gzip compressed datagrams and TCP and Unix stream connections. zstd is not supported, zstd payloads are dropped.").Default("false").Bool()
+		compressionMaxSize   = kingpin.Flag("statsd.compression.max-size", "Maximum decompressed size (in bytes) of a compressed datagram, and allowance of a compressed stream beyond --statsd.compression.max-ratio.").Default("1048576").Int()
+		compressionMaxRatio  = kingpin.Flag("statsd.compression.max-ratio", "Maximum ratio of the decompressed to the compressed size of streams.").Default("100").Float64()
 		cacheSize            = kingpin.Flag("statsd.cache-size", "Maximum size of your metric mapping cache. Relies on least recently used replacement policy if max size is reached.").Default("1000").Int()
 		cacheType            = kingpin.Flag("statsd.cache-type", "Metric mapping cache type. Valid options are \"lru\" and \"random\"").Default("lru").Enum("lru", "random")
 		eventQueueSize       = kingpin.Flag("statsd.event-queue-size", "Size of internal queue for processing events.").Default("10000").Uint()
 		eventFlushThreshold  = kingpin.Flag("statsd.event-flush-threshold", "Number of events to hold in queue before flushing.").Default("1000").Int()
 		eventFlushInterval   = kingpin.Flag("statsd.event-flush-interval", "Maximum time between event queue flushes.").Default("200ms").Duration()
+		eventQueueOverflow   = kingpin.Flag("statsd.event-queue-overflow", "What to do with events when the event queue is full. One of: block, drop-newest, drop-oldest, sample.").Default("block").Enum("block", "drop-newest", "drop-oldest", "sample")
+		aclConfig            = kingpin.Flag("statsd.acl-config", "ACL configuration file name, which restricts who may send metrics. It is reloaded along with the mapping config. Everyone may send metrics if unset.").String()
+		rateLimitConfig      = kingpin.Flag("statsd.rate-limit-config", "Rate limit configuration file name. Lines are not rate limited if unset.").String()
+		sourceLabels         = kingpin.Flag("statsd.source-labels", "How to name the senders of metrics for the source_label of mappings. One of: none, ip, hostname.").Default("none").Enum("none", "ip", "hostname")
+		proxyProtocol        = kingpin.Flag("statsd.proxy-protocol", "Listener to accept PROXY protocol headers on, tcp or udp. Can be repeated.").Enums("tcp", "udp")
+		proxyProtocolTrusted = kingpin.Flag("statsd.proxy-protocol.trusted", "Network in CIDR notation that PROXY protocol listeners accept headers from. Can be repeated. Required by --statsd.proxy-protocol.").Strings()
+		shards               = kingpin.Flag("statsd.shards", "Number of workers that map and record events in parallel.").Default("1").Int()
 		dumpFSMPath          = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
+		unmappedTrackerSize  = kingpin.Flag("debug.unmapped-metrics", "Number of most frequent unmapped metrics to keep track of. 0 disables tracking.").Default("100").Int()
+		snapshotFile         = kingpin.Flag("snapshot.file", "File to persist the state of all metrics to, so that it survives restarts. \"\" disables persistence.").Default("").String()
+		snapshotInterval     = kingpin.Flag("snapshot.interval", "Interval between snapshots of the state of all metrics.").Default("1m").Duration()
 		checkConfig          = kingpin.Flag("check-config", "Check configuration and exit.").Default("false").Bool()
 		dogstatsdTagsEnabled = kingpin.Flag("statsd.parse-dogstatsd-tags", "Parse DogStatsd style tags. Enabled by default.").Default("true").Bool()
 		influxdbTagsEnabled  = kingpin.Flag("statsd.parse-influxdb-tags", "Parse InfluxDB style tags. Enabled by default.").Default("true").Bool()
@@ -260,13 +235,19 @@ func main() {
 		signalFXTagsEnabled  = kingpin.Flag("statsd.parse-signalfx-tags", "Parse SignalFX style tags. Enabled by default.").Default("true").Bool()
 		relayAddr            = kingpin.Flag("statsd.relay.address", "The UDP relay target address (host:port)").String()
 		relayPacketLen       = kingpin.Flag("statsd.relay.packet-length", "Maximum relay output packet length to avoid fragmentation").Default("1400").Uint()
+		upgradeTransferState = kingpin.Flag("upgrade.transfer-state", "Hand the state of all metrics over to the new process on upgrades.").Default("true").Bool()
+		upgradeTimeout       = kingpin.Flag("upgrade.timeout", "Maximum time for the new process to take over on upgrades.").Default("30s").Duration()
+
+		_                 = kingpin.Command("serve", "Run the exporter. This is the default command.").Default()
+		testMappingsCmd   = kingpin.Command("test-mappings", "Run unit tests for the mapping configuration and exit.")
+		testMappingsFiles = testMappingsCmd.Arg("test-file", "Files containing the mapping unit tests.").Required().ExistingFiles()
 	)
 
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("statsd_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
 	if err := level.SetLogLevel(promlogConfig.Level.String()); err != nil {
 		level.Error(logger).Log("msg", "failed to set log level", "error", err)
@@ -288,194 +269,133 @@ func main() {
 		parser.EnableSignalFXParsing()
 	}
 
+	if command == testMappingsCmd.FullCommand() {
+		os.Exit(runMappingTests(os.Stdout, *testMappingsFiles, *mappingConfig, parser, logger))
+	}
+
 	level.Info(logger).Log("msg", "Starting StatsD -> Prometheus Exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
 
-	events := make(chan event.Events, *eventQueueSize)
-	defer close(events)
-	eventQueue := event.NewEventQueue(events, *eventFlushThreshold, *eventFlushInterval, eventsFlushed)
-
-	thisMapper := &mapper.MetricMapper{Registerer: prometheus.DefaultRegisterer, MappingsCount: mappingsCount, Logger: logger}
+	// convert the string to octet
+	unixSocketMode := os.FileMode(0755)
+	perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Bad unix socket permission, ignoring", "mode", *statsdUnixSocketMode, "error", err)
+	} else {
+		unixSocketMode = os.FileMode(perm)
+	}
 
-	cache, err := getCache(*cacheSize, *cacheType, thisMapper.Registerer)
+	// Sockets handed over by the process being upgraded, or passed by
+	// systemd socket activation, take the place of the listen addresses of
+	// their listeners.
+	child, err := upgrade.Inherited()
 	if err != nil {
-		level.Error(logger).Log("msg", "Unable to setup metric mapper cache", "error", err)
+		level.Error(logger).Log("msg", "Unable to take over from the previous process", "error", err)
 		os.Exit(1)
 	}
-	thisMapper.UseCache(cache)
-
-	if *mappingConfig != "" {
-		err := thisMapper.InitFromFile(*mappingConfig)
+	var listenerFiles map[string]*os.File
+	if child != nil {
+		level.Info(logger).Log("msg", "Taking over from the previous process")
+		listenerFiles = child.Files
+	} else {
+		listenerFiles, err = activation.Files()
 		if err != nil {
-			level.Error(logger).Log("msg", "error loading config", "error", err)
+			level.Error(logger).Log("msg", "Unable to use the sockets passed by systemd", "error", err)
 			os.Exit(1)
 		}
-		if *dumpFSMPath != "" {
-			err := dumpFSM(thisMapper, *dumpFSMPath, logger)
+	}
+	for name := range listenerFiles {
+		level.Info(logger).Log("msg", "Using inherited socket", "listener", name)
+	}
+	webFile := listenerFiles["web"]
+	delete(listenerFiles, "web")
+
+	srv, err := server.New(
+		server.WithRegisterer(prometheus.DefaultRegisterer),
+		server.WithLogger(logger),
+		server.WithUDPAddress(*statsdListenUDP),
+		server.WithTCPAddress(*statsdListenTCP),
+		server.WithUnixgramPath(*statsdListenUnixgram, unixSocketMode),
+		server.WithUnixPath(*statsdListenUnix, unixSocketMode),
+		server.WithListenerFiles(listenerFiles),
+		server.WithListenerFilesOwned(child != nil),
+		server.WithReadBuffer(*readBuffer),
+		server.WithMaxLineLength(*maxLineLength),
+		server.WithTCPLimits(*tcpMaxConnections, *tcpIdleTimeout, *tcpKeepAlive),
+		server.WithCompression(*compressionEnabled, *compressionMaxSize, *compressionMaxRatio),
+		server.WithParser(parser),
+		server.WithMappingConfig(*mappingConfig),
+		server.WithCache(*cacheSize, *cacheType),
+		server.WithEventQueue(*eventQueueSize, *eventFlushThreshold, *eventFlushInterval),
+		server.WithEventQueueOverflow(event.OverflowPolicy(*eventQueueOverflow)),
+		server.WithACLConfig(*aclConfig),
+		server.WithRateLimitConfig(*rateLimitConfig),
+		server.WithSourceLabels(*sourceLabels),
+		server.WithProxyProtocol(contains(*proxyProtocol, "tcp"), contains(*proxyProtocol, "udp"), *proxyProtocolTrusted),
+		server.WithShards(*shards),
+		server.WithUnmappedTracker(*unmappedTrackerSize),
+		server.WithSnapshot(*snapshotFile, *snapshotInterval),
+		server.WithRelay(*relayAddr, *relayPacketLen),
+	)
+	if err != nil {
+		level.Error(logger).Log("msg", "Unable to create the StatsD server", "error", err)
+		os.Exit(1)
+	}
+	thisMapper := srv.Mapper()
+	// loadACL is nil without an ACL config, so that there is nothing to
+	// reload.
+	var loadACL aclLoader
+	if srv.ACL() != nil {
+		loadACL = func() (func(), error) {
+			c, err := srv.LoadACL()
 			if err != nil {
-				level.Error(logger).Log("msg", "error dumping FSM", "error", err)
-				// Failure to dump the FSM is an error (the user asked for it and it
-				// didn't happen) but not fatal (the exporter is fully functional
-				// afterwards).
+				return nil, err
 			}
+			return func() { srv.ACL().SetConfig(c) }, nil
 		}
 	}
 
-	exporter := exporter.NewExporter(prometheus.DefaultRegisterer, thisMapper, logger, eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	if *mappingConfig != "" && *dumpFSMPath != "" {
+		err := dumpFSM(thisMapper, *dumpFSMPath, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "error dumping FSM", "error", err)
+			// Failure to dump the FSM is an error (the user asked for it and it
+			// didn't happen) but not fatal (the exporter is fully functional
+			// afterwards).
+		}
+	}
 
 	if *checkConfig {
 		level.Info(logger).Log("msg", "Configuration check successful, exiting")
 		return
 	}
 
-	var relayTarget *relay.Relay
-	if *relayAddr != "" {
-		var err error
-		relayTarget, err = relay.NewRelay(logger, *relayAddr, *relayPacketLen)
-		if err != nil {
-			level.Error(logger).Log("msg", "Unable to create relay", "err", err)
-			os.Exit(1)
-		}
-	}
-
-	level.Info(logger).Log("msg", "Accepting StatsD Traffic", "udp", *statsdListenUDP, "tcp", *statsdListenTCP, "unixgram", *statsdListenUnixgram)
-	level.Info(logger).Log("msg", "Accepting Prometheus Requests", "addr", *listenAddress)
-
-	if *statsdListenUDP == "" && *statsdListenTCP == "" && *statsdListenUnixgram == "" {
-		level.Error(logger).Log("At least one of UDP/TCP/Unixgram listeners must be specified.")
+	webListener, err := webListen(*listenAddress, webFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "Unable to listen for Prometheus requests", "error", err)
 		os.Exit(1)
 	}
 
-	if *statsdListenUDP != "" {
-		udpListenAddr, err := address.UDPAddrFromString(*statsdListenUDP)
-		if err != nil {
-			level.Error(logger).Log("msg", "invalid UDP listen address", "address", *statsdListenUDP, "error", err)
-			os.Exit(1)
-		}
-		uconn, err := net.ListenUDP("udp", udpListenAddr)
+	if child != nil {
+		// The previous process keeps reading from the sockets until this
+		// one is ready, and then hands over its state.
+		state, err := child.Ready()
 		if err != nil {
-			level.Error(logger).Log("msg", "failed to start UDP listener", "error", err)
-			os.Exit(1)
-		}
-
-		if *readBuffer != 0 {
-			err = uconn.SetReadBuffer(*readBuffer)
-			if err != nil {
-				level.Error(logger).Log("msg", "error setting UDP read buffer", "error", err)
-				os.Exit(1)
-			}
-		}
-
-		ul := &listener.StatsDUDPListener{
-			Conn:            uconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			UDPPackets:      udpPackets,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			Relay:           relayTarget,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
+			level.Warn(logger).Log("msg", "Unable to receive the state of the previous process", "error", err)
+		} else if state != nil {
+			srv.UseSnapshot(state)
 		}
-
-		go ul.Listen()
 	}
-
-	if *statsdListenTCP != "" {
-		tcpListenAddr, err := address.TCPAddrFromString(*statsdListenTCP)
-		if err != nil {
-			level.Error(logger).Log("msg", "invalid TCP listen address", "address", *statsdListenUDP, "error", err)
-			os.Exit(1)
-		}
-		tconn, err := net.ListenTCP("tcp", tcpListenAddr)
-		if err != nil {
-			level.Error(logger).Log("msg", err)
-			os.Exit(1)
-		}
-		defer tconn.Close()
-
-		tl := &listener.StatsDTCPListener{
-			Conn:            tconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			Relay:           relayTarget,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-			TCPConnections:  tcpConnections,
-			TCPErrors:       tcpErrors,
-			TCPLineTooLong:  tcpLineTooLong,
-		}
-
-		go tl.Listen()
+	if err := srv.Start(context.Background()); err != nil {
+		level.Error(logger).Log("msg", "Unable to start the StatsD server", "error", err)
+		os.Exit(1)
 	}
-
-	if *statsdListenUnixgram != "" {
-		var err error
-		if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			level.Error(logger).Log("msg", "Unixgram socket already exists", "socket_name", *statsdListenUnixgram)
-			os.Exit(1)
-		}
-		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
-			Net:  "unixgram",
-			Name: *statsdListenUnixgram,
-		})
-		if err != nil {
-			level.Error(logger).Log("msg", "failed to listen on Unixgram socket", "error", err)
-			os.Exit(1)
-		}
-
-		defer uxgconn.Close()
-
-		if *readBuffer != 0 {
-			err = uxgconn.SetReadBuffer(*readBuffer)
-			if err != nil {
-				level.Error(logger).Log("msg", "error setting Unixgram read buffer", "error", err)
-				os.Exit(1)
-			}
-		}
-
-		ul := &listener.StatsDUnixgramListener{
-			Conn:            uxgconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			UnixgramPackets: unixgramPackets,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			Relay:           relayTarget,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-		}
-
-		go ul.Listen()
-
-		// if it's an abstract unix domain socket, it won't exist on fs
-		// so we can't chmod it either
-		if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			defer os.Remove(*statsdListenUnixgram)
-
-			// convert the string to octet
-			perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
-			if err != nil {
-				level.Warn(logger).Log("Bad permission %s: %v, ignoring\n", *statsdUnixSocketMode, err)
-			} else {
-				err = os.Chmod(*statsdListenUnixgram, os.FileMode(perm))
-				if err != nil {
-					level.Warn(logger).Log("Failed to change unixgram socket permission: %v", err)
-				}
-			}
+	if child != nil {
+		if err := child.Started(); err != nil {
+			level.Warn(logger).Log("msg", "Unable to notify the previous process", "error", err)
 		}
 	}
+	level.Info(logger).Log("msg", "Accepting Prometheus Requests", "addr", webListener.Addr())
 
 	mux := http.DefaultServeMux
 	mux.Handle(*metricsEndpoint, promhttp.Handler())
@@ -492,17 +412,8 @@ func main() {
 	quitChan := make(chan struct{}, 1)
 
 	if *enableLifecycle {
-		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodPut || r.Method == http.MethodPost {
-				fmt.Fprintf(w, "Requesting reload")
-				if *mappingConfig == "" {
-					level.Warn(logger).Log("msg", "Received lifecycle api reload but no mapping config to reload")
-					return
-				}
-				level.Info(logger).Log("msg", "Received lifecycle api reload, attempting reload")
-				reloadConfig(*mappingConfig, thisMapper, logger)
-			}
-		})
+		mux.HandleFunc("/-/reload", reloadHandler(*mappingConfig, thisMapper, srv.Exporter().Unmapped, loadACL, logger))
+		mux.HandleFunc("/-/validate", validateConfigHandler(logger))
 		mux.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == http.MethodPut || r.Method == http.MethodPost {
 				fmt.Fprintf(w, "Requesting termination... Goodbye!")
@@ -511,6 +422,11 @@ func main() {
 		})
 	}
 
+	mux.HandleFunc("/api/v1/mapping/explain", explainHandler(thisMapper, parser, logger))
+	if tracker := srv.Exporter().Unmapped; tracker != nil {
+		mux.HandleFunc("/api/v1/mapping/unmapped", unmappedHandler(tracker, thisMapper, logger))
+	}
+
 	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			level.Debug(logger).Log("msg", "Received health check")
@@ -519,27 +435,144 @@ func main() {
 		}
 	})
 
+	// shuttingDown is set once the shutdown starts, so that the exporter
+	// reports that it is no longer ready while it still serves metrics.
+	var shuttingDown int32
 	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			level.Debug(logger).Log("msg", "Received ready check")
+			if atomic.LoadInt32(&shuttingDown) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "Statsd Exporter is shutting down.\n")
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "Statsd Exporter is Ready.\n")
 		}
 	})
 
-	go serveHTTP(mux, *listenAddress, logger)
+	httpServer := &http.Server{Handler: mux}
+	go serveHTTP(httpServer, webListener, logger)
 
-	go sighupConfigReloader(*mappingConfig, thisMapper, logger)
-	go exporter.Listen(events)
+	go sighupConfigReloader(*mappingConfig, thisMapper, srv.Exporter().Unmapped, loadACL, logger)
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	upgrades := make(chan os.Signal, 1)
+	if upgrade.Signal != nil {
+		signal.Notify(upgrades, upgrade.Signal)
+	}
+
+	// quit if we get a message on any channel
+	exitCode := 0
+	var newProcess *upgrade.Parent
+	for newProcess == nil {
+		select {
+		case sig := <-signals:
+			level.Info(logger).Log("msg", "Received os signal, exiting", "signal", sig.String())
+		case <-quitChan:
+			level.Info(logger).Log("msg", "Received lifecycle api quit, exiting")
+		case err := <-srv.Errors():
+			level.Error(logger).Log("msg", "Stopped receiving StatsD traffic, exiting", "error", err)
+			exitCode = 1
+		case sig := <-upgrades:
+			level.Info(logger).Log("msg", "Received signal, upgrading", "signal", sig.String())
+			newProcess, err = startUpgrade(srv, webListener, *upgradeTimeout)
+			if err != nil {
+				level.Error(logger).Log("msg", "Upgrade failed, continuing", "error", err)
+			}
+			continue
+		}
+		break
+	}
+
+	if newProcess != nil {
+		// The new process serves both StatsD and Prometheus requests from
+		// now on, so there is no grace period.
+		srv.KeepSockets()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			level.Error(logger).Log("msg", "Failed to shut down the StatsD server", "error", err)
+		}
+		var state *snapshot.Snapshot
+		if *upgradeTransferState {
+			state = srv.Exporter().Snapshot()
+		}
+		if err := newProcess.Finish(state, *upgradeTimeout); err != nil {
+			level.Error(logger).Log("msg", "The new process did not take over", "pid", newProcess.Pid(), "error", err)
+			exitCode = 1
+		} else {
+			level.Info(logger).Log("msg", "Handed over to the new process, exiting", "pid", newProcess.Pid())
+		}
+		httpServer.Close()
+		os.Exit(exitCode)
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	// Process all events that have been received before the grace period
+	// starts.
+	if err := srv.Shutdown(context.Background()); err != nil {
+		level.Error(logger).Log("msg", "Failed to shut down the StatsD server", "error", err)
+	}
+
+	if *shutdownGracePeriod > 0 {
+		level.Info(logger).Log("msg", "All events processed, serving metrics until the grace period ends", "grace_period", *shutdownGracePeriod)
+		select {
+		case <-time.After(*shutdownGracePeriod):
+		case sig := <-signals:
+			level.Info(logger).Log("msg", "Received os signal, ending grace period", "signal", sig.String())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := httpServer.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("msg", "Failed to shut down HTTP server", "error", err)
+	}
+	cancel()
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
 
-	// quit if we get a message on either channel
-	select {
-	case sig := <-signals:
-		level.Info(logger).Log("msg", "Received os signal, exiting", "signal", sig.String())
-	case <-quitChan:
-		level.Info(logger).Log("msg", "Received lifecycle api quit, exiting")
+// webListen returns the listener for Prometheus requests, created from the
+// inherited socket f if there is one.
+func webListen(address string, f *os.File) (net.Listener, error) {
+	if f == nil {
+		return net.Listen("tcp", address)
 	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// startUpgrade starts a new process of the exporter with the same arguments,
+// and hands it the listening sockets. It returns once the new process is
+// ready to take over.
+func startUpgrade(srv *server.Server, webListener net.Listener, timeout time.Duration) (*upgrade.Parent, error) {
+	if upgrade.Signal == nil {
+		return nil, upgrade.ErrNotSupported
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files, err := srv.ListenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if l, ok := webListener.(interface{ File() (*os.File, error) }); ok {
+		f, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("web listener: %w", err)
+		}
+		files["web"] = f
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return upgrade.Start(cmd, files, timeout)
 }
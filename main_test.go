@@ -0,0 +1,209 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
+)
+
+const validConfig = `
+mappings:
+- match: test.*.*
+  name: "test_metric"
+  labels:
+    first: "$1"
+    second: "$2"
+`
+
+const invalidConfig = `
+mappings:
+- match: test.*.*
+  labels:
+    first: "$1"
+`
+
+func TestReloadHandler(t *testing.T) {
+	f, err := ioutil.TempFile("", "statsd_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(validConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	m := &mapper.MetricMapper{}
+	tracker := unmapped.NewTracker(10)
+	tracker.Observe("test.a.b", mapper.MetricTypeCounter, nil)
+	handler := reloadHandler(f.Name(), m, tracker, nil, log.NewNopLogger())
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d for valid config, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if len(m.Mappings) != 1 {
+		t.Fatalf("expected 1 mapping after reload, got %d", len(m.Mappings))
+	}
+	// The unmapped metrics may be mapped by the new configuration.
+	if top := tracker.Top(0); len(top) != 0 {
+		t.Fatalf("expected the unmapped metrics to be reset after reload, got %v", top)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte(invalidConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d for invalid config, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "didn't set a metric name") {
+		t.Fatalf("expected parse error in response, got %q", rec.Body.String())
+	}
+	if len(m.Mappings) != 1 {
+		t.Fatalf("failed reload must keep the previous mappings, got %d", len(m.Mappings))
+	}
+}
+
+func TestValidateConfigHandler(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		method string
+		config string
+		code   int
+	}{
+		{
+			name:   "valid config",
+			method: http.MethodPost,
+			config: validConfig,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "invalid config",
+			method: http.MethodPut,
+			config: invalidConfig,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "malformed yaml",
+			method: http.MethodPost,
+			config: "mappings: [",
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	handler := validateConfigHandler(log.NewNopLogger())
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(s.method, "/-/validate", strings.NewReader(s.config)))
+			if rec.Code != s.code {
+				t.Fatalf("expected status %d, got %d: %s", s.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReloadHandlerACL(t *testing.T) {
+	var (
+		applied int
+		aclErr  error
+	)
+	loadACL := func() (func(), error) {
+		if aclErr != nil {
+			return nil, aclErr
+		}
+		return func() { applied++ }, nil
+	}
+	handler := reloadHandler("", &mapper.MetricMapper{}, nil, loadACL, log.NewNopLogger())
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusOK || applied != 1 {
+		t.Fatalf("expected the ACL to be reloaded without a mapping config, got status %d after %d reloads", rec.Code, applied)
+	}
+
+	aclErr = errors.New("invalid ACL config")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "invalid ACL config") {
+		t.Fatalf("expected the ACL error in a 500 response, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReloadHandlerAtomic(t *testing.T) {
+	f, err := ioutil.TempFile("", "statsd_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	var (
+		applied int
+		aclErr  error
+	)
+	loadACL := func() (func(), error) {
+		if aclErr != nil {
+			return nil, aclErr
+		}
+		return func() { applied++ }, nil
+	}
+	m := &mapper.MetricMapper{}
+	handler := reloadHandler(f.Name(), m, nil, loadACL, log.NewNopLogger())
+	reload := func(config string, code int) {
+		t.Helper()
+		if err := ioutil.WriteFile(f.Name(), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+		if rec.Code != code {
+			t.Fatalf("expected status %d, got %d: %s", code, rec.Code, rec.Body.String())
+		}
+	}
+
+	reload(validConfig, http.StatusOK)
+	if len(m.Mappings) != 1 || applied != 1 {
+		t.Fatalf("expected both configs to be applied, got %d mappings and %d ACL reloads", len(m.Mappings), applied)
+	}
+
+	// An invalid mapping config keeps the previous ACL.
+	reload(invalidConfig, http.StatusInternalServerError)
+	if applied != 1 {
+		t.Fatal("expected the ACL not to be applied with an invalid mapping config")
+	}
+
+	// An invalid ACL config keeps the previous mappings.
+	aclErr = errors.New("invalid ACL config")
+	reload(validConfig+`- match: other.*
+  name: "other_metric"
+`, http.StatusInternalServerError)
+	if len(m.Mappings) != 1 {
+		t.Fatalf("expected the previous mappings with an invalid ACL config, got %d", len(m.Mappings))
+	}
+}
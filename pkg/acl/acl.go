@@ -0,0 +1,223 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acl restricts who may send StatsD lines to the listeners, by
+// network for UDP and TCP and by user or group for Unixgram and Unix stream
+// sockets.
+package acl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/address"
+)
+
+// Config is the ACL configuration.
+type Config struct {
+	UDP      Networks    `yaml:"udp"`
+	TCP      Networks    `yaml:"tcp"`
+	Unixgram Credentials `yaml:"unixgram"`
+	Unix     Credentials `yaml:"unix"`
+}
+
+// Networks allows senders by their IP address. Addresses in Deny are
+// denied. If Allow is not empty, addresses that are not in it are denied as
+// well. The networks are in CIDR notation, plain IP addresses are single
+// hosts.
+type Networks struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Credentials allows the processes sending to a Unixgram or Unix stream
+// socket by their user or group ID. If both lists are empty, all processes are allowed.
+// Otherwise processes are allowed if their user ID is in UIDs or their group
+// ID is in GIDs, and processes whose credentials are unknown are denied.
+type Credentials struct {
+	UIDs []uint32 `yaml:"uids"`
+	GIDs []uint32 `yaml:"gids"`
+}
+
+// ParseConfig parses and validates an ACL configuration.
+func ParseConfig(s string) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict([]byte(s), &c); err != nil {
+		return nil, err
+	}
+	if err := c.UDP.init(); err != nil {
+		return nil, fmt.Errorf("udp: %w", err)
+	}
+	if err := c.TCP.init(); err != nil {
+		return nil, fmt.Errorf("tcp: %w", err)
+	}
+	return &c, nil
+}
+
+// LoadConfig reads an ACL configuration from a file.
+func LoadConfig(fileName string) (*Config, error) {
+	s, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(string(s))
+}
+
+func (n *Networks) init() error {
+	var err error
+	if n.allow, err = address.NetworksFromStrings(n.Allow); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	if n.deny, err = address.NetworksFromStrings(n.Deny); err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	return nil
+}
+
+// Allows reports whether ip is allowed.
+func (n *Networks) Allows(ip net.IP) bool {
+	if contains(n.deny, ip) {
+		return false
+	}
+	return len(n.allow) == 0 || contains(n.allow, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether a process with the given user and group ID is
+// allowed. ok is false if the credentials are unknown.
+func (c *Credentials) Allows(uid, gid uint32, ok bool) bool {
+	if len(c.UIDs) == 0 && len(c.GIDs) == 0 {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	for _, u := range c.UIDs {
+		if u == uid {
+			return true
+		}
+	}
+	for _, g := range c.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics are the metrics of ACLs.
+type Metrics struct {
+	// Denied counts the denied UDP and Unixgram packets and TCP and Unix
+	// stream connections, by listener.
+	Denied *prometheus.CounterVec
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	var m Metrics
+
+	m.Denied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_acl_denied_total",
+			Help: "The number of StatsD packets and connections denied by the ACL, by listener.",
+		},
+		[]string{"listener"},
+	)
+
+	if reg != nil {
+		reg.MustRegister(m.Denied)
+	}
+	return &m
+}
+
+// ACL decides which senders are allowed. It is safe for concurrent use, and
+// its configuration can be replaced while it is in use.
+type ACL struct {
+	mu     sync.RWMutex
+	config *Config
+
+	udpDenied      prometheus.Counter
+	tcpDenied      prometheus.Counter
+	unixgramDenied prometheus.Counter
+	unixDenied     prometheus.Counter
+}
+
+// New creates an ACL for the given configuration.
+func New(c *Config, m *Metrics) *ACL {
+	return &ACL{
+		config:         c,
+		udpDenied:      m.Denied.WithLabelValues("udp"),
+		tcpDenied:      m.Denied.WithLabelValues("tcp"),
+		unixgramDenied: m.Denied.WithLabelValues("unixgram"),
+		unixDenied:     m.Denied.WithLabelValues("unix"),
+	}
+}
+
+// SetConfig replaces the configuration, for example after it was reloaded.
+func (a *ACL) SetConfig(c *Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.config = c
+}
+
+func (a *ACL) getConfig() *Config {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.config
+}
+
+// AllowUDP reports whether a UDP packet from ip is allowed.
+func (a *ACL) AllowUDP(ip net.IP) bool {
+	return count(a.getConfig().UDP.Allows(ip), a.udpDenied)
+}
+
+// AllowTCP reports whether a TCP connection from ip is allowed.
+func (a *ACL) AllowTCP(ip net.IP) bool {
+	return count(a.getConfig().TCP.Allows(ip), a.tcpDenied)
+}
+
+// AllowUnixgram reports whether a Unixgram datagram from a process with the
+// given user and group ID is allowed. ok is false if the credentials are
+// unknown.
+func (a *ACL) AllowUnixgram(uid, gid uint32, ok bool) bool {
+	return count(a.getConfig().Unixgram.Allows(uid, gid, ok), a.unixgramDenied)
+}
+
+// AllowUnix reports whether a Unix stream connection from a process with the
+// given user and group ID is allowed. ok is false if the credentials are
+// unknown.
+func (a *ACL) AllowUnix(uid, gid uint32, ok bool) bool {
+	return count(a.getConfig().Unix.Allows(uid, gid, ok), a.unixDenied)
+}
+
+func count(allowed bool, denied prometheus.Counter) bool {
+	if !allowed {
+		denied.Inc()
+	}
+	return allowed
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseConfig(t *testing.T) {
+	scenarios := []struct {
+		config string
+		valid  bool
+	}{
+		{config: ``, valid: true},
+		{config: "udp: {allow: [10.0.0.0/8], deny: [10.1.0.0/16]}", valid: true},
+		{config: "tcp: {allow: ['192.0.2.1', '2001:db8::/32']}", valid: true},
+		{config: "unixgram: {uids: [0, 1000], gids: [100]}", valid: true},
+		{config: "unix: {uids: [1000]}", valid: true},
+		{config: "udp: {allow: [10.0.0.0/33]}", valid: false},
+		{config: "tcp: {deny: [example.com]}", valid: false},
+		{config: "unixgram: {uids: [-1]}", valid: false},
+		{config: "http: {allow: [10.0.0.0/8]}", valid: false},
+	}
+	for _, s := range scenarios {
+		_, err := ParseConfig(s.config)
+		if s.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", s.config, err)
+		}
+		if !s.valid && err == nil {
+			t.Errorf("%q: expected an error", s.config)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	c, err := ParseConfig(`
+udp:
+  allow: [10.0.0.0/8, '2001:db8::/32']
+  deny: [10.1.0.0/16]
+tcp:
+  deny: [192.0.2.1]
+unixgram:
+  uids: [1000]
+  gids: [100]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics(nil)
+	a := New(c, m)
+
+	udp := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"2001:db8::1", true},
+		{"10.1.0.1", false},
+		{"192.0.2.1", false},
+	}
+	for _, s := range udp {
+		if got := a.AllowUDP(net.ParseIP(s.ip)); got != s.allowed {
+			t.Errorf("udp %s: expected allowed %v, got %v", s.ip, s.allowed, got)
+		}
+	}
+
+	tcp := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"2001:db8::1", true},
+	}
+	for _, s := range tcp {
+		if got := a.AllowTCP(net.ParseIP(s.ip)); got != s.allowed {
+			t.Errorf("tcp %s: expected allowed %v, got %v", s.ip, s.allowed, got)
+		}
+	}
+
+	unixgram := []struct {
+		uid, gid    uint32
+		ok, allowed bool
+	}{
+		{1000, 1000, true, true},
+		{0, 100, true, true},
+		{0, 0, true, false},
+		{1000, 100, false, false},
+	}
+	for _, s := range unixgram {
+		if got := a.AllowUnixgram(s.uid, s.gid, s.ok); got != s.allowed {
+			t.Errorf("unixgram %d:%d (%v): expected allowed %v, got %v", s.uid, s.gid, s.ok, s.allowed, got)
+		}
+	}
+
+	// The Unixgram lists don't apply to Unix stream connections.
+	if !a.AllowUnix(0, 0, true) {
+		t.Errorf("unix: expected everyone to be allowed without a unix section")
+	}
+	unix, err := ParseConfig("unix: {uids: [1000]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetConfig(unix)
+	if a.AllowUnix(0, 100, true) || !a.AllowUnix(1000, 0, true) {
+		t.Errorf("unix: expected only user ID 1000 to be allowed")
+	}
+
+	for listener, want := range map[string]float64{"udp": 2, "tcp": 1, "unixgram": 2, "unix": 1} {
+		if got := testutil.ToFloat64(m.Denied.WithLabelValues(listener)); got != want {
+			t.Errorf("expected %v denied for %s, got %v", want, listener, got)
+		}
+	}
+
+	// An empty configuration allows everyone, even processes without
+	// credentials.
+	empty, _ := ParseConfig(``)
+	a.SetConfig(empty)
+	if !a.AllowUDP(net.ParseIP("10.1.0.1")) || !a.AllowTCP(net.ParseIP("192.0.2.1")) || !a.AllowUnixgram(0, 0, false) {
+		t.Errorf("expected everything to be allowed after reloading an empty configuration")
+	}
+}
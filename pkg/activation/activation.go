@@ -0,0 +1,89 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package activation receives the sockets passed by systemd socket
+// activation. See sd_listen_fds(3).
+package activation
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// Files returns the sockets passed to the process, by their name as given by
+// FileDescriptorName= in the socket unit. It returns nil if no sockets were
+// passed. The environment variables are unset, so that child processes
+// don't take the sockets for their own.
+func Files() (map[string]*os.File, error) {
+	names, err := parseEnv(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || names == nil {
+		return nil, err
+	}
+
+	files := make(map[string]*os.File, len(names))
+	for i, name := range names {
+		fd := listenFdsStart + i
+		closeOnExec(fd)
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
+
+// parseEnv returns the names of the sockets passed to the process pid, in
+// the order of their file descriptors, or nil if none were passed.
+func parseEnv(pid int, listenPid, listenFds, listenFdNames string) ([]string, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); err != nil || p != pid {
+		// The sockets were passed to another process, which passed on
+		// its environment.
+		return nil, nil
+	}
+	n, err := strconv.Atoi(listenFds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", listenFds)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, n)
+	if listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+		if len(names) != n {
+			return nil, fmt.Errorf("LISTEN_FDNAMES has %d names for %d sockets", len(names), n)
+		}
+	}
+	seen := make(map[string]bool, n)
+	for i, name := range names {
+		if name == "" {
+			// systemd's default name.
+			name = "unknown"
+			names[i] = name
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("more than one socket is named %q", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package activation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	scenarios := []struct {
+		name              string
+		pid, fds, fdNames string
+		expected          []string
+		err               bool
+	}{
+		{name: "not activated"},
+		{name: "other process", pid: "2", fds: "1", fdNames: "udp"},
+		{name: "no sockets", pid: "1", fds: "0"},
+		{name: "named", pid: "1", fds: "3", fdNames: "udp:tcp:unixgram", expected: []string{"udp", "tcp", "unixgram"}},
+		{name: "unnamed", pid: "1", fds: "1", expected: []string{"unknown"}},
+		{name: "invalid count", pid: "1", fds: "x", err: true},
+		{name: "names mismatch", pid: "1", fds: "2", fdNames: "udp", err: true},
+		{name: "duplicate names", pid: "1", fds: "2", fdNames: "udp:udp", err: true},
+		{name: "duplicate unnamed", pid: "1", fds: "2", err: true},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			names, err := parseEnv(1, s.pid, s.fds, s.fdNames)
+			if s.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, s.expected) {
+				t.Fatalf("expected %v, got %v", s.expected, names)
+			}
+		})
+	}
+}
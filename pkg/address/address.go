@@ -64,3 +64,25 @@ func TCPAddrFromString(addr string) (*net.TCPAddr, error) {
 		Zone: ip.Zone,
 	}, nil
 }
+
+// NetworksFromStrings parses a list of networks in CIDR notation, such as
+// "10.0.0.0/8". A plain IP address is a network of its own.
+func NetworksFromStrings(networks []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range networks {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %s: %s", s, err)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compression decompresses StatsD payloads that the sender
+// compressed. Compressed datagrams and streams are recognized by the magic
+// bytes of their format, which can't start a StatsD line, so compressed and
+// plain payloads can be mixed.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Formats of compressed payloads.
+const (
+	FormatGzip = "gzip"
+	// FormatZstd is recognized, but not supported, as the standard library
+	// has no zstd decoder.
+	FormatZstd = "zstd"
+)
+
+var magics = []struct {
+	format string
+	magic  []byte
+}{
+	{FormatGzip, []byte{0x1f, 0x8b}},
+	{FormatZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Reasons why payloads can't be decompressed.
+const (
+	ReasonUnsupported = "unsupported"
+	ReasonInvalid     = "invalid"
+	ReasonTooLarge    = "too_large"
+)
+
+// Error is returned for payloads that can't be decompressed.
+type Error struct {
+	// Reason is one of the Reason constants.
+	Reason string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("decompression failed (%s): %v", e.Reason, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Metrics are the metrics of decompressors.
+type Metrics struct {
+	// All metrics are labeled by proto, the listener the payloads were
+	// received on.
+	Payloads          *prometheus.CounterVec
+	CompressedBytes   *prometheus.CounterVec
+	DecompressedBytes *prometheus.CounterVec
+	Ratio             *prometheus.HistogramVec
+	Errors            *prometheus.CounterVec
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	var m Metrics
+
+	m.Payloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_compressed_payloads_total",
+			Help: "The number of compressed datagrams and streams received.",
+		},
+		[]string{"proto", "format"},
+	)
+	m.CompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_compressed_bytes_total",
+			Help: "The number of compressed bytes received.",
+		},
+		[]string{"proto"},
+	)
+	m.DecompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_decompressed_bytes_total",
+			Help: "The number of bytes that compressed payloads decompressed to.",
+		},
+		[]string{"proto"},
+	)
+	m.Ratio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "statsd_exporter_compression_ratio",
+			Help:    "The ratio of the decompressed to the compressed size of payloads.",
+			Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+		},
+		[]string{"proto"},
+	)
+	m.Errors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_decompression_errors_total",
+			Help: "The number of compressed payloads that could not be decompressed.",
+		},
+		[]string{"proto", "reason"},
+	)
+
+	if reg != nil {
+		reg.MustRegister(m.Payloads, m.CompressedBytes, m.DecompressedBytes, m.Ratio, m.Errors)
+	}
+	return &m
+}
+
+// Decompressor decompresses datagrams and streams within bounds, so that
+// small payloads can't expand to arbitrary amounts of data. It is safe for
+// concurrent use.
+type Decompressor struct {
+	maxSize  int
+	maxRatio float64
+	metrics  *Metrics
+}
+
+// New returns a Decompressor. A datagram may decompress to at most maxSize
+// bytes. A stream has no overall size, so it may decompress to at most
+// maxSize bytes plus maxRatio times the compressed bytes read so far.
+func New(maxSize int, maxRatio float64, m *Metrics) *Decompressor {
+	return &Decompressor{maxSize: maxSize, maxRatio: maxRatio, metrics: m}
+}
+
+// format returns the format of the compressed payload b starts with, or ""
+// if b doesn't start with one.
+func format(b []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.format
+		}
+	}
+	return ""
+}
+
+func (d *Decompressor) fail(proto, reason string, err error) error {
+	d.metrics.Errors.WithLabelValues(proto, reason).Inc()
+	return &Error{Reason: reason, Err: err}
+}
+
+// Datagram returns the decompressed datagram b received on the listener
+// proto, or b itself if it is not compressed.
+func (d *Decompressor) Datagram(proto string, b []byte) ([]byte, error) {
+	f := format(b)
+	if f == "" {
+		return b, nil
+	}
+	d.metrics.Payloads.WithLabelValues(proto, f).Inc()
+	if f != FormatGzip {
+		return nil, d.fail(proto, ReasonUnsupported, fmt.Errorf("%s is not supported", f))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, d.fail(proto, ReasonInvalid, err)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(zr, int64(d.maxSize)+1))
+	if err != nil {
+		return nil, d.fail(proto, ReasonInvalid, err)
+	}
+	if len(out) > d.maxSize {
+		return nil, d.fail(proto, ReasonTooLarge, fmt.Errorf("decompressed size exceeds %d bytes", d.maxSize))
+	}
+
+	d.metrics.CompressedBytes.WithLabelValues(proto).Add(float64(len(b)))
+	d.metrics.DecompressedBytes.WithLabelValues(proto).Add(float64(len(out)))
+	d.metrics.Ratio.WithLabelValues(proto).Observe(float64(len(out)) / float64(len(b)))
+	return out, nil
+}
+
+// Stream returns a reader of the decompressed stream if r, a connection on
+// the listener proto, starts with a compressed payload, and nil otherwise.
+// The reader has to be closed once the connection ends. Errors of the
+// decompression are of type *Error, read errors of the connection are
+// returned as they are.
+func (d *Decompressor) Stream(proto string, r *bufio.Reader) (*Stream, error) {
+	// Peek no further than needed, as plain lines may be short, and the
+	// sender may wait for a response.
+	var f string
+	first, _ := r.Peek(1)
+	for _, m := range magics {
+		if len(first) == 0 || first[0] != m.magic[0] {
+			continue
+		}
+		if b, _ := r.Peek(len(m.magic)); bytes.Equal(b, m.magic) {
+			f = m.format
+		}
+		break
+	}
+	if f == "" {
+		return nil, nil
+	}
+	d.metrics.Payloads.WithLabelValues(proto, f).Inc()
+	if f != FormatGzip {
+		return nil, d.fail(proto, ReasonUnsupported, fmt.Errorf("%s is not supported", f))
+	}
+
+	src := &countingReader{r: r}
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, d.streamError(proto, err)
+	}
+	// The next member is only read once the caller asks for more, as a
+	// connection is idle after a member until the sender has more lines.
+	zr.Multistream(false)
+	return &Stream{d: d, proto: proto, src: src, zr: zr}, nil
+}
+
+// Stream is a decompressed stream.
+type Stream struct {
+	d            *Decompressor
+	proto        string
+	src          *countingReader
+	zr           *gzip.Reader
+	compressed   int64 // as reported to the metrics
+	decompressed int64
+	// memberDone is set at the end of each gzip member.
+	memberDone bool
+	err        error
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for s.err == nil {
+		if s.memberDone {
+			// The end of the connection after a member is the end of
+			// the stream.
+			if err := s.zr.Reset(s.src); err != nil {
+				if err != io.EOF {
+					err = s.d.streamError(s.proto, err)
+				}
+				s.err = err
+				break
+			}
+			s.zr.Multistream(false)
+			s.memberDone = false
+		}
+
+		n, err := s.zr.Read(p)
+		s.decompressed += int64(n)
+		m := s.d.metrics
+		m.CompressedBytes.WithLabelValues(s.proto).Add(float64(s.src.n - s.compressed))
+		m.DecompressedBytes.WithLabelValues(s.proto).Add(float64(n))
+		s.compressed = s.src.n
+
+		if limit := float64(s.d.maxSize) + s.d.maxRatio*float64(s.compressed); float64(s.decompressed) > limit {
+			s.err = s.d.fail(s.proto, ReasonTooLarge, errors.New("decompressed size exceeds the maximum ratio"))
+			break
+		}
+		switch {
+		case err == io.EOF:
+			s.memberDone = true
+		case err != nil:
+			s.err = s.d.streamError(s.proto, err)
+			return n, s.err
+		}
+		// An empty member has nothing to return, so the next one is read.
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		}
+	}
+	return 0, s.err
+}
+
+// streamError returns the error of decompressing a stream. Read errors of
+// the connection are returned as they are, as they are not the fault of the
+// payload.
+func (d *Decompressor) streamError(proto string, err error) error {
+	var re *readError
+	if errors.As(err, &re) {
+		return re.err
+	}
+	return d.fail(proto, ReasonInvalid, err)
+}
+
+// Close records the compression ratio of the stream.
+func (s *Stream) Close() error {
+	if s.compressed > 0 {
+		s.d.metrics.Ratio.WithLabelValues(s.proto).Observe(float64(s.decompressed) / float64(s.compressed))
+	}
+	return s.zr.Close()
+}
+
+// countingReader counts the bytes read from r. It is an io.ByteReader, so
+// that the decompressor reads no further than it needs.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+// readError marks the errors of the underlying reader.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, wrapReadError(err)
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, wrapReadError(err)
+}
+
+func wrapReadError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &readError{err: err}
+}
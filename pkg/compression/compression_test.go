@@ -0,0 +1,146 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func compress(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func expectReason(t *testing.T, err error, reason string) {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) || e.Reason != reason {
+		t.Fatalf("expected a %s error, got %v", reason, err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	m := NewMetrics(nil)
+	d := New(1000, 10, m)
+
+	plain := []byte("foo:1|c\nbar:2|g")
+	if out, err := d.Datagram("udp", plain); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("expected a plain datagram to be returned as it is, got %q, %v", out, err)
+	}
+
+	out, err := d.Datagram("udp", compress(t, string(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Fatalf("expected %q, got %q", plain, out)
+	}
+	if n := testutil.ToFloat64(m.DecompressedBytes.WithLabelValues("udp")); n != float64(len(plain)) {
+		t.Fatalf("expected %d decompressed bytes, got %v", len(plain), n)
+	}
+
+	// The maximum size applies to datagrams, however well they compress.
+	_, err = d.Datagram("udp", compress(t, strings.Repeat("foo:1|c\n", 200)))
+	expectReason(t, err, ReasonTooLarge)
+
+	_, err = d.Datagram("udp", []byte{0x1f, 0x8b, 0, 0})
+	expectReason(t, err, ReasonInvalid)
+
+	_, err = d.Datagram("udp", []byte{0x28, 0xb5, 0x2f, 0xfd, 0})
+	expectReason(t, err, ReasonUnsupported)
+
+	for reason, expected := range map[string]float64{ReasonTooLarge: 1, ReasonInvalid: 1, ReasonUnsupported: 1} {
+		if n := testutil.ToFloat64(m.Errors.WithLabelValues("udp", reason)); n != expected {
+			t.Errorf("expected %v %s errors, got %v", expected, reason, n)
+		}
+	}
+	if n := testutil.ToFloat64(m.Payloads.WithLabelValues("udp", FormatGzip)); n != 3 {
+		t.Errorf("expected 3 gzip payloads, got %v", n)
+	}
+}
+
+func TestStream(t *testing.T) {
+	m := NewMetrics(nil)
+	d := New(100, 10, m)
+
+	// A plain stream is left alone, even if it starts like a compressed
+	// one.
+	for _, plain := range []string{"foo:1|c\n", "(foo:1|c\n", "f"} {
+		r := bufio.NewReader(strings.NewReader(plain))
+		s, err := d.Stream("tcp", r)
+		if err != nil || s != nil {
+			t.Fatalf("%q: expected no decompression, got %v, %v", plain, s, err)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != plain {
+			t.Fatalf("%q: expected the stream to be unread, got %q", plain, rest)
+		}
+	}
+
+	// Concatenated gzip members form one stream, empty ones included.
+	lines := "foo:1|c\nbar:2|g\n"
+	compressed := append(compress(t, lines), compress(t, "")...)
+	compressed = append(compressed, compress(t, lines)...)
+	s, err := d.Stream("tcp", bufio.NewReader(bytes.NewReader(compressed)))
+	if err != nil || s == nil {
+		t.Fatalf("expected a decompressed stream, got %v, %v", s, err)
+	}
+	out, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != lines+lines {
+		t.Fatalf("expected %q, got %q", lines+lines, out)
+	}
+	s.Close()
+	if n := testutil.ToFloat64(m.CompressedBytes.WithLabelValues("tcp")); n != float64(len(compressed)) {
+		t.Fatalf("expected %d compressed bytes, got %v", len(compressed), n)
+	}
+
+	// A stream that expands beyond the maximum ratio is cut off.
+	bomb := compress(t, strings.Repeat("x", 100000))
+	s, err = d.Stream("tcp", bufio.NewReader(bytes.NewReader(bomb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(ioutil.Discard, s)
+	expectReason(t, err, ReasonTooLarge)
+
+	// Garbage after a gzip member is invalid.
+	s, err = d.Stream("tcp", bufio.NewReader(bytes.NewReader(append(compress(t, lines), "foo:1|c\n"...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(ioutil.Discard, s)
+	expectReason(t, err, ReasonInvalid)
+
+	_, err = d.Stream("tcp", bufio.NewReader(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0})))
+	expectReason(t, err, ReasonUnsupported)
+}
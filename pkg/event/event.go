@@ -14,6 +14,8 @@
 package event
 
 import (
+	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -33,35 +35,66 @@ type CounterEvent struct {
 	CMetricName string
 	CValue      float64
 	CLabels     map[string]string
+	CSource     string
 }
 
 func (c *CounterEvent) MetricName() string            { return c.CMetricName }
 func (c *CounterEvent) Value() float64                { return c.CValue }
 func (c *CounterEvent) Labels() map[string]string     { return c.CLabels }
 func (c *CounterEvent) MetricType() mapper.MetricType { return mapper.MetricTypeCounter }
+func (c *CounterEvent) Source() string                { return c.CSource }
 
 type GaugeEvent struct {
 	GMetricName string
 	GValue      float64
 	GRelative   bool
 	GLabels     map[string]string
+	GSource     string
 }
 
 func (g *GaugeEvent) MetricName() string            { return g.GMetricName }
 func (g *GaugeEvent) Value() float64                { return g.GValue }
 func (g *GaugeEvent) Labels() map[string]string     { return g.GLabels }
 func (g *GaugeEvent) MetricType() mapper.MetricType { return mapper.MetricTypeGauge }
+func (g *GaugeEvent) Source() string                { return g.GSource }
 
 type ObserverEvent struct {
 	OMetricName string
 	OValue      float64
 	OLabels     map[string]string
+	// OTimer is set if the value was sent as a StatsD timer in milliseconds
+	// and converted to seconds.
+	OTimer  bool
+	OSource string
 }
 
 func (o *ObserverEvent) MetricName() string            { return o.OMetricName }
 func (o *ObserverEvent) Value() float64                { return o.OValue }
 func (o *ObserverEvent) Labels() map[string]string     { return o.OLabels }
 func (o *ObserverEvent) MetricType() mapper.MetricType { return mapper.MetricTypeObserver }
+func (o *ObserverEvent) Source() string                { return o.OSource }
+
+// SourceEvent is an event that knows who sent it.
+type SourceEvent interface {
+	Event
+	// Source is the sender of the event, such as its IP address or host
+	// name, or "" if it is unknown.
+	Source() string
+}
+
+// SetSource sets the sender of events.
+func SetSource(events Events, source string) {
+	for _, e := range events {
+		switch e := e.(type) {
+		case *CounterEvent:
+			e.CSource = source
+		case *GaugeEvent:
+			e.GSource = source
+		case *ObserverEvent:
+			e.OSource = source
+		}
+	}
+}
 
 type Events []Event
 
@@ -73,13 +106,70 @@ type EventQueue struct {
 	flushThreshold int
 	flushInterval  time.Duration
 	eventsFlushed  prometheus.Counter
+	policy         OverflowPolicy
+	metrics        QueueMetrics
+	// random returns a number in [0, 1) for OverflowSample. It is only
+	// called with m held.
+	random func() float64
+	// done stops the flush goroutine, which closes stopped when it returns.
+	done    chan struct{}
+	stopped chan struct{}
 }
 
 type EventHandler interface {
 	Queue(event Events)
 }
 
+// OverflowPolicy decides what happens to events that are flushed while C is
+// full, because the exporter can't keep up.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits until there is room in C. Everything that queues
+	// events, including the listeners, waits with it.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest drops the events that are flushed.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest drops the oldest batch of events in C to make
+	// room for the events that are flushed.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowSample drops a random sample of the events that are flushed
+	// once C is half full. The fuller C is, the more events are dropped,
+	// and all of them once C is full.
+	OverflowSample OverflowPolicy = "sample"
+)
+
+// OverflowPolicies are all known overflow policies.
+var OverflowPolicies = []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowSample}
+
+// ParseOverflowPolicy returns the overflow policy called s.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for _, p := range OverflowPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event queue overflow policy %q", s)
+}
+
+// QueueMetrics are the metrics of an EventQueue about the overflow of C.
+type QueueMetrics struct {
+	// BlockedSeconds is the time spent waiting for room in C.
+	BlockedSeconds prometheus.Counter
+	// EventsDropped is the number of events dropped by the overflow policy.
+	EventsDropped prometheus.Counter
+}
+
 func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duration, eventsFlushed prometheus.Counter) *EventQueue {
+	return NewEventQueueWithPolicy(c, flushThreshold, flushInterval, eventsFlushed, OverflowBlock, QueueMetrics{
+		BlockedSeconds: prometheus.NewCounter(prometheus.CounterOpts{Name: "unused"}),
+		EventsDropped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "unused"}),
+	})
+}
+
+// NewEventQueueWithPolicy is NewEventQueue with an overflow policy other
+// than OverflowBlock.
+func NewEventQueueWithPolicy(c chan Events, flushThreshold int, flushInterval time.Duration, eventsFlushed prometheus.Counter, policy OverflowPolicy, m QueueMetrics) *EventQueue {
 	ticker := clock.NewTicker(flushInterval)
 	eq := &EventQueue{
 		C:              c,
@@ -88,16 +178,41 @@ func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duratio
 		flushTicker:    ticker,
 		q:              make([]Event, 0, flushThreshold),
 		eventsFlushed:  eventsFlushed,
+		policy:         policy,
+		metrics:        m,
+		random:         rand.Float64,
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
 	go func() {
+		defer close(eq.stopped)
 		for {
-			<-ticker.C
-			eq.Flush()
+			select {
+			case <-ticker.C:
+				eq.Flush()
+			case <-eq.done:
+				return
+			}
 		}
 	}()
 	return eq
 }
 
+// Close stops the periodic flushes and flushes the events that are still
+// queued. Once it returns, nothing is sent on C anymore, so C can be closed.
+// Events must not be queued after Close.
+func (eq *EventQueue) Close() {
+	close(eq.done)
+	<-eq.stopped
+	eq.flushTicker.Stop()
+
+	eq.m.Lock()
+	defer eq.m.Unlock()
+	if len(eq.q) > 0 {
+		eq.FlushUnlocked()
+	}
+}
+
 func (eq *EventQueue) Queue(events Events) {
 	eq.m.Lock()
 	defer eq.m.Unlock()
@@ -117,9 +232,89 @@ func (eq *EventQueue) Flush() {
 }
 
 func (eq *EventQueue) FlushUnlocked() {
-	eq.C <- eq.q
-	eq.q = make([]Event, 0, cap(eq.q))
-	eq.eventsFlushed.Inc()
+	if eq.send() {
+		eq.q = make([]Event, 0, cap(eq.q))
+		eq.eventsFlushed.Inc()
+	} else {
+		// Nothing refers to the dropped events, the queue can be reused.
+		eq.q = eq.q[:0]
+	}
+}
+
+// send sends the queued events to C, as far as the overflow policy allows.
+// It returns false if all of them were dropped.
+func (eq *EventQueue) send() bool {
+	if eq.policy == OverflowSample {
+		// Sampling starts before C is full.
+		eq.sample()
+		if len(eq.q) == 0 {
+			return false
+		}
+	}
+	select {
+	case eq.C <- eq.q:
+		return true
+	default:
+	}
+
+	switch eq.policy {
+	case OverflowDropNewest:
+		eq.drop(len(eq.q))
+		return false
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-eq.C:
+				eq.drop(len(oldest))
+			default:
+				// C is unbuffered and the exporter is busy, there is
+				// nothing older to drop.
+				eq.drop(len(eq.q))
+				return false
+			}
+			select {
+			case eq.C <- eq.q:
+				return true
+			default:
+			}
+		}
+
+	case OverflowSample:
+		// C is unbuffered and the exporter is busy, or C filled up since
+		// the events were sampled.
+		eq.drop(len(eq.q))
+		return false
+
+	default:
+		start := time.Now()
+		eq.C <- eq.q
+		eq.metrics.BlockedSeconds.Add(time.Since(start).Seconds())
+		return true
+	}
+}
+
+// sample drops queued events at random. Once C is half full, the share of
+// events that is kept decreases linearly, down to none when C is full.
+func (eq *EventQueue) sample() {
+	half := cap(eq.C) / 2
+	free := cap(eq.C) - len(eq.C)
+	if half == 0 || free >= half {
+		return
+	}
+	keep := float64(free) / float64(half)
+	kept := eq.q[:0]
+	for _, e := range eq.q {
+		if eq.random() < keep {
+			kept = append(kept, e)
+		}
+	}
+	eq.drop(len(eq.q) - len(kept))
+	eq.q = kept
+}
+
+func (eq *EventQueue) drop(n int) {
+	eq.metrics.EventsDropped.Add(float64(n))
 }
 
 func (eq *EventQueue) Len() int {
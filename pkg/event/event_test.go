@@ -14,10 +14,13 @@
 package event
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 )
 
@@ -85,3 +88,121 @@ func TestEventIntervalFlush(t *testing.T) {
 		t.Fatal("Expected 10 events in the event channel, but got", len(events))
 	}
 }
+
+func TestEventQueueClose(t *testing.T) {
+	c := make(chan Events, 100)
+	// Flushing on the interval would race with Close, so it must not happen.
+	eq := NewEventQueue(c, 1000, time.Hour, eventsFlushed)
+	eq.Queue(make(Events, 10))
+
+	eq.Close()
+	// C can be closed safely once Close has returned.
+	close(c)
+
+	if eq.Len() != 0 {
+		t.Fatal("Expected 0 events to be queued, but got", eq.Len())
+	}
+	batches := 0
+	for events := range c {
+		batches++
+		if len(events) != 10 {
+			t.Fatal("Expected 10 events in the event channel, but got", len(events))
+		}
+	}
+	if batches != 1 {
+		t.Fatal("Expected 1 batch in the event channel, but got", batches)
+	}
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	scenarios := []struct {
+		policy  OverflowPolicy
+		dropped float64
+		// batches are the sizes of the batches in C afterwards.
+		batches []int
+	}{
+		{policy: OverflowDropNewest, dropped: 3, batches: []int{1, 2}},
+		{policy: OverflowDropOldest, dropped: 1, batches: []int{2, 3}},
+		// C is full, so none of the events are kept.
+		{policy: OverflowSample, dropped: 3, batches: []int{1, 2}},
+	}
+	for _, s := range scenarios {
+		t.Run(string(s.policy), func(t *testing.T) {
+			m := QueueMetrics{
+				BlockedSeconds: prometheus.NewCounter(prometheus.CounterOpts{Name: "blocked"}),
+				EventsDropped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+			}
+			c := make(chan Events, 2)
+			eq := NewEventQueueWithPolicy(c, 1000, time.Hour, eventsFlushed, s.policy, m)
+			for _, n := range []int{1, 2, 3} {
+				eq.Queue(make(Events, n))
+				eq.Flush()
+			}
+			eq.Close()
+			close(c)
+
+			if dropped := testutil.ToFloat64(m.EventsDropped); dropped != s.dropped {
+				t.Fatalf("Expected %v events to be dropped, but got %v", s.dropped, dropped)
+			}
+			var batches []int
+			for events := range c {
+				batches = append(batches, len(events))
+			}
+			if fmt.Sprint(batches) != fmt.Sprint(s.batches) {
+				t.Fatalf("Expected batches %v, but got %v", s.batches, batches)
+			}
+		})
+	}
+}
+
+func TestEventQueueOverflowSample(t *testing.T) {
+	m := QueueMetrics{
+		BlockedSeconds: prometheus.NewCounter(prometheus.CounterOpts{Name: "blocked"}),
+		EventsDropped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+	}
+	c := make(chan Events, 10)
+	eq := NewEventQueueWithPolicy(c, 1000, time.Hour, eventsFlushed, OverflowSample, m)
+	eq.random = rand.New(rand.NewSource(1)).Float64
+	// C is 7/10 full, so 3/5 of the events are kept.
+	for i := 0; i < 7; i++ {
+		c <- Events{}
+	}
+	eq.Queue(make(Events, 999))
+	eq.Flush()
+	eq.Close()
+	close(c)
+
+	var kept int
+	for events := range c {
+		kept += len(events)
+	}
+	dropped := int(testutil.ToFloat64(m.EventsDropped))
+	if kept+dropped != 999 {
+		t.Fatalf("Expected 999 events to be kept or dropped, but got %d and %d", kept, dropped)
+	}
+	if kept < 500 || kept > 700 {
+		t.Fatalf("Expected about 600 events to be kept, but got %d", kept)
+	}
+}
+
+func TestEventQueueOverflowBlock(t *testing.T) {
+	m := QueueMetrics{
+		BlockedSeconds: prometheus.NewCounter(prometheus.CounterOpts{Name: "blocked"}),
+		EventsDropped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+	}
+	c := make(chan Events)
+	eq := NewEventQueueWithPolicy(c, 1, time.Hour, eventsFlushed, OverflowBlock, m)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c
+	}()
+	eq.Queue(make(Events, 1))
+	eq.Close()
+
+	if blocked := testutil.ToFloat64(m.BlockedSeconds); blocked < 0.01 {
+		t.Fatalf("Expected at least 10ms blocked, but got %vs", blocked)
+	}
+	if dropped := testutil.ToFloat64(m.EventsDropped); dropped != 0 {
+		t.Fatalf("Expected no events to be dropped, but got %v", dropped)
+	}
+}
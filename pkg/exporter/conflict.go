@@ -0,0 +1,120 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+	"github.com/prometheus/statsd_exporter/pkg/registry"
+)
+
+// statsdTypeLabel is added by the label conflict strategy.
+const statsdTypeLabel = "statsd_type"
+
+// maxEvictions bounds the number of metrics the replace strategy evicts for
+// a single event. A histogram can conflict with up to four metrics.
+const maxEvictions = 4
+
+// updateFunc records an event in the metric with the given name and labels.
+type updateFunc func(metricName string, labels prometheus.Labels) error
+
+// addToGauge returns an updateFunc that adds value to a gauge.
+func (b *Exporter) addToGauge(help string, mapping *mapper.MetricMapping, value float64) updateFunc {
+	return func(metricName string, labels prometheus.Labels) error {
+		gauge, err := b.Registry.GetGauge(metricName, labels, help, mapping, b.MetricsCount)
+		if err != nil {
+			return err
+		}
+		gauge.Add(value)
+		return nil
+	}
+}
+
+// record calls update for the metric. If the metric name is in use by a
+// metric of a different type, the conflict is resolved according to the
+// conflict strategy of the mapping:
+//
+//   - drop: the event is discarded.
+//   - suffix: the event is recorded in a metric named after the metric and
+//     typeSuffix.
+//   - label: if asGauge is set and the existing metric is a gauge, the event
+//     is recorded with asGauge in the existing metric, with an additional
+//     statsd_type label. Otherwise, this behaves like suffix.
+//   - replace: the existing metric is evicted.
+func (b *Exporter) record(eventType, typeSuffix string, metricName string, labels prometheus.Labels, mapping *mapper.MetricMapping, update, asGauge updateFunc) {
+	err := update(metricName, labels)
+
+	var conflict *registry.ConflictError
+	if err != nil && errors.As(err, &conflict) && mapping.ConflictStrategy != mapper.ConflictStrategyDrop && mapping.ConflictStrategy != mapper.ConflictStrategyDefault {
+		strategy := mapping.ConflictStrategy
+		resolvedName := metricName
+		switch strategy {
+		case mapper.ConflictStrategyLabel:
+			if asGauge != nil && conflict.MetricName == metricName && conflict.MetricType == metrics.GaugeMetricType {
+				typedLabels := make(prometheus.Labels, len(labels)+1)
+				for k, v := range labels {
+					typedLabels[k] = v
+				}
+				typedLabels[statsdTypeLabel] = eventType
+				err = asGauge(metricName, typedLabels)
+				break
+			}
+			strategy = mapper.ConflictStrategySuffix
+			fallthrough
+		case mapper.ConflictStrategySuffix:
+			resolvedName = metricName + "_" + typeSuffix
+			err = update(resolvedName, labels)
+		case mapper.ConflictStrategyReplace:
+			for i := 0; i < maxEvictions && errors.As(err, &conflict); i++ {
+				b.Registry.Evict(conflict.MetricName)
+				err = update(metricName, labels)
+			}
+		}
+		if err == nil {
+			b.conflictResolved(metricName, resolvedName, strategy)
+		}
+	}
+
+	if err != nil {
+		level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
+		b.ConflictingEventStats.WithLabelValues(eventType).Inc()
+		return
+	}
+	b.EventStats.WithLabelValues(eventType).Inc()
+}
+
+// conflictResolved accounts for an event that was recorded by a conflict
+// strategy. The first resolution for each metric name is logged at info
+// level, so that operators can find renamed metrics.
+func (b *Exporter) conflictResolved(metricName, resolvedName string, strategy mapper.ConflictStrategy) {
+	if b.ConflictsResolved != nil {
+		b.ConflictsResolved.WithLabelValues(string(strategy)).Inc()
+	}
+
+	if b.resolvedConflicts == nil {
+		b.resolvedConflicts = make(map[string]struct{})
+	}
+	key := string(strategy) + "\xff" + metricName
+	logger := level.Debug(b.Logger)
+	if _, ok := b.resolvedConflicts[key]; !ok {
+		b.resolvedConflicts[key] = struct{}{}
+		logger = level.Info(b.Logger)
+	}
+	logger.Log("msg", "Resolved metric type conflict", "metric", metricName, "strategy", strategy, "resolved_metric", resolvedName)
+}
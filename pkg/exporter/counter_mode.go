@@ -0,0 +1,58 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// handleCounter records a counter event according to the counter mode of the
+// mapping.
+func (b *Exporter) handleCounter(metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, value float64) {
+	switch mapping.CounterMode {
+	case mapper.CounterModeDeltaGauge:
+		b.record("counter", "gauge", metricName, prometheusLabels, mapping, b.addToGauge(help, mapping, value), nil)
+
+	case mapper.CounterModePerInterval:
+		b.record("counter", "gauge", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+			gauge, err := b.Registry.GetGauge(metricName, labels, help, mapping, b.MetricsCount)
+			if err != nil {
+				return err
+			}
+			b.gaugeWindowFor(metricName, labels, gauge, mapping.CounterInterval, rateResult).add(value)
+			return nil
+		}, nil)
+
+	default:
+		// We don't accept negative values for counters. Incrementing the counter with a negative number
+		// will cause the exporter to panic. Instead we will warn and continue to the next event.
+		if value < 0.0 {
+			level.Debug(b.Logger).Log("msg", "counter must be non-negative value", "metric", metricName, "event_value", value)
+			b.ErrorEventStats.WithLabelValues("illegal_negative_counter").Inc()
+			return
+		}
+
+		b.record("counter", "counter", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+			counter, err := b.Registry.GetCounter(metricName, labels, help, mapping, b.MetricsCount)
+			if err != nil {
+				return err
+			}
+			counter.Add(value)
+			return nil
+		}, b.addToGauge(help, mapping, value))
+	}
+}
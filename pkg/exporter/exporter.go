@@ -15,6 +15,7 @@ package exporter
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -24,7 +25,10 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/event"
 	"github.com/prometheus/statsd_exporter/pkg/level"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
 	"github.com/prometheus/statsd_exporter/pkg/registry"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
 )
 
 const (
@@ -37,7 +41,11 @@ type Registry interface {
 	GetGauge(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Gauge, error)
 	GetHistogram(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error)
 	GetSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error)
+	GetRegisteredMetric(metricName string, labels prometheus.Labels) *metrics.RegisteredMetric
+	Evict(metricName string)
 	RemoveStaleMetrics()
+	Snapshot() []snapshot.Series
+	Restore(series []snapshot.Series, metricsCount *prometheus.GaugeVec) (int, error)
 }
 
 type Exporter struct {
@@ -50,43 +58,116 @@ type Exporter struct {
 	EventStats            *prometheus.CounterVec
 	ConflictingEventStats *prometheus.CounterVec
 	MetricsCount          *prometheus.GaugeVec
+	// Unmapped, if set, keeps track of the most frequent unmapped metrics.
+	Unmapped *unmapped.Tracker
+	// ConflictsResolved, if set, counts the events recorded by a conflict
+	// strategy, by strategy.
+	ConflictsResolved *prometheus.CounterVec
+	// SnapshotFile, if set, is where the state of all metrics is persisted
+	// every SnapshotInterval and when Listen terminates.
+	SnapshotFile     string
+	SnapshotInterval time.Duration
+	// Shards, if greater than one, is the number of partitions of the
+	// registry. Events are handled by one goroutine per partition, see
+	// listenSharded. It must be set before Listen or RestoreSnapshot are
+	// called, and requires an exporter created by NewExporter.
+	Shards int
+
+	// mu serializes access to the registry between Listen and snapshots
+	// requested from other goroutines.
+	mu sync.Mutex
+	// resolvedConflicts is the set of metric names that have been rewritten
+	// by a conflict strategy.
+	resolvedConflicts map[string]struct{}
+	// windows holds all series that are aggregated over windows.
+	windows map[*windowState]struct{}
+
+	// registerer is used to create the partitions of the registry.
+	registerer prometheus.Registerer
+	// shards are the exporters that handle the partitions of the registry.
+	shards     []*Exporter
+	shardsOnce sync.Once
 }
 
 // Listen handles all events sent to the given channel sequentially. It
 // terminates when the channel is closed.
 func (b *Exporter) Listen(e <-chan event.Events) {
+	b.initShards()
+	if b.shards != nil {
+		b.listenSharded(e)
+		return
+	}
+
 	removeStaleMetricsTicker := clock.NewTicker(time.Second)
 
+	// The snapshot ticker does not use the clock package, so that it does
+	// not compete with the ticker above in tests.
+	var snapshotC <-chan time.Time
+	if b.SnapshotFile != "" && b.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(b.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotC = snapshotTicker.C
+	}
+
 	for {
 		select {
 		case <-removeStaleMetricsTicker.C:
+			b.mu.Lock()
 			b.Registry.RemoveStaleMetrics()
+			b.advanceWindows()
+			b.mu.Unlock()
+		case <-snapshotC:
+			b.writeSnapshotOrLog()
 		case events, ok := <-e:
 			if !ok {
 				level.Debug(b.Logger).Log("msg", "Channel is closed. Break out of Exporter.Listener.")
 				removeStaleMetricsTicker.Stop()
+				b.writeSnapshotOrLog()
 				return
 			}
+			b.mu.Lock()
 			for _, event := range events {
 				b.handleEvent(event)
 			}
+			b.mu.Unlock()
 		}
 	}
 }
 
+// mappedEvent is an event together with the result of its mapping.
+type mappedEvent struct {
+	event      event.Event
+	metricName string
+	labels     prometheus.Labels
+	help       string
+	mapping    *mapper.MetricMapping
+}
+
 // handleEvent processes a single Event according to the configured mapping.
 func (b *Exporter) handleEvent(thisEvent event.Event) {
+	if me, ok := b.mapEvent(thisEvent); ok {
+		b.recordEvent(me)
+	}
+}
+
+// mapEvent looks up the mapping of an event, and determines the name and
+// labels of the metric it is recorded in. It returns false if the event is
+// not recorded. It doesn't touch the registry, so it is safe to call
+// concurrently.
+func (b *Exporter) mapEvent(thisEvent event.Event) (mappedEvent, bool) {
 	mapping, labels, present := b.Mapper.GetMapping(thisEvent.MetricName(), thisEvent.MetricType())
 	if mapping == nil {
 		mapping = &mapper.MetricMapping{}
 		if b.Mapper.Defaults.Ttl != 0 {
 			mapping.Ttl = b.Mapper.Defaults.Ttl
 		}
+		mapping.ConflictStrategy = b.Mapper.Defaults.ConflictStrategy
+		mapping.SourceLabel = b.Mapper.Defaults.SourceLabel
 	}
 
 	if mapping.Action == mapper.ActionTypeDrop {
 		b.EventsActions.WithLabelValues("drop").Inc()
-		return
+		return mappedEvent{}, false
 	}
 
 	metricName := ""
@@ -101,7 +182,7 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		if mapping.Name == "" {
 			level.Debug(b.Logger).Log("msg", "The mapping generates an empty metric name", "metric_name", thisEvent.MetricName(), "match", mapping.Match)
 			b.ErrorEventStats.WithLabelValues("empty_metric_name").Inc()
-			return
+			return mappedEvent{}, false
 		}
 		metricName = mapper.EscapeMetricName(mapping.Name)
 		for label, value := range labels {
@@ -110,81 +191,96 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		b.EventsActions.WithLabelValues(string(mapping.Action)).Inc()
 	} else {
 		b.EventsUnmapped.Inc()
+		if b.Unmapped != nil {
+			b.Unmapped.Observe(thisEvent.MetricName(), thisEvent.MetricType(), prometheusLabels)
+		}
 		metricName = mapper.EscapeMetricName(thisEvent.MetricName())
 	}
 
-	switch ev := thisEvent.(type) {
-	case *event.CounterEvent:
-		// We don't accept negative values for counters. Incrementing the counter with a negative number
-		// will cause the exporter to panic. Instead we will warn and continue to the next event.
-		if thisEvent.Value() < 0.0 {
-			level.Debug(b.Logger).Log("msg", "counter must be non-negative value", "metric", metricName, "event_value", thisEvent.Value())
-			b.ErrorEventStats.WithLabelValues("illegal_negative_counter").Inc()
-			return
+	if mapping.SourceLabel != "" {
+		if e, ok := thisEvent.(event.SourceEvent); ok && e.Source() != "" {
+			if prometheusLabels == nil {
+				prometheusLabels = prometheus.Labels{}
+			}
+			prometheusLabels[mapping.SourceLabel] = e.Source()
 		}
+	}
 
-		counter, err := b.Registry.GetCounter(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-		if err == nil {
-			counter.Add(thisEvent.Value())
-			b.EventStats.WithLabelValues("counter").Inc()
-		} else {
-			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("counter").Inc()
-		}
+	return mappedEvent{
+		event:      thisEvent,
+		metricName: metricName,
+		labels:     prometheusLabels,
+		help:       help,
+		mapping:    mapping,
+	}, true
+}
 
-	case *event.GaugeEvent:
-		gauge, err := b.Registry.GetGauge(metricName, prometheusLabels, help, mapping, b.MetricsCount)
+// recordEvent records a mapped event in the registry.
+func (b *Exporter) recordEvent(me mappedEvent) {
+	thisEvent, metricName, prometheusLabels, help, mapping := me.event, me.metricName, me.labels, me.help, me.mapping
 
-		if err == nil {
-			if ev.GRelative {
-				gauge.Add(thisEvent.Value())
-			} else {
-				gauge.Set(thisEvent.Value())
-			}
-			b.EventStats.WithLabelValues("gauge").Inc()
-		} else {
-			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("gauge").Inc()
-		}
+	if mapping.TypeOverride != "" && mapping.TypeOverride != thisEvent.MetricType() {
+		b.handleTypeOverride(thisEvent, metricName, prometheusLabels, help, mapping)
+		return
+	}
+
+	switch ev := thisEvent.(type) {
+	case *event.CounterEvent:
+		value := mapping.TransformValue(thisEvent.Value(), false, false)
+		b.handleCounter(metricName, prometheusLabels, help, mapping, value)
+
+	case *event.GaugeEvent:
+		value := mapping.TransformValue(thisEvent.Value(), false, !ev.GRelative)
+		b.handleGauge(metricName, prometheusLabels, help, mapping, value, ev.GRelative)
 
 	case *event.ObserverEvent:
-		t := mapper.ObserverTypeDefault
-		if mapping != nil {
-			t = mapping.ObserverType
-		}
-		if t == mapper.ObserverTypeDefault {
-			t = b.Mapper.Defaults.ObserverType
-		}
+		value := mapping.TransformValue(thisEvent.Value(), ev.OTimer, true)
+		b.observe(metricName, prometheusLabels, help, mapping, value)
+
+	default:
+		level.Debug(b.Logger).Log("msg", "Unsupported event type")
+		b.EventStats.WithLabelValues("illegal").Inc()
+	}
+}
 
-		switch t {
-		case mapper.ObserverTypeHistogram:
-			histogram, err := b.Registry.GetHistogram(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-			if err == nil {
-				histogram.Observe(thisEvent.Value())
-				b.EventStats.WithLabelValues("observer").Inc()
-			} else {
-				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+// observe records a value in the histogram or summary configured for the
+// mapping.
+func (b *Exporter) observe(metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, value float64) {
+	t := mapper.ObserverTypeDefault
+	if mapping != nil {
+		t = mapping.ObserverType
+	}
+	if t == mapper.ObserverTypeDefault {
+		t = b.Mapper.Defaults.ObserverType
+	}
+
+	switch t {
+	case mapper.ObserverTypeHistogram:
+		b.record("observer", "histogram", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+			histogram, err := b.Registry.GetHistogram(metricName, labels, help, mapping, b.MetricsCount)
+			if err != nil {
+				return err
 			}
+			histogram.Observe(value)
+			return nil
+		}, nil)
 
-		case mapper.ObserverTypeDefault, mapper.ObserverTypeSummary:
-			summary, err := b.Registry.GetSummary(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-			if err == nil {
-				summary.Observe(thisEvent.Value())
-				b.EventStats.WithLabelValues("observer").Inc()
-			} else {
-				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+	case mapper.ObserverTypeDefault, mapper.ObserverTypeSummary:
+		b.record("observer", "summary", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+			summary, err := b.Registry.GetSummary(metricName, labels, help, mapping, b.MetricsCount)
+			if err != nil {
+				return err
 			}
+			summary.Observe(value)
+			return nil
+		}, nil)
 
-		default:
-			level.Error(b.Logger).Log("msg", "unknown observer type", "type", t)
-			os.Exit(1)
-		}
+	case mapper.ObserverTypeStatsdAggregates:
+		b.observeStatsdAggregates(metricName, prometheusLabels, help, mapping, value)
 
 	default:
-		level.Debug(b.Logger).Log("msg", "Unsupported event type")
-		b.EventStats.WithLabelValues("illegal").Inc()
+		level.Error(b.Logger).Log("msg", "unknown observer type", "type", t)
+		os.Exit(1)
 	}
 }
 
@@ -199,5 +295,6 @@ func NewExporter(reg prometheus.Registerer, mapper *mapper.MetricMapper, logger
 		EventStats:            eventStats,
 		ConflictingEventStats: conflictingEventStats,
 		MetricsCount:          metricsCount,
+		registerer:            reg,
 	}
 }
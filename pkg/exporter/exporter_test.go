@@ -15,7 +15,12 @@ package exporter
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -774,6 +779,902 @@ func TestCounterIncrement(t *testing.T) {
 	}
 }
 
+func TestValueTransforms(t *testing.T) {
+	config := `
+mappings:
+- match: micro.timer
+  observer_type: histogram
+  name: micro_timer_seconds
+  value_conversion: us_to_s
+- match: raw.timer
+  observer_type: histogram
+  name: raw_timer_milliseconds
+  disable_timer_conversion: true
+- match: bytes.used
+  name: used_megabytes
+  value_conversion: b_to_mb
+- match: temperature
+  name: temperature_fahrenheit
+  value_scale: 1.8
+  value_offset: 32
+- match: relative.temperature
+  name: relative_temperature_fahrenheit
+  value_scale: 1.8
+  value_offset: 32
+- match: scaled.counter
+  name: scaled_counter_total
+  value_scale: 2
+  value_offset: 100
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.ObserverEvent{OMetricName: "micro.timer", OValue: 2500000},
+		&event.ObserverEvent{OMetricName: "raw.timer", OValue: 0.2, OTimer: true},
+		&event.GaugeEvent{GMetricName: "bytes.used", GValue: 3000000},
+		&event.GaugeEvent{GMetricName: "temperature", GValue: 100},
+		&event.GaugeEvent{GMetricName: "relative.temperature", GValue: 10},
+		&event.GaugeEvent{GMetricName: "relative.temperature", GValue: 10, GRelative: true},
+		&event.CounterEvent{CMetricName: "scaled.counter", CValue: 3},
+		&event.CounterEvent{CMetricName: "scaled.counter", CValue: 4},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from registry: %v", err)
+	}
+
+	expected := map[string]float64{
+		"micro_timer_seconds":             2.5,
+		"raw_timer_milliseconds":          200,
+		"used_megabytes":                  3,
+		"temperature_fahrenheit":          212,
+		"relative_temperature_fahrenheit": 68,
+		"scaled_counter_total":            14,
+	}
+	for name, want := range expected {
+		value := getFloat64(metrics, name, prometheus.Labels{})
+		if value == nil {
+			t.Fatalf("%s: metric not found", name)
+		}
+		if math.Abs(*value-want) > 1e-9 {
+			t.Fatalf("%s: expected %v, got %v", name, want, *value)
+		}
+	}
+}
+
+func TestTypeOverride(t *testing.T) {
+	config := `
+mappings:
+- match: counter.as.gauge
+  name: counter_as_gauge
+  type_override: gauge
+- match: counter.as.observer
+  name: counter_as_observer
+  type_override: observer
+  observer_type: histogram
+- match: gauge.as.counter
+  name: gauge_as_counter_total
+  type_override: counter
+- match: relative.gauge.as.counter
+  name: relative_gauge_as_counter_total
+  type_override: counter
+- match: gauge.as.observer
+  name: gauge_as_observer
+  type_override: observer
+- match: timer.as.counter
+  name: timer_as_counter_seconds_total
+  type_override: counter
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "counter.as.gauge", CValue: 5},
+		&event.CounterEvent{CMetricName: "counter.as.gauge", CValue: 3},
+		&event.CounterEvent{CMetricName: "counter.as.observer", CValue: 2},
+		&event.CounterEvent{CMetricName: "counter.as.observer", CValue: 4},
+		// The first value is the baseline, 10 -> 15 is an increase of 5, and
+		// 15 -> 4 is a reset, adding 4.
+		&event.GaugeEvent{GMetricName: "gauge.as.counter", GValue: 10},
+		&event.GaugeEvent{GMetricName: "gauge.as.counter", GValue: 15},
+		&event.GaugeEvent{GMetricName: "gauge.as.counter", GValue: 4},
+		// Relative decreases are ignored.
+		&event.GaugeEvent{GMetricName: "relative.gauge.as.counter", GValue: 3, GRelative: true},
+		&event.GaugeEvent{GMetricName: "relative.gauge.as.counter", GValue: -2, GRelative: true},
+		&event.GaugeEvent{GMetricName: "relative.gauge.as.counter", GValue: 4, GRelative: true},
+		&event.GaugeEvent{GMetricName: "gauge.as.observer", GValue: 1.5},
+		&event.GaugeEvent{GMetricName: "gauge.as.observer", GValue: 2.5},
+		&event.ObserverEvent{OMetricName: "timer.as.counter", OValue: 0.25, OTimer: true},
+		&event.ObserverEvent{OMetricName: "timer.as.counter", OValue: 0.5, OTimer: true},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from registry: %v", err)
+	}
+
+	expected := map[string]struct {
+		value      float64
+		metricType dto.MetricType
+	}{
+		"counter_as_gauge":                {3, dto.MetricType_GAUGE},
+		"counter_as_observer":             {6, dto.MetricType_HISTOGRAM},
+		"gauge_as_counter_total":          {9, dto.MetricType_COUNTER},
+		"relative_gauge_as_counter_total": {7, dto.MetricType_COUNTER},
+		"gauge_as_observer":               {4, dto.MetricType_SUMMARY},
+		"timer_as_counter_seconds_total":  {0.75, dto.MetricType_COUNTER},
+	}
+	for name, want := range expected {
+		value := getFloat64(metrics, name, prometheus.Labels{})
+		if value == nil {
+			t.Fatalf("%s: metric not found", name)
+		}
+		if *value != want.value {
+			t.Fatalf("%s: expected %v, got %v", name, want.value, *value)
+		}
+		for _, mf := range metrics {
+			if mf.GetName() == name && mf.GetType() != want.metricType {
+				t.Fatalf("%s: expected type %v, got %v", name, want.metricType, mf.GetType())
+			}
+		}
+	}
+}
+
+func TestSourceLabel(t *testing.T) {
+	config := `
+mappings:
+- match: with.source
+  name: with_source
+  source_label: host
+- match: without.source
+  name: without_source
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+		close(done)
+	}()
+
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "with.source", CValue: 1, CLabels: map[string]string{}, CSource: "10.0.0.1"},
+		&event.CounterEvent{CMetricName: "with.source", CValue: 2, CLabels: map[string]string{}, CSource: "10.0.0.2"},
+		&event.GaugeEvent{GMetricName: "without.source", GValue: 3, GLabels: map[string]string{}, GSource: "10.0.0.1"},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from registry: %v", err)
+	}
+
+	expected := []struct {
+		name   string
+		labels prometheus.Labels
+		value  float64
+	}{
+		{name: "with_source", labels: prometheus.Labels{"host": "10.0.0.1"}, value: 1},
+		{name: "with_source", labels: prometheus.Labels{"host": "10.0.0.2"}, value: 2},
+		{name: "without_source", labels: prometheus.Labels{}, value: 3},
+	}
+	for _, e := range expected {
+		value := getFloat64(metrics, e.name, e.labels)
+		if value == nil {
+			t.Fatalf("%s%v: metric not found", e.name, e.labels)
+		}
+		if *value != e.value {
+			t.Fatalf("%s%v: expected %v, got %v", e.name, e.labels, e.value, *value)
+		}
+	}
+}
+
+func TestConflictStrategies(t *testing.T) {
+	config := `
+defaults:
+  conflict_strategy: suffix
+mappings:
+- match: label.*
+  name: label_test
+  conflict_strategy: label
+- match: replace.*
+  name: replace_test
+  conflict_strategy: replace
+- match: drop.*
+  name: drop_test
+  conflict_strategy: drop
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	resolved := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "resolved"}, []string{"strategy"})
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.ConflictsResolved = resolved
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		// Unmapped events use the default strategy.
+		&event.GaugeEvent{GMetricName: "suffix_test", GValue: 2},
+		&event.CounterEvent{CMetricName: "suffix_test", CValue: 1},
+		// A counter can be added to a gauge, an observation can't.
+		&event.GaugeEvent{GMetricName: "label.a", GValue: 5},
+		&event.CounterEvent{CMetricName: "label.b", CValue: 3},
+		&event.ObserverEvent{OMetricName: "label.c", OValue: 1},
+		// The counter is replaced by a gauge, which is replaced again by a
+		// counter that starts from scratch.
+		&event.CounterEvent{CMetricName: "replace.a", CValue: 1},
+		&event.GaugeEvent{GMetricName: "replace.b", GValue: 7},
+		&event.CounterEvent{CMetricName: "replace.c", CValue: 2},
+		&event.CounterEvent{CMetricName: "drop.a", CValue: 1},
+		&event.GaugeEvent{GMetricName: "drop.b", GValue: 2},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from registry: %v", err)
+	}
+
+	expected := []struct {
+		name       string
+		labels     prometheus.Labels
+		value      float64
+		metricType dto.MetricType
+	}{
+		{"suffix_test", prometheus.Labels{}, 2, dto.MetricType_GAUGE},
+		{"suffix_test_counter", prometheus.Labels{}, 1, dto.MetricType_COUNTER},
+		{"label_test", prometheus.Labels{}, 5, dto.MetricType_GAUGE},
+		{"label_test", prometheus.Labels{"statsd_type": "counter"}, 3, dto.MetricType_GAUGE},
+		{"label_test_summary", prometheus.Labels{}, 1, dto.MetricType_SUMMARY},
+		{"replace_test", prometheus.Labels{}, 2, dto.MetricType_COUNTER},
+		{"drop_test", prometheus.Labels{}, 1, dto.MetricType_COUNTER},
+	}
+	for _, want := range expected {
+		value := getFloat64(metrics, want.name, want.labels)
+		if value == nil {
+			t.Fatalf("%s%v: metric not found", want.name, want.labels)
+		}
+		if *value != want.value {
+			t.Fatalf("%s%v: expected %v, got %v", want.name, want.labels, want.value, *value)
+		}
+		for _, mf := range metrics {
+			if mf.GetName() == want.name && mf.GetType() != want.metricType {
+				t.Fatalf("%s: expected type %v, got %v", want.name, want.metricType, mf.GetType())
+			}
+		}
+	}
+
+	for strategy, want := range map[string]float64{"suffix": 2, "label": 1, "replace": 2, "drop": 0} {
+		if got := getTelemetryCounterValue(resolved.WithLabelValues(strategy)); got != want {
+			t.Errorf("%s: expected %v resolved conflicts, got %v", strategy, want, got)
+		}
+	}
+}
+
+func TestCounterModes(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	config := `
+mappings:
+- match: delta.*
+  name: delta_test
+  counter_mode: delta_gauge
+- match: interval.*
+  name: interval_test
+  counter_mode: per_interval
+  counter_interval: 10s
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	// Steps advance the clock, tick, and send events. The tick is handled
+	// before the events.
+	steps := []struct {
+		now      time.Time
+		events   event.Events
+		expected map[string]float64
+	}{
+		{
+			now: time.Unix(0, 0),
+			events: event.Events{
+				&event.CounterEvent{CMetricName: "delta.a", CValue: 5},
+				&event.CounterEvent{CMetricName: "delta.a", CValue: -7},
+				&event.CounterEvent{CMetricName: "interval.a", CValue: 20},
+				&event.CounterEvent{CMetricName: "interval.a", CValue: 30},
+			},
+			expected: map[string]float64{"delta_test": -2, "interval_test": 0},
+		},
+		{
+			now:      time.Unix(10, 0),
+			expected: map[string]float64{"delta_test": -2, "interval_test": 5},
+		},
+		{
+			now: time.Unix(15, 0),
+			events: event.Events{
+				&event.CounterEvent{CMetricName: "interval.a", CValue: 10},
+			},
+			expected: map[string]float64{"interval_test": 5},
+		},
+		{
+			now:      time.Unix(20, 0),
+			expected: map[string]float64{"interval_test": 1},
+		},
+		{
+			// No values were received in the interval that ended at 30s.
+			now:      time.Unix(40, 0),
+			expected: map[string]float64{"interval_test": 0},
+		},
+	}
+
+	for i, step := range steps {
+		clock.ClockInstance.Instant = step.now
+		tickerCh <- step.now
+		events <- step.events
+		events <- event.Events{}
+
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Cannot gather from registry: %v", err)
+		}
+		for name, want := range step.expected {
+			value := getFloat64(metrics, name, prometheus.Labels{})
+			if value == nil {
+				t.Fatalf("step %d: %s: metric not found", i, name)
+			}
+			if *value != want {
+				t.Fatalf("step %d: %s: expected %v, got %v", i, name, want, *value)
+			}
+			for _, mf := range metrics {
+				if mf.GetName() == name && mf.GetType() != dto.MetricType_GAUGE {
+					t.Fatalf("step %d: %s: expected a gauge, got %v", i, name, mf.GetType())
+				}
+			}
+		}
+	}
+}
+
+func TestGaugeAggregation(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	config := "mappings:\n"
+	for _, aggregation := range []string{"last", "min", "max", "sum", "avg", "count"} {
+		config += fmt.Sprintf("- match: agg.%s\n  name: agg_%s\n  gauge_aggregation: %s\n  gauge_aggregation_window: 10s\n", aggregation, aggregation, aggregation)
+	}
+
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	gauges := func(values ...float64) event.Events {
+		var events event.Events
+		for _, aggregation := range []string{"last", "min", "max", "sum", "avg", "count"} {
+			for _, v := range values {
+				events = append(events, &event.GaugeEvent{GMetricName: "agg." + aggregation, GValue: v})
+			}
+		}
+		return events
+	}
+
+	// Steps advance the clock, tick, and send events. The tick is handled
+	// before the events.
+	steps := []struct {
+		now      time.Time
+		events   event.Events
+		expected map[string]float64
+	}{
+		{
+			now:    time.Unix(0, 0),
+			events: gauges(3, 1, 2),
+			// Nothing is exposed before the end of the first window.
+			expected: map[string]float64{"agg_last": 0, "agg_min": 0, "agg_max": 0, "agg_sum": 0, "agg_avg": 0, "agg_count": 0},
+		},
+		{
+			now:      time.Unix(10, 0),
+			expected: map[string]float64{"agg_last": 2, "agg_min": 1, "agg_max": 3, "agg_sum": 6, "agg_avg": 2, "agg_count": 3},
+		},
+		{
+			// Empty windows keep the value, except for sum and count.
+			now:      time.Unix(30, 0),
+			expected: map[string]float64{"agg_last": 2, "agg_min": 1, "agg_max": 3, "agg_sum": 0, "agg_avg": 2, "agg_count": 0},
+		},
+		{
+			// Relative changes apply to the most recent value.
+			now: time.Unix(35, 0),
+			events: event.Events{
+				&event.GaugeEvent{GMetricName: "agg.last", GValue: 5, GRelative: true},
+				&event.GaugeEvent{GMetricName: "agg.min", GValue: 4},
+				&event.GaugeEvent{GMetricName: "agg.min", GValue: 8},
+			},
+		},
+		{
+			now:      time.Unix(40, 0),
+			expected: map[string]float64{"agg_last": 7, "agg_min": 4},
+		},
+	}
+
+	for i, step := range steps {
+		clock.ClockInstance.Instant = step.now
+		tickerCh <- step.now
+		events <- step.events
+		events <- event.Events{}
+
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Cannot gather from registry: %v", err)
+		}
+		for name, want := range step.expected {
+			value := getFloat64(metrics, name, prometheus.Labels{})
+			if value == nil {
+				t.Fatalf("step %d: %s: metric not found", i, name)
+			}
+			if *value != want {
+				t.Fatalf("step %d: %s: expected %v, got %v", i, name, want, *value)
+			}
+		}
+	}
+}
+
+func TestStatsdAggregates(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	config := `
+mappings:
+- match: timer.*
+  name: timer_test
+  observer_type: statsd_aggregates
+  statsd_aggregates_options:
+    percentiles: [90, 99.9]
+    flush_interval: 10s
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	var observations event.Events
+	for _, v := range []float64{7, 3, 10, 1, 5, 2, 9, 4, 8, 6} {
+		observations = append(observations, &event.ObserverEvent{OMetricName: "timer.a", OValue: v})
+	}
+
+	steps := []struct {
+		now      time.Time
+		events   event.Events
+		expected map[string]float64
+	}{
+		{
+			now:      time.Unix(0, 0),
+			events:   observations,
+			expected: map[string]float64{"timer_test_count": 0},
+		},
+		{
+			now: time.Unix(10, 0),
+			expected: map[string]float64{
+				"timer_test_count":      10,
+				"timer_test_count_ps":   1,
+				"timer_test_sum":        55,
+				"timer_test_lower":      1,
+				"timer_test_upper":      10,
+				"timer_test_mean":       5.5,
+				"timer_test_median":     5.5,
+				"timer_test_std":        math.Sqrt(8.25),
+				"timer_test_count_90":   9,
+				"timer_test_sum_90":     45,
+				"timer_test_mean_90":    5,
+				"timer_test_upper_90":   9,
+				"timer_test_count_99_9": 10,
+				"timer_test_upper_99_9": 10,
+			},
+		},
+		{
+			// An empty interval only resets the counts.
+			now: time.Unix(20, 0),
+			expected: map[string]float64{
+				"timer_test_count":    0,
+				"timer_test_count_ps": 0,
+				"timer_test_upper_90": 9,
+			},
+		},
+	}
+
+	for i, step := range steps {
+		clock.ClockInstance.Instant = step.now
+		tickerCh <- step.now
+		events <- step.events
+		events <- event.Events{}
+
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Cannot gather from registry: %v", err)
+		}
+		for name, want := range step.expected {
+			value := getFloat64(metrics, name, prometheus.Labels{})
+			if value == nil {
+				t.Fatalf("step %d: %s: metric not found", i, name)
+			}
+			if *value != want {
+				t.Fatalf("step %d: %s: expected %v, got %v", i, name, want, *value)
+			}
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "state")
+
+	config := `
+mappings:
+- match: hist.*
+  name: hist_test
+  observer_type: histogram
+  histogram_options:
+    buckets: [1, 5]
+- match: sum.*
+  name: sum_test
+  observer_type: summary
+  summary_options:
+    quantiles:
+    - quantile: 0.25
+      error: 0.01
+- match: gauge.*
+  name: gauge_test
+  ttl: 1h
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	// run starts an exporter with a fresh registry, restores the snapshot,
+	// handles the events and shuts down, which writes the snapshot.
+	run := func(in event.Events) []*dto.MetricFamily {
+		reg := prometheus.NewRegistry()
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.SnapshotFile = snapshotFile
+		if err := ex.RestoreSnapshot(); err != nil {
+			t.Fatalf("Cannot restore snapshot: %v", err)
+		}
+
+		events := make(chan event.Events)
+		done := make(chan struct{})
+		go func() {
+			ex.Listen(events)
+			close(done)
+		}()
+		events <- in
+		close(events)
+		<-done
+
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Cannot gather from registry: %v", err)
+		}
+		return metrics
+	}
+
+	run(event.Events{
+		&event.CounterEvent{CMetricName: "counter_test", CValue: 3, CLabels: map[string]string{"code": "200"}},
+		&event.GaugeEvent{GMetricName: "gauge.a", GValue: 7},
+		&event.ObserverEvent{OMetricName: "hist.a", OValue: 0.5},
+		&event.ObserverEvent{OMetricName: "hist.a", OValue: 3},
+		&event.ObserverEvent{OMetricName: "sum.a", OValue: 1},
+		&event.ObserverEvent{OMetricName: "sum.a", OValue: 3},
+	})
+	metrics := run(event.Events{
+		&event.CounterEvent{CMetricName: "counter_test", CValue: 2, CLabels: map[string]string{"code": "200"}},
+		&event.ObserverEvent{OMetricName: "hist.a", OValue: 10},
+	})
+
+	expected := map[string]float64{
+		"counter_test": 5,
+		"gauge_test":   7,
+		"hist_test":    13.5,
+		"sum_test":     4,
+	}
+	for name, want := range expected {
+		labels := prometheus.Labels{}
+		if name == "counter_test" {
+			labels["code"] = "200"
+		}
+		value := getFloat64(metrics, name, labels)
+		if value == nil {
+			t.Fatalf("%s: metric not found", name)
+		}
+		if *value != want {
+			t.Fatalf("%s: expected %v, got %v", name, want, *value)
+		}
+	}
+
+	for _, mf := range metrics {
+		if mf.GetName() != "sum_test" {
+			continue
+		}
+		// The summary is only restored, but has the quantiles of its mapping.
+		q := mf.Metric[0].GetSummary().Quantile
+		if len(q) != 1 || q[0].GetQuantile() != 0.25 {
+			t.Fatalf("expected the 0.25 quantile, got %v", q)
+		}
+	}
+
+	for _, mf := range metrics {
+		if mf.GetName() != "hist_test" {
+			continue
+		}
+		h := mf.Metric[0].GetHistogram()
+		if h.GetSampleCount() != 3 {
+			t.Fatalf("expected 3 observations, got %d", h.GetSampleCount())
+		}
+		for i, want := range []uint64{1, 2} {
+			if got := h.Bucket[i].GetCumulativeCount(); got != want {
+				t.Fatalf("bucket %v: expected %d, got %d", h.Bucket[i].GetUpperBound(), want, got)
+			}
+		}
+	}
+}
+
+func TestShardedExporter(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = previousClock }()
+	clock.ClockInstance.Instant = time.Unix(0, 0)
+
+	config := `
+defaults:
+  conflict_strategy: suffix
+mappings:
+- match: hist.*
+  name: hist_${1}
+  observer_type: histogram
+  histogram_options:
+    buckets: [1, 5]
+- match: ttl.*
+  name: ttl_${1}
+  ttl: 1s
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	var in event.Events
+	for i := 0; i < 200; i++ {
+		labels := map[string]string{"n": fmt.Sprint(i % 7)}
+		in = append(in,
+			&event.CounterEvent{CMetricName: fmt.Sprintf("counter_%d", i%13), CValue: float64(i), CLabels: labels},
+			&event.GaugeEvent{GMetricName: fmt.Sprintf("gauge_%d", i%11), GValue: float64(i), GRelative: i%2 == 0, GLabels: labels},
+			&event.ObserverEvent{OMetricName: fmt.Sprintf("hist.%d", i%5), OValue: float64(i % 7), OLabels: labels},
+			&event.ObserverEvent{OMetricName: fmt.Sprintf("summary_%d", i%3), OValue: float64(i % 7), OLabels: labels},
+			// These conflict with the histograms and are renamed.
+			&event.CounterEvent{CMetricName: fmt.Sprintf("hist.%d", i%5), CValue: 1, CLabels: labels},
+			&event.GaugeEvent{GMetricName: fmt.Sprintf("counter_%d", i%13), GValue: 1, GLabels: labels},
+		)
+	}
+
+	run := func(shards int, in event.Events, tick bool) []*dto.MetricFamily {
+		reg := prometheus.NewRegistry()
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Shards = shards
+
+		events := make(chan event.Events)
+		done := make(chan struct{})
+		go func() {
+			ex.Listen(events)
+			close(done)
+		}()
+		for i := 0; i < len(in); i += 50 {
+			events <- in[i : i+50]
+		}
+		if tick {
+			// Wait until all events are recorded before they expire.
+			recorded := func() bool {
+				metrics := gather(t, reg)
+				for _, ev := range in {
+					if strings.HasPrefix(ev.MetricName(), "ttl.") && getFloat64(metrics, "ttl_"+ev.MetricName()[4:], prometheus.Labels{}) == nil {
+						return false
+					}
+				}
+				return true
+			}
+			for i := 0; !recorded(); i++ {
+				if i == 100 {
+					t.Fatal("events were not recorded")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			clock.ClockInstance.Instant = time.Unix(10, 0)
+			clock.ClockInstance.TickerCh <- time.Unix(10, 0)
+		}
+		close(events)
+		<-done
+
+		return gather(t, reg)
+	}
+
+	expected := run(1, in, false)
+	actual := run(4, in, false)
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d metric families, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i].String() != actual[i].String() {
+			t.Fatalf("expected %s, got %s", expected[i], actual[i])
+		}
+	}
+
+	// Stale series are removed in all shards.
+	var ttlEvents event.Events
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		ttlEvents = append(ttlEvents, &event.GaugeEvent{GMetricName: "ttl." + name, GValue: 1})
+	}
+	for len(ttlEvents)%50 != 0 {
+		ttlEvents = append(ttlEvents, &event.CounterEvent{CMetricName: "counter_0", CValue: 1})
+	}
+	metrics := run(4, ttlEvents, true)
+	for _, mf := range metrics {
+		if strings.HasPrefix(mf.GetName(), "ttl_") {
+			t.Fatalf("expected %s to be removed", mf.GetName())
+		}
+	}
+	if getFloat64(metrics, "counter_0", prometheus.Labels{}) == nil {
+		t.Fatal("expected counter_0 without TTL to be kept")
+	}
+}
+
+func TestShardedExporterSeriesOrder(t *testing.T) {
+	// All StatsD metrics are mapped to the same series.
+	config := `
+mappings:
+- match: gauge.*
+  name: gauge
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Shards = 8
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	// Every batch has its own StatsD metric, which would let the batches
+	// overtake each other if they were distributed by StatsD metric.
+	const batches = 500
+	for i := 0; i < batches; i++ {
+		events <- event.Events{&event.GaugeEvent{GMetricName: fmt.Sprintf("gauge.%d", i), GValue: float64(i)}}
+	}
+	close(events)
+	<-done
+
+	v := getFloat64(gather(t, reg), "gauge", prometheus.Labels{})
+	if v == nil {
+		t.Fatal("expected the gauge to be recorded")
+	}
+	if *v != batches-1 {
+		t.Fatalf("expected the last value %d, got %v", batches-1, *v)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	scenarios := map[string]string{
+		"foo":               "foo",
+		"foo_sum":           "foo",
+		"foo_bucket":        "foo",
+		"foo_counter_count": "foo",
+		"foo_count_ps":      "foo",
+		"foo_upper_99_9":    "foo",
+		"http_requests":     "http_requests",
+		"_sum":              "_sum",
+		"sum":               "sum",
+	}
+	for name, key := range scenarios {
+		if got := shardKey(name); got != key {
+			t.Errorf("%s: expected shard key %s, got %s", name, key, got)
+		}
+	}
+}
+
+func gather(t *testing.T, reg *prometheus.Registry) []*dto.MetricFamily {
+	t.Helper()
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from registry: %v", err)
+	}
+	return metrics
+}
+
 type statsDPacketHandler interface {
 	HandlePacket(packet []byte)
 	SetEventHandler(eh event.EventHandler)
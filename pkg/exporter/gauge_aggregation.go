@@ -0,0 +1,49 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// handleGauge records a gauge value. Without a gauge aggregation, the gauge
+// is updated right away. Otherwise, the value is added to the current window,
+// and the gauge is set to the aggregate at the end of the window. Relative
+// changes are applied to the most recent value of the series.
+func (b *Exporter) handleGauge(metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, value float64, relative bool) {
+	b.record("gauge", "gauge", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+		gauge, err := b.Registry.GetGauge(metricName, labels, help, mapping, b.MetricsCount)
+		if err != nil {
+			return err
+		}
+
+		if mapping.GaugeAggregation == mapper.GaugeAggregationDefault {
+			if relative {
+				gauge.Add(value)
+			} else {
+				gauge.Set(value)
+			}
+			return nil
+		}
+
+		w := b.gaugeWindowFor(metricName, labels, gauge, mapping.GaugeAggregationWindow, gaugeAggregationResult(mapping.GaugeAggregation))
+		if relative {
+			value += w.last
+		}
+		w.add(value)
+		return nil
+	}, nil)
+}
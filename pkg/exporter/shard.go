@@ -0,0 +1,328 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/registry"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+)
+
+// shardQueueSize is the number of batches that can wait for each stage of
+// a sharded pipeline.
+const shardQueueSize = 16
+
+// shardBatch is the work of a shard. tick requests the periodic removal of
+// stale metrics and the advancement of windows.
+type shardBatch struct {
+	events []mappedEvent
+	tick   bool
+}
+
+// derivedSuffixes are the name suffixes of metrics that are derived from
+// another metric. A metric and all metrics derived from it have the same
+// shard key:
+//
+//   - sum, count and bucket are the series of histograms and summaries.
+//   - counter, gauge, histogram, summary and statsd are added by the suffix
+//     conflict strategy.
+//   - the rest are added by statsd_aggregates, and may be followed by a
+//     percentile.
+var derivedSuffixes = []string{
+	"sum", "count", "bucket",
+	"counter", "gauge", "histogram", "summary", "statsd",
+	"ps", "lower", "upper", "mean", "median", "std",
+}
+
+// shardKey returns the part of a metric name that determines its shard. It
+// strips all suffixes of derived metrics, so that all metrics whose names
+// can conflict with each other are in the same shard.
+func shardKey(metricName string) string {
+	for {
+		i := strings.LastIndexByte(metricName, '_')
+		if i <= 0 {
+			return metricName
+		}
+		if !isDerivedSuffix(metricName[i+1:]) {
+			return metricName
+		}
+		metricName = metricName[:i]
+	}
+}
+
+func isDerivedSuffix(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := true
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			digits = false
+			break
+		}
+	}
+	if digits {
+		return true
+	}
+	for _, suffix := range derivedSuffixes {
+		if s == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// shardOf returns the index of the shard for key, out of n shards. It uses
+// the 32-bit FNV-1a hash, inlined to avoid allocations.
+func shardOf(key string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+// initShards creates the partitions of the registry when Shards is set. The
+// first partition is the registry of the exporter itself.
+func (b *Exporter) initShards() {
+	b.shardsOnce.Do(func() {
+		if b.Shards <= 1 {
+			return
+		}
+		if b.registerer == nil {
+			level.Warn(b.Logger).Log("msg", "Sharding requires an exporter created by NewExporter, handling events sequentially")
+			return
+		}
+		b.shards = make([]*Exporter, b.Shards)
+		for i := range b.shards {
+			r := b.Registry
+			if i > 0 {
+				r = registry.NewRegistry(b.registerer, b.Mapper)
+			}
+			b.shards[i] = &Exporter{
+				Mapper:                b.Mapper,
+				Registry:              r,
+				Logger:                b.Logger,
+				EventsActions:         b.EventsActions,
+				EventsUnmapped:        b.EventsUnmapped,
+				ErrorEventStats:       b.ErrorEventStats,
+				EventStats:            b.EventStats,
+				ConflictingEventStats: b.ConflictingEventStats,
+				MetricsCount:          b.MetricsCount,
+				Unmapped:              b.Unmapped,
+				ConflictsResolved:     b.ConflictsResolved,
+			}
+		}
+	})
+}
+
+// listenSharded is Listen for an exporter with shards. It is a pipeline of
+// two stages with one goroutine per shard each:
+//
+//  1. Events are mapped. The batches of events take turns between the
+//     mappers, so that they are mapped in parallel.
+//  2. Mapped events are recorded. They are distributed by the shard key of
+//     the resulting metric name, and each shard owns its partition of the
+//     registry. Each shard takes the batches from the mappers in the same
+//     turns, so it records them in the order they were received.
+//
+// All events of a series go to the same shard, and stay in order, even if
+// they were sent under different StatsD metric names.
+func (b *Exporter) listenSharded(e <-chan event.Events) {
+	n := len(b.shards)
+	removeStaleMetricsTicker := clock.NewTicker(time.Second)
+
+	var snapshotC <-chan time.Time
+	if b.SnapshotFile != "" && b.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(b.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotC = snapshotTicker.C
+	}
+
+	// toRecord[m][s] carries the batches of mapper m for shard s.
+	toRecord := make([][]chan shardBatch, n)
+	for m := range toRecord {
+		toRecord[m] = make([]chan shardBatch, n)
+		for s := range toRecord[m] {
+			toRecord[m][s] = make(chan shardBatch, shardQueueSize)
+		}
+	}
+
+	var recorders sync.WaitGroup
+	for s, shard := range b.shards {
+		in := make([]<-chan shardBatch, n)
+		for m := range toRecord {
+			in[m] = toRecord[m][s]
+		}
+		recorders.Add(1)
+		go func(shard *Exporter, in []<-chan shardBatch) {
+			defer recorders.Done()
+			shard.recordBatches(in)
+		}(shard, in)
+	}
+
+	var mappers sync.WaitGroup
+	toMap := make([]chan mapBatch, n)
+	for m := range toMap {
+		toMap[m] = make(chan mapBatch, shardQueueSize)
+		mappers.Add(1)
+		go func(c <-chan mapBatch, out []chan shardBatch) {
+			defer mappers.Done()
+			b.mapEvents(c, out)
+		}(toMap[m], toRecord[m])
+	}
+
+	// turn is the mapper that gets the next batch.
+	turn := 0
+	send := func(batch mapBatch) {
+		toMap[turn] <- batch
+		turn = (turn + 1) % n
+	}
+	for {
+		select {
+		case <-removeStaleMetricsTicker.C:
+			send(mapBatch{tick: true})
+		case <-snapshotC:
+			b.writeSnapshotOrLog()
+		case events, ok := <-e:
+			if !ok {
+				level.Debug(b.Logger).Log("msg", "Channel is closed. Break out of Exporter.Listener.")
+				removeStaleMetricsTicker.Stop()
+				// Drain the pipeline. The mappers close their channels
+				// to the shards once they are done.
+				for _, c := range toMap {
+					close(c)
+				}
+				mappers.Wait()
+				recorders.Wait()
+				b.writeSnapshotOrLog()
+				return
+			}
+			send(mapBatch{events: events})
+		}
+	}
+}
+
+// mapBatch is the work of a mapper. tick is passed on to all shards.
+type mapBatch struct {
+	events event.Events
+	tick   bool
+}
+
+// mapEvents is the first stage of a sharded pipeline. It passes a batch,
+// empty or not, to every shard for each of its batches, so that the shards
+// can take the batches of the mappers in turns.
+func (b *Exporter) mapEvents(c <-chan mapBatch, out []chan shardBatch) {
+	defer func() {
+		for _, o := range out {
+			close(o)
+		}
+	}()
+	n := len(out)
+	for batch := range c {
+		batches := make([]shardBatch, n)
+		for i := range batches {
+			batches[i].tick = batch.tick
+		}
+		for _, ev := range batch.events {
+			me, ok := b.mapEvent(ev)
+			if !ok {
+				continue
+			}
+			i := shardOf(shardKey(me.metricName), n)
+			batches[i].events = append(batches[i].events, me)
+		}
+		for i, o := range out {
+			o <- batches[i]
+		}
+	}
+}
+
+// recordBatches is the second stage of a sharded pipeline, run by each
+// shard. It takes the batches from the mappers in the turns they got their
+// work in. Once the mapper whose turn it is is done, all are.
+func (b *Exporter) recordBatches(in []<-chan shardBatch) {
+	for turn := 0; ; turn = (turn + 1) % len(in) {
+		batch, ok := <-in[turn]
+		if !ok {
+			return
+		}
+		if !batch.tick && len(batch.events) == 0 {
+			continue
+		}
+		b.mu.Lock()
+		if batch.tick {
+			b.Registry.RemoveStaleMetrics()
+			b.advanceWindows()
+		}
+		for _, me := range batch.events {
+			b.recordEvent(me)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// snapshotSeries returns the state of all metrics, of all shards.
+func (b *Exporter) snapshotSeries() []snapshot.Series {
+	if b.shards == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.Registry.Snapshot()
+	}
+
+	var series []snapshot.Series
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		series = append(series, shard.Registry.Snapshot()...)
+		shard.mu.Unlock()
+	}
+	return series
+}
+
+// restoreSeries restores series into the shards they belong to.
+func (b *Exporter) restoreSeries(series []snapshot.Series) (int, error) {
+	if b.shards == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.Registry.Restore(series, b.MetricsCount)
+	}
+
+	n := len(b.shards)
+	partitions := make([][]snapshot.Series, n)
+	for _, s := range series {
+		i := shardOf(shardKey(s.Name), n)
+		partitions[i] = append(partitions[i], s)
+	}
+	var (
+		restored int
+		firstErr error
+	)
+	for i, shard := range b.shards {
+		shard.mu.Lock()
+		r, err := shard.Registry.Restore(partitions[i], b.MetricsCount)
+		shard.mu.Unlock()
+		restored += r
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return restored, firstErr
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"os"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+)
+
+// WriteSnapshot persists the state of all metrics to SnapshotFile. It is a
+// no-op if no snapshot file is configured. It is safe to call while Listen
+// is running.
+func (b *Exporter) WriteSnapshot() error {
+	if b.SnapshotFile == "" {
+		return nil
+	}
+
+	return snapshot.WriteFile(b.SnapshotFile, b.Snapshot())
+}
+
+// Snapshot returns the state of all metrics. It is safe to call while
+// Listen is running.
+func (b *Exporter) Snapshot() *snapshot.Snapshot {
+	b.initShards()
+	return &snapshot.Snapshot{
+		CreatedAt: clock.Now(),
+		Series:    b.snapshotSeries(),
+	}
+}
+
+// Restore recreates the metrics of a snapshot, and returns the number of
+// series restored. It must be called before any events are handled. Series
+// that can't be restored are skipped, and the error tells why.
+func (b *Exporter) Restore(s *snapshot.Snapshot) (int, error) {
+	b.initShards()
+	return b.restoreSeries(s.Series)
+}
+
+func (b *Exporter) writeSnapshotOrLog() {
+	if err := b.WriteSnapshot(); err != nil {
+		level.Error(b.Logger).Log("msg", "Failed to write snapshot", "file", b.SnapshotFile, "error", err)
+	}
+}
+
+// RestoreSnapshot recreates the metrics persisted in SnapshotFile. It must be
+// called before any events are handled. A missing snapshot file is not an
+// error.
+func (b *Exporter) RestoreSnapshot() error {
+	if b.SnapshotFile == "" {
+		return nil
+	}
+
+	s, err := snapshot.ReadFile(b.SnapshotFile)
+	if os.IsNotExist(err) {
+		level.Info(b.Logger).Log("msg", "No snapshot to restore", "file", b.SnapshotFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	restored, err := b.Restore(s)
+	level.Info(b.Logger).Log("msg", "Restored snapshot", "file", b.SnapshotFile, "created_at", s.CreatedAt, "series", restored, "skipped", len(s.Series)-restored)
+	if err != nil {
+		level.Warn(b.Logger).Log("msg", "Some series could not be restored", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// statsdAggregates computes the timer statistics of the original StatsD
+// daemon over a flush interval, and exposes each of them as a gauge named
+// after the metric and the statistic, for example my_timer_upper_90.
+type statsdAggregates struct {
+	b           *Exporter
+	metricName  string
+	labels      prometheus.Labels
+	help        string
+	mapping     *mapper.MetricMapping
+	percentiles []float64
+
+	values []float64
+}
+
+func (a *statsdAggregates) add(value float64) {
+	a.values = append(a.values, value)
+}
+
+func (a *statsdAggregates) flush(window time.Duration) {
+	values := a.values
+	a.values = a.values[:0]
+
+	count := len(values)
+	if count == 0 {
+		// Like StatsD, only the counts are reported for an empty interval.
+		a.setExisting("count", 0)
+		a.setExisting("count_ps", 0)
+		return
+	}
+
+	sort.Float64s(values)
+	cumulative := make([]float64, count)
+	sum := 0.0
+	for i, v := range values {
+		sum += v
+		cumulative[i] = sum
+	}
+	mean := sum / float64(count)
+
+	var median float64
+	if mid := count / 2; count%2 == 1 {
+		median = values[mid]
+	} else {
+		median = (values[mid-1] + values[mid]) / 2
+	}
+
+	sumOfDiffs := 0.0
+	for _, v := range values {
+		sumOfDiffs += (v - mean) * (v - mean)
+	}
+
+	a.set("count", float64(count))
+	a.set("count_ps", float64(count)/window.Seconds())
+	a.set("sum", sum)
+	a.set("lower", values[0])
+	a.set("upper", values[count-1])
+	a.set("mean", mean)
+	a.set("median", median)
+	a.set("std", math.Sqrt(sumOfDiffs/float64(count)))
+
+	for _, p := range a.percentiles {
+		// The number of values below the threshold is rounded half up, as in
+		// StatsD.
+		n := int(math.Floor(p/100*float64(count) + 0.5))
+		if count == 1 {
+			n = 1
+		}
+		if n == 0 {
+			continue
+		}
+		suffix := percentileSuffix(p)
+		a.set("count"+suffix, float64(n))
+		a.set("sum"+suffix, cumulative[n-1])
+		a.set("mean"+suffix, cumulative[n-1]/float64(n))
+		a.set("upper"+suffix, values[n-1])
+	}
+}
+
+// percentileSuffix is appended to the statistics of a percentile, with the
+// "." in the percentile replaced by "_", for example _99_9.
+func percentileSuffix(p float64) string {
+	return "_" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+// StatsdAggregatesStats returns the statistics that a statsd_aggregates
+// observer with the given percentiles exposes for an interval with a single
+// value, in the order they are set. Each of them is a gauge named after the
+// metric and the statistic.
+func StatsdAggregatesStats(percentiles []float64) []string {
+	stats := []string{"count", "count_ps", "sum", "lower", "upper", "mean", "median", "std"}
+	for _, p := range percentiles {
+		suffix := percentileSuffix(p)
+		stats = append(stats, "count"+suffix, "sum"+suffix, "mean"+suffix, "upper"+suffix)
+	}
+	return stats
+}
+
+// set updates the gauge of a statistic.
+func (a *statsdAggregates) set(stat string, value float64) {
+	name := a.metricName + "_" + stat
+	gauge, err := a.b.Registry.GetGauge(name, a.labels, a.help, a.mapping, a.b.MetricsCount)
+	if err != nil {
+		level.Debug(a.b.Logger).Log("msg", regErrF, "metric", name, "error", err)
+		return
+	}
+	gauge.Set(value)
+}
+
+// setExisting updates the gauge of a statistic if it exists, without
+// extending its lifetime.
+func (a *statsdAggregates) setExisting(stat string, value float64) {
+	rm := a.b.Registry.GetRegisteredMetric(a.metricName+"_"+stat, a.labels)
+	if rm == nil {
+		return
+	}
+	if gauge, ok := rm.Metric.(prometheus.Gauge); ok {
+		gauge.Set(value)
+	}
+}
+
+// observeStatsdAggregates adds a value to the current flush interval of a
+// statsd_aggregates observer.
+func (b *Exporter) observeStatsdAggregates(metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, value float64) {
+	options := b.Mapper.StatsdAggregates(mapping)
+	b.record("observer", "statsd", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+		// The count gauge holds the state of the series.
+		countName := metricName + "_count"
+		if _, err := b.Registry.GetGauge(countName, labels, help, mapping, b.MetricsCount); err != nil {
+			return err
+		}
+		newAggregates := func() windowAggregator {
+			return &statsdAggregates{b: b, metricName: metricName, labels: labels}
+		}
+		state := b.windowFor(countName, labels, options.FlushInterval, newAggregates)
+		a, ok := state.aggregator.(*statsdAggregates)
+		if !ok {
+			a = newAggregates().(*statsdAggregates)
+			state.aggregator = a
+		}
+		// The options may have changed with a configuration reload.
+		a.help = help
+		a.mapping = mapping
+		a.percentiles = options.Percentiles
+		a.add(value)
+		return nil
+	}, nil)
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// gaugeCounterState is the per-series state of a gauge that is exposed as a
+// counter.
+type gaugeCounterState struct {
+	last float64
+}
+
+// handleTypeOverride records an event as the metric type the mapping
+// overrides it to. The conversions are:
+//
+//   - counter to gauge: the gauge is set to the value.
+//   - counter or gauge to observer: the value is observed. For relative
+//     gauge changes, the change itself is observed.
+//   - gauge to counter: the counter is incremented by the increase of the
+//     gauge since the previous event. The first value only sets the baseline.
+//     A decrease of an absolute gauge is treated as a reset, and the new value
+//     is added. Relative decreases are ignored.
+//   - observer to counter: the counter is incremented by the value.
+//   - observer to gauge: the gauge is set to the value.
+func (b *Exporter) handleTypeOverride(thisEvent event.Event, metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping) {
+	fromTimer := false
+	relative := false
+	switch ev := thisEvent.(type) {
+	case *event.GaugeEvent:
+		relative = ev.GRelative
+	case *event.ObserverEvent:
+		fromTimer = ev.OTimer
+	}
+	value := mapping.TransformValue(thisEvent.Value(), fromTimer, !relative)
+
+	switch mapping.TypeOverride {
+	case mapper.MetricTypeCounter:
+		fromGauge := thisEvent.MetricType() == mapper.MetricTypeGauge
+		if !fromGauge && value < 0.0 {
+			level.Debug(b.Logger).Log("msg", "counter must be non-negative value", "metric", metricName, "event_value", value)
+			b.ErrorEventStats.WithLabelValues("illegal_negative_counter").Inc()
+			return
+		}
+
+		// A gauge can't be recorded in an existing gauge as a counter without
+		// losing its reset semantics.
+		var asGauge updateFunc
+		if !fromGauge {
+			asGauge = b.addToGauge(help, mapping, value)
+		}
+		b.record("counter", "counter", metricName, prometheusLabels, mapping, func(metricName string, labels prometheus.Labels) error {
+			counter, err := b.Registry.GetCounter(metricName, labels, help, mapping, b.MetricsCount)
+			if err != nil {
+				return err
+			}
+			increase := value
+			if fromGauge {
+				increase = gaugeIncrease(b.Registry.GetRegisteredMetric(metricName, labels), value, relative)
+			}
+			counter.Add(increase)
+			return nil
+		}, asGauge)
+
+	case mapper.MetricTypeGauge:
+		b.handleGauge(metricName, prometheusLabels, help, mapping, value, false)
+
+	case mapper.MetricTypeObserver:
+		b.observe(metricName, prometheusLabels, help, mapping, value)
+	}
+}
+
+// gaugeIncrease tracks the value of a gauge that is exposed as a counter in
+// the state of its series, and returns how much the counter has to be
+// incremented.
+func gaugeIncrease(rm *metrics.RegisteredMetric, value float64, relative bool) float64 {
+	state, ok := rm.State.(*gaugeCounterState)
+	if !ok {
+		// A new series starts from zero for relative changes. An absolute
+		// value only sets the baseline.
+		state = &gaugeCounterState{}
+		rm.State = state
+		if !relative {
+			state.last = value
+			return 0
+		}
+	}
+
+	if relative {
+		state.last += value
+		if value < 0 {
+			return 0
+		}
+		return value
+	}
+
+	increase := value - state.last
+	if increase < 0 {
+		// The gauge went down, which is treated as a reset.
+		increase = value
+		if increase < 0 {
+			increase = 0
+		}
+	}
+	state.last = value
+	return increase
+}
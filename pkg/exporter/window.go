@@ -0,0 +1,183 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// windowAggregator combines the values received within a window.
+type windowAggregator interface {
+	add(value float64)
+	// flush publishes the aggregate of a completed window, and starts a new
+	// one.
+	flush(window time.Duration)
+}
+
+// windowState is the per-series state of a metric whose values are
+// aggregated over fixed windows, and published at the end of each window.
+type windowState struct {
+	metricName string
+	labels     prometheus.Labels
+	rm         *metrics.RegisteredMetric
+	window     time.Duration
+	// start is the beginning of the current window.
+	start      time.Time
+	aggregator windowAggregator
+}
+
+// advance publishes the completed windows up to now.
+func (s *windowState) advance(now time.Time) {
+	elapsed := now.Sub(s.start)
+	if elapsed < s.window {
+		return
+	}
+	periods := elapsed / s.window
+	s.aggregator.flush(s.window)
+	if periods > 1 {
+		// The last completed window was empty.
+		s.aggregator.flush(s.window)
+	}
+	s.start = s.start.Add(periods * s.window)
+}
+
+// windowFor returns the window state of a series, creating it with
+// newAggregator if necessary, and publishes the windows that have completed
+// by now.
+func (b *Exporter) windowFor(metricName string, labels prometheus.Labels, window time.Duration, newAggregator func() windowAggregator) *windowState {
+	now := clock.Now()
+	rm := b.Registry.GetRegisteredMetric(metricName, labels)
+	state, ok := rm.State.(*windowState)
+	if !ok {
+		state = &windowState{
+			metricName: metricName,
+			labels:     labels,
+			rm:         rm,
+			start:      now,
+			aggregator: newAggregator(),
+		}
+		rm.State = state
+		if b.windows == nil {
+			b.windows = make(map[*windowState]struct{})
+		}
+		b.windows[state] = struct{}{}
+	}
+	// The window may have changed with a configuration reload.
+	state.window = window
+	state.advance(now)
+	return state
+}
+
+// advanceWindows publishes the completed windows of all aggregated series,
+// so that they are updated when no more values are received. Series that
+// have expired are forgotten.
+func (b *Exporter) advanceWindows() {
+	now := clock.Now()
+	for state := range b.windows {
+		if b.Registry.GetRegisteredMetric(state.metricName, state.labels) != state.rm {
+			delete(b.windows, state)
+			continue
+		}
+		state.advance(now)
+	}
+}
+
+// gaugeWindow aggregates the values of a window into a single gauge.
+type gaugeWindow struct {
+	gauge prometheus.Gauge
+	// result computes the value of the gauge for a completed window. It
+	// returns false if the gauge should keep its current value.
+	result func(w *gaugeWindow, window time.Duration) (float64, bool)
+
+	count         int
+	sum, min, max float64
+	// last is the most recent value. It is kept across windows, so that
+	// relative gauge changes can be applied to it.
+	last float64
+}
+
+func (w *gaugeWindow) add(value float64) {
+	if w.count == 0 || value < w.min {
+		w.min = value
+	}
+	if w.count == 0 || value > w.max {
+		w.max = value
+	}
+	w.count++
+	w.sum += value
+	w.last = value
+}
+
+func (w *gaugeWindow) flush(window time.Duration) {
+	if value, ok := w.result(w, window); ok {
+		w.gauge.Set(value)
+	}
+	w.count = 0
+	w.sum, w.min, w.max = 0, 0, 0
+}
+
+// rateResult publishes the per-second rate of the sum of a window.
+func rateResult(w *gaugeWindow, window time.Duration) (float64, bool) {
+	return w.sum / window.Seconds(), true
+}
+
+// gaugeAggregationResult returns the result function for a gauge
+// aggregation. Empty windows publish zero for sum and count, and keep the
+// previous value otherwise.
+func gaugeAggregationResult(aggregation mapper.GaugeAggregation) func(w *gaugeWindow, window time.Duration) (float64, bool) {
+	return func(w *gaugeWindow, _ time.Duration) (float64, bool) {
+		switch aggregation {
+		case mapper.GaugeAggregationSum:
+			return w.sum, true
+		case mapper.GaugeAggregationCount:
+			return float64(w.count), true
+		}
+		if w.count == 0 {
+			return 0, false
+		}
+		switch aggregation {
+		case mapper.GaugeAggregationMin:
+			return w.min, true
+		case mapper.GaugeAggregationMax:
+			return w.max, true
+		case mapper.GaugeAggregationAvg:
+			return w.sum / float64(w.count), true
+		default:
+			return w.last, true
+		}
+	}
+}
+
+// gaugeWindowFor returns the gaugeWindow of a gauge series.
+func (b *Exporter) gaugeWindowFor(metricName string, labels prometheus.Labels, gauge prometheus.Gauge, window time.Duration, result func(w *gaugeWindow, window time.Duration) (float64, bool)) *gaugeWindow {
+	state := b.windowFor(metricName, labels, window, func() windowAggregator {
+		return &gaugeWindow{gauge: gauge}
+	})
+	w, ok := state.aggregator.(*gaugeWindow)
+	if !ok {
+		// The series was aggregated differently before a configuration
+		// reload.
+		w = &gaugeWindow{gauge: gauge}
+		state.aggregator = w
+	}
+	// The aggregation may have changed with a configuration reload.
+	w.result = result
+	return w
+}
@@ -81,6 +81,7 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 			OMetricName: metric,
 			OValue:      float64(value) / 1000, // prometheus presumes seconds, statsd millisecond
 			OLabels:     labels,
+			OTimer:      true,
 		}, nil
 	case "h", "d":
 		return &event.ObserverEvent{
@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"net"
+	"syscall"
+)
+
+// credentialsSize is the size of the control message with the credentials
+// of the sender of a datagram.
+var credentialsSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// EnablePeerCredentials makes the operating system pass the credentials of
+// the sending process along with each datagram received on c.
+func EnablePeerCredentials(c *net.UnixConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// peerCredentials returns the user and group ID of the sender from the
+// control messages of a datagram.
+func peerCredentials(oob []byte) (uid, gid uint32, ok bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, msg := range msgs {
+		cred, err := syscall.ParseUnixCredentials(&msg)
+		if err == nil {
+			return cred.Uid, cred.Gid, true
+		}
+	}
+	return 0, 0, false
+}
+
+// connCredentials returns the user and group ID of the process at the other
+// end of a Unix stream connection, as of when it connected.
+func connCredentials(c *net.UnixConn) (uid, gid uint32, ok bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var (
+		cred    *syscall.Ucred
+		sockErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || sockErr != nil {
+		return 0, 0, false
+	}
+	return cred.Uid, cred.Gid, true
+}
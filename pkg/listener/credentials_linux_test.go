@@ -0,0 +1,323 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/statsd_exporter/pkg/acl"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/ratelimit"
+)
+
+func TestUnixgramRateLimitByUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnablePeerCredentials(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ratelimit.ParseConfig(fmt.Sprintf("limits: [{match: 'uid:%d', rate: 1}]", os.Getuid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ratelimit.NewMetrics(nil)
+	c := make(chan event.Events, 10)
+	l := &StatsDUnixgramListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UnixgramPackets: newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		RateLimiter:     ratelimit.NewLimiter(config, m),
+	}
+	wait := start(t, context.Background(), l.Listen)
+
+	client, err := net.Dial("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("first:1|c"))
+	client.Write([]byte("second:1|c"))
+	client.Write([]byte("third:1|c"))
+	expectEvent(t, c, "first")
+	for i := 0; testutil.ToFloat64(l.LinesReceived) < 3; i++ {
+		if i == 100 {
+			t.Fatal("lines were not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.Close()
+	wait()
+	if len(c) != 0 {
+		t.Fatalf("expected all but the first line to be dropped, got %d more", len(c))
+	}
+	if n := testutil.ToFloat64(m.LinesDropped.WithLabelValues(fmt.Sprintf("uid:%d", os.Getuid()))); n != 2 {
+		t.Fatalf("expected 2 lines to be dropped, got %v", n)
+	}
+}
+
+func TestUnixgramACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnablePeerCredentials(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a user ID other than ours is allowed.
+	config, err := acl.ParseConfig(fmt.Sprintf("unixgram: {uids: [%d]}", os.Getuid()+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := acl.NewMetrics(nil)
+	c := make(chan event.Events, 10)
+	l := &StatsDUnixgramListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UnixgramPackets: newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		ACL:             acl.New(config, m),
+	}
+	wait := start(t, context.Background(), l.Listen)
+	defer func() {
+		conn.Close()
+		wait()
+	}()
+
+	client, err := net.Dial("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("denied:1|c"))
+	for i := 0; testutil.ToFloat64(m.Denied.WithLabelValues("unixgram")) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the datagram to be denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	config, err = acl.ParseConfig(fmt.Sprintf("unixgram: {gids: [%d]}", os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ACL.SetConfig(config)
+	client.Write([]byte("allowed:1|c"))
+	expectEvent(t, c, "allowed")
+	if n := testutil.ToFloat64(l.UnixgramPackets); n != 1 {
+		t.Fatalf("expected only the allowed datagram to be handled, got %v", n)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	conn, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDUnixListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		UnixConnections: newCounter(),
+		UnixErrors:      newCounter(),
+		UnixLineTooLong: newCounter(),
+		SourceNamer:     IPSourceNamer{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := start(t, ctx, l.Listen)
+
+	client, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("first:1|c\nsecond:1|c\n"))
+	for _, name := range []string{"first", "second"} {
+		select {
+		case events := <-c:
+			if events[0].MetricName() != name {
+				t.Fatalf("expected an event for %s, got %s", name, events[0].MetricName())
+			}
+			// Senders are named by their user ID, not by an address.
+			if s, want := events[0].(event.SourceEvent).Source(), fmt.Sprintf("uid:%d", os.Getuid()); s != want {
+				t.Fatalf("expected source %s, got %s", want, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	// A line longer than the read buffer ends the connection.
+	long, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+	long.Write([]byte("third:1|c|#" + strings.Repeat("x", 8192) + "\n"))
+	for i := 0; testutil.ToFloat64(l.UnixLineTooLong) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the line to be too long")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping waits for the handler of the open connection.
+	cancel()
+	wait()
+	if n := testutil.ToFloat64(l.UnixErrors); n != 0 {
+		t.Fatalf("expected stopping not to count as an error, got %v errors", n)
+	}
+	if n := testutil.ToFloat64(l.UnixConnections); n != 2 {
+		t.Fatalf("expected 2 connections, got %v", n)
+	}
+	conn.Close()
+}
+
+func TestUnixListenerACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	conn, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Unixgram lists allow us, but only a user ID other than ours may
+	// connect to the stream socket.
+	config, err := acl.ParseConfig(fmt.Sprintf("unixgram: {uids: [%d]}\nunix: {uids: [%d]}", os.Getuid(), os.Getuid()+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := acl.NewMetrics(nil)
+	c := make(chan event.Events, 10)
+	l := &StatsDUnixListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		UnixConnections: newCounter(),
+		UnixErrors:      newCounter(),
+		UnixLineTooLong: newCounter(),
+		ACL:             acl.New(config, m),
+	}
+	wait := start(t, context.Background(), l.Listen)
+	defer func() {
+		conn.Close()
+		wait()
+	}()
+	send := func(data string) {
+		t.Helper()
+		client, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte(data))
+	}
+
+	send("denied:1|c\n")
+	for i := 0; testutil.ToFloat64(m.Denied.WithLabelValues("unix")) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the connection to be denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(l.UnixConnections); n != 0 {
+		t.Fatalf("expected denied connections not to be handled, got %v", n)
+	}
+
+	config, err = acl.ParseConfig(fmt.Sprintf("unix: {gids: [%d]}", os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ACL.SetConfig(config)
+	send("allowed:1|c\n")
+	expectEvent(t, c, "allowed")
+	if n := testutil.ToFloat64(m.Denied.WithLabelValues("unixgram")); n != 0 {
+		t.Fatalf("expected the Unixgram lists not to apply, got %v denied", n)
+	}
+	if len(c) != 0 {
+		t.Fatalf("expected no events from the denied connection, got %d", len(c))
+	}
+}
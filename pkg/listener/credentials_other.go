@@ -0,0 +1,37 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+const credentialsSize = 0
+
+// EnablePeerCredentials is only supported on Linux.
+func EnablePeerCredentials(c *net.UnixConn) error {
+	return errors.New("peer credentials are not supported on this platform")
+}
+
+func peerCredentials(oob []byte) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+func connCredentials(c *net.UnixConn) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -15,16 +15,23 @@ package listener
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/prometheus/statsd_exporter/pkg/acl"
+	"github.com/prometheus/statsd_exporter/pkg/compression"
 	"github.com/prometheus/statsd_exporter/pkg/event"
 	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/ratelimit"
 	"github.com/prometheus/statsd_exporter/pkg/relay"
 )
 
@@ -32,6 +39,198 @@ type Parser interface {
 	LineToEvents(line string, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events
 }
 
+// aLongTimeAgo is a deadline in the past, which makes blocked reads and
+// accepts return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext calls setDeadline with a deadline in the past once ctx is
+// done, to interrupt the listener. The returned function stops watching.
+// The deadline is cleared first, so that a listener can be started again
+// after it was stopped.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	setDeadline(time.Time{})
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// allow reports whether line, sent by source, is within its rate limit.
+// Empty lines don't count.
+func allow(limiter *ratelimit.Limiter, source packetSource, line string) bool {
+	return limiter == nil || line == "" || limiter.Allow(source.key, line)
+}
+
+// withSource sets the source of events, if it is known.
+func withSource(events event.Events, source packetSource) event.Events {
+	if source.name != "" {
+		event.SetSource(events, source.name)
+	}
+	return events
+}
+
+// stopped reports whether err is the result of stopping a listener, by
+// canceling its context or by closing its connection.
+func stopped(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, net.ErrClosed)
+}
+
+// connSet tracks the open connections of a stream listener, so that it can
+// stop reading from them when it stops.
+type connSet struct {
+	// mu guards conns and closing. wg tracks the connection handlers.
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// reset prepares the set for a listener that is started again.
+func (s *connSet) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = false
+}
+
+// handle runs handleConn for c in a new goroutine, and tracks c until
+// handleConn returns.
+func (s *connSet) handle(c net.Conn, handleConn func()) {
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		handleConn()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+}
+
+// stop makes all pending reads on open connections fail, and waits until
+// their handlers return. Lines that are already buffered are still handled.
+func (s *connSet) stop() {
+	s.mu.Lock()
+	s.closing = true
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *connSet) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// len returns the number of open connections.
+func (s *connSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// setIdleDeadline makes reads from c fail after timeout, unless the set is
+// stopping, so that it doesn't undo stop.
+func (s *connSet) setIdleDeadline(c net.Conn, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closing {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// DefaultMaxLineLength is the maximum length of lines on stream connections
+// if none is set.
+const DefaultMaxLineLength = 4096
+
+// newLineReader returns a reader for lines of up to maxLength bytes.
+func newLineReader(c io.Reader, maxLength int) *bufio.Reader {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	// Room for the line ending, which ReadLine doesn't return.
+	return bufio.NewReaderSize(c, maxLength+2)
+}
+
+// decompressPacket returns the decompressed packet if d is set and the
+// packet is compressed, and the packet itself otherwise. It returns false if
+// the packet can't be decompressed, which d counts.
+func decompressPacket(d *compression.Decompressor, proto string, packet []byte, logger log.Logger) ([]byte, bool) {
+	if d == nil {
+		return packet, true
+	}
+	packet, err := d.Datagram(proto, packet)
+	if err != nil {
+		level.Debug(logger).Log("msg", "Decompression failed", "proto", proto, "error", err)
+		return nil, false
+	}
+	return packet, true
+}
+
+// decompressStream returns a reader for the lines of the decompressed
+// stream if the connection read by r is compressed, and r itself otherwise.
+// done has to be called once the connection ends. It returns false if the
+// stream can't be decompressed, which d counts.
+func decompressStream(d *compression.Decompressor, proto string, r *bufio.Reader, maxLineLength int, logger log.Logger) (lines *bufio.Reader, done func(), ok bool) {
+	s, err := d.Stream(proto, r)
+	if err != nil {
+		level.Debug(logger).Log("msg", "Decompression failed", "proto", proto, "error", err)
+		return nil, nil, false
+	}
+	if s == nil {
+		return r, func() {}, true
+	}
+	return newLineReader(s, maxLineLength), func() { s.Close() }, true
+}
+
+func isDecompressionError(err error) bool {
+	var de *compression.Error
+	return errors.As(err, &de)
+}
+
+// lineBuffered returns whether a whole line can be read from r without
+// reading from the connection.
+func lineBuffered(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buf, '\n') >= 0
+}
+
+// readLine reads the next line from r, without its line ending. A line
+// longer than maxLength is skipped, up to its end, and tooLong is returned.
+func readLine(r *bufio.Reader, maxLength int) (line []byte, tooLong bool, err error) {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	line, isPrefix, err := r.ReadLine()
+	if err != nil || !isPrefix && len(line) <= maxLength {
+		return line, false, err
+	}
+	for isPrefix {
+		if _, isPrefix, err = r.ReadLine(); err != nil {
+			return nil, true, err
+		}
+	}
+	return nil, true, nil
+}
+
 type StatsDUDPListener struct {
 	Conn            *net.UDPConn
 	EventHandler    event.EventHandler
@@ -45,39 +244,72 @@ type StatsDUDPListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// RateLimiter, if set, drops lines exceeding their rate limit.
+	RateLimiter *ratelimit.Limiter
+	// SourceNamer, if set, names the sender of the events.
+	SourceNamer SourceNamer
+	// ProxyProtocol, if set, accepts PROXY protocol headers.
+	ProxyProtocol *ProxyProtocol
+	// ACL, if set, drops packets from senders it denies.
+	ACL *acl.ACL
+	// Decompressor, if set, decompresses compressed packets.
+	Decompressor *compression.Decompressor
 }
 
 func (l *StatsDUDPListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
-func (l *StatsDUDPListener) Listen() {
+// Listen handles packets until ctx is canceled or Conn is closed, and then
+// returns nil. Conn is not closed when ctx is canceled, so Listen can be
+// called again with a new context. Any other read error is returned.
+func (l *StatsDUDPListener) Listen(ctx context.Context) error {
+	defer watchContext(ctx, l.Conn.SetReadDeadline)()
+
 	buf := make([]byte, 65535)
 	for {
-		n, _, err := l.Conn.ReadFromUDP(buf)
+		n, addr, err := l.Conn.ReadFromUDP(buf)
 		if err != nil {
-			// https://github.com/golang/go/issues/4373
-			// ignore net: errClosing error as it will occur during shutdown
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				return
+			if stopped(ctx, err) {
+				return nil
 			}
-			level.Error(l.Logger).Log("error", err)
-			return
+			return err
 		}
-		l.HandlePacket(buf[0:n])
+		packet, ip := buf[0:n], addr.IP
+		if l.ProxyProtocol != nil {
+			var ok bool
+			if packet, ip, ok = l.ProxyProtocol.unwrapDatagram(ip, packet); !ok {
+				continue
+			}
+		}
+		if l.ACL != nil && !l.ACL.AllowUDP(ip) {
+			continue
+		}
+		l.handlePacket(packet, ipSource(ip, l.RateLimiter, l.SourceNamer))
 	}
 }
 
 func (l *StatsDUDPListener) HandlePacket(packet []byte) {
+	l.handlePacket(packet, packetSource{})
+}
+
+func (l *StatsDUDPListener) handlePacket(packet []byte, source packetSource) {
 	l.UDPPackets.Inc()
+	packet, ok := decompressPacket(l.Decompressor, "udp", packet, l.Logger)
+	if !ok {
+		return
+	}
 	lines := strings.Split(string(packet), "\n")
 	for _, line := range lines {
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "udp", "line", line)
 		l.LinesReceived.Inc()
+		if !allow(l.RateLimiter, source, line) {
+			continue
+		}
 		if l.Relay != nil && len(line) > 0 {
 			l.Relay.RelayLine(line)
 		}
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		l.EventHandler.Queue(withSource(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger), source))
 	}
 }
 
@@ -96,54 +328,283 @@ type StatsDTCPListener struct {
 	TCPConnections  prometheus.Counter
 	TCPErrors       prometheus.Counter
 	TCPLineTooLong  prometheus.Counter
+	// TCPOpenConnections, TCPConnectionsRejected and TCPIdleTimeouts, if
+	// set, count the open connections, the connections closed because
+	// MaxConnections were open, and the connections closed for being idle.
+	TCPOpenConnections     prometheus.Gauge
+	TCPConnectionsRejected prometheus.Counter
+	TCPIdleTimeouts        prometheus.Counter
+	// MaxLineLength is the maximum length of lines, longer lines are
+	// skipped. 0 means DefaultMaxLineLength.
+	MaxLineLength int
+	// MaxConnections, if positive, is the maximum number of open
+	// connections. Further connections are closed right away.
+	MaxConnections int
+	// IdleTimeout, if positive, closes connections that send nothing for
+	// that long.
+	IdleTimeout time.Duration
+	// KeepAlive is the period of TCP keepalive probes. 0 keeps Go's
+	// default, a negative value disables them.
+	KeepAlive time.Duration
+	// RateLimiter, if set, drops lines exceeding their rate limit.
+	RateLimiter *ratelimit.Limiter
+	// SourceNamer, if set, names the sender of the events.
+	SourceNamer SourceNamer
+	// ProxyProtocol, if set, accepts PROXY protocol headers.
+	ProxyProtocol *ProxyProtocol
+	// ACL, if set, closes connections from senders it denies.
+	ACL *acl.ACL
+	// Decompressor, if set, decompresses compressed connections.
+	Decompressor *compression.Decompressor
+
+	conns connSet
 }
 
 func (l *StatsDTCPListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
-func (l *StatsDTCPListener) Listen() {
+// Listen accepts connections until ctx is canceled or Conn is closed, or
+// accepting fails. It then stops reading from the connections that are still
+// open, and returns once the lines that have already been read are handled.
+// Conn is not closed when ctx is canceled, so Listen can be called again
+// with a new context. The error of accepting is returned, if any.
+func (l *StatsDTCPListener) Listen(ctx context.Context) error {
+	defer watchContext(ctx, l.Conn.SetDeadline)()
+
+	l.conns.reset()
 	for {
 		c, err := l.Conn.AcceptTCP()
 		if err != nil {
-			// https://github.com/golang/go/issues/4373
-			// ignore net: errClosing error as it will occur during shutdown
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				return
+			l.conns.stop()
+			if stopped(ctx, err) {
+				return nil
 			}
-			level.Error(l.Logger).Log("msg", "AcceptTCP failed", "error", err)
-			os.Exit(1)
+			return err
+		}
+		// Behind a PROXY protocol proxy, the client is only known once the
+		// header is read, so HandleConn checks the ACL instead.
+		if l.ACL != nil && l.ProxyProtocol == nil && !l.allowConn(c) {
+			c.Close()
+			continue
+		}
+		if l.MaxConnections > 0 && l.conns.len() >= l.MaxConnections {
+			if l.TCPConnectionsRejected != nil {
+				l.TCPConnectionsRejected.Inc()
+			}
+			level.Debug(l.Logger).Log("msg", "Too many connections, closing", "addr", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		if l.KeepAlive < 0 {
+			c.SetKeepAlive(false)
+		} else if l.KeepAlive > 0 {
+			c.SetKeepAlive(true)
+			c.SetKeepAlivePeriod(l.KeepAlive)
 		}
-		go l.HandleConn(c)
+		l.conns.handle(c, func() { l.HandleConn(c) })
 	}
 }
 
+func (l *StatsDTCPListener) allowConn(c *net.TCPConn) bool {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	return ok && l.ACL.AllowTCP(addr.IP)
+}
+
 func (l *StatsDTCPListener) HandleConn(c *net.TCPConn) {
 	defer c.Close()
 
 	l.TCPConnections.Inc()
+	if l.TCPOpenConnections != nil {
+		l.TCPOpenConnections.Inc()
+		defer l.TCPOpenConnections.Dec()
+	}
+
+	r := newLineReader(c, l.MaxLineLength)
+	// A client that sends nothing at all, not even a PROXY protocol
+	// header, is idle as well.
+	if l.IdleTimeout > 0 {
+		l.conns.setIdleDeadline(c, l.IdleTimeout)
+	}
 
-	r := bufio.NewReader(c)
+	var source packetSource
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip := addr.IP
+		if l.ProxyProtocol != nil {
+			var err error
+			if ip, ok, err = l.ProxyProtocol.readHeader(ip, r); !ok {
+				if !l.conns.isClosing() && l.isIdleTimeout(err) {
+					l.closeIdle(c)
+				}
+				return
+			}
+			if l.ACL != nil && !l.ACL.AllowTCP(ip) {
+				return
+			}
+		}
+		source = ipSource(ip, l.RateLimiter, l.SourceNamer)
+	}
+	if l.Decompressor != nil {
+		if l.IdleTimeout > 0 {
+			l.conns.setIdleDeadline(c, l.IdleTimeout)
+		}
+		dr, done, ok := decompressStream(l.Decompressor, "tcp", r, l.MaxLineLength, l.Logger)
+		if !ok {
+			return
+		}
+		defer done()
+		r = dr
+	}
 	for {
-		line, isPrefix, err := r.ReadLine()
+		if l.IdleTimeout > 0 && !lineBuffered(r) {
+			l.conns.setIdleDeadline(c, l.IdleTimeout)
+		}
+		line, tooLong, err := readLine(r, l.MaxLineLength)
+		if tooLong {
+			l.TCPLineTooLong.Inc()
+			level.Debug(l.Logger).Log("msg", "Skipped line: line too long", "addr", c.RemoteAddr())
+		}
 		if err != nil {
-			if err != io.EOF {
+			switch {
+			case err == io.EOF || l.conns.isClosing():
+			case isDecompressionError(err):
+				level.Debug(l.Logger).Log("msg", "Decompression failed", "addr", c.RemoteAddr(), "error", err)
+			case l.isIdleTimeout(err):
+				l.closeIdle(c)
+			default:
 				l.TCPErrors.Inc()
 				level.Debug(l.Logger).Log("msg", "Read failed", "addr", c.RemoteAddr(), "error", err)
 			}
 			break
 		}
+		if tooLong {
+			continue
+		}
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "tcp", "line", line)
-		if isPrefix {
-			l.TCPLineTooLong.Inc()
-			level.Debug(l.Logger).Log("msg", "Read failed: line too long", "addr", c.RemoteAddr())
+		l.LinesReceived.Inc()
+		if !allow(l.RateLimiter, source, string(line)) {
+			continue
+		}
+		if l.Relay != nil && len(line) > 0 {
+			l.Relay.RelayLine(string(line))
+		}
+		l.EventHandler.Queue(withSource(l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger), source))
+	}
+}
+
+// isIdleTimeout reports whether err is due to the idle timeout.
+func (l *StatsDTCPListener) isIdleTimeout(err error) bool {
+	var netErr net.Error
+	return l.IdleTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// closeIdle records that c is closed for being idle.
+func (l *StatsDTCPListener) closeIdle(c *net.TCPConn) {
+	if l.TCPIdleTimeouts != nil {
+		l.TCPIdleTimeouts.Inc()
+	}
+	level.Debug(l.Logger).Log("msg", "Closing idle connection", "addr", c.RemoteAddr())
+}
+
+type StatsDUnixListener struct {
+	Conn            *net.UnixListener
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      Parser
+	LinesReceived   prometheus.Counter
+	EventsFlushed   prometheus.Counter
+	Relay           *relay.Relay
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	UnixConnections prometheus.Counter
+	UnixErrors      prometheus.Counter
+	UnixLineTooLong prometheus.Counter
+	// MaxLineLength is the maximum length of lines, longer lines are
+	// skipped. 0 means DefaultMaxLineLength.
+	MaxLineLength int
+	// Decompressor, if set, decompresses compressed connections.
+	Decompressor *compression.Decompressor
+	// RateLimiter, if set, drops lines exceeding their rate limit.
+	RateLimiter *ratelimit.Limiter
+	// SourceNamer, if set, names the sender of the events.
+	SourceNamer SourceNamer
+	// ACL, if set, closes connections from processes it denies.
+	ACL *acl.ACL
+
+	conns connSet
+}
+
+func (l *StatsDUnixListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+// Listen accepts connections until ctx is canceled or Conn is closed, or
+// accepting fails, like StatsDTCPListener.Listen.
+func (l *StatsDUnixListener) Listen(ctx context.Context) error {
+	defer watchContext(ctx, l.Conn.SetDeadline)()
+
+	l.conns.reset()
+	for {
+		c, err := l.Conn.AcceptUnix()
+		if err != nil {
+			l.conns.stop()
+			if stopped(ctx, err) {
+				return nil
+			}
+			return err
+		}
+		l.conns.handle(c, func() { l.HandleConn(c) })
+	}
+}
+
+func (l *StatsDUnixListener) HandleConn(c *net.UnixConn) {
+	defer c.Close()
+
+	uid, gid, ok := connCredentials(c)
+	if l.ACL != nil && !l.ACL.AllowUnix(uid, gid, ok) {
+		return
+	}
+	l.UnixConnections.Inc()
+
+	source := credentialsSource(uid, ok, l.RateLimiter, l.SourceNamer)
+	r := newLineReader(c, l.MaxLineLength)
+	if l.Decompressor != nil {
+		dr, done, ok := decompressStream(l.Decompressor, "unix", r, l.MaxLineLength, l.Logger)
+		if !ok {
+			return
+		}
+		defer done()
+		r = dr
+	}
+	for {
+		line, tooLong, err := readLine(r, l.MaxLineLength)
+		if tooLong {
+			l.UnixLineTooLong.Inc()
+			level.Debug(l.Logger).Log("msg", "Skipped line: line too long", "proto", "unix")
+		}
+		if err != nil {
+			if isDecompressionError(err) {
+				level.Debug(l.Logger).Log("msg", "Decompression failed", "proto", "unix", "error", err)
+			} else if err != io.EOF && !l.conns.isClosing() {
+				l.UnixErrors.Inc()
+				level.Debug(l.Logger).Log("msg", "Read failed", "proto", "unix", "error", err)
+			}
 			break
 		}
+		if tooLong {
+			continue
+		}
+		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "unix", "line", line)
 		l.LinesReceived.Inc()
+		if !allow(l.RateLimiter, source, string(line)) {
+			continue
+		}
 		if l.Relay != nil && len(line) > 0 {
 			l.Relay.RelayLine(string(line))
 		}
-		l.EventHandler.Queue(l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		l.EventHandler.Queue(withSource(l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger), source))
 	}
 }
 
@@ -160,38 +621,67 @@ type StatsDUnixgramListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// RateLimiter, if set, drops lines exceeding their rate limit.
+	RateLimiter *ratelimit.Limiter
+	// SourceNamer, if set, names the sender of the events.
+	SourceNamer SourceNamer
+	// ACL, if set, drops datagrams from processes it denies. It needs the
+	// credentials enabled by EnablePeerCredentials.
+	ACL *acl.ACL
+	// Decompressor, if set, decompresses compressed packets.
+	Decompressor *compression.Decompressor
 }
 
 func (l *StatsDUnixgramListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
-func (l *StatsDUnixgramListener) Listen() {
+// Listen handles packets until ctx is canceled or Conn is closed, and then
+// returns nil. Conn is not closed when ctx is canceled, so Listen can be
+// called again with a new context. Any other read error is returned.
+func (l *StatsDUnixgramListener) Listen(ctx context.Context) error {
+	defer watchContext(ctx, l.Conn.SetReadDeadline)()
+
 	buf := make([]byte, 65535)
+	oob := make([]byte, credentialsSize)
 	for {
-		n, _, err := l.Conn.ReadFromUnix(buf)
+		n, oobn, _, _, err := l.Conn.ReadMsgUnix(buf, oob)
 		if err != nil {
-			// https://github.com/golang/go/issues/4373
-			// ignore net: errClosing error as it will occur during shutdown
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				return
+			if stopped(ctx, err) {
+				return nil
 			}
-			level.Error(l.Logger).Log(err)
-			os.Exit(1)
+			return err
+		}
+		// The credentials are only passed if EnablePeerCredentials was
+		// called for Conn.
+		uid, gid, ok := peerCredentials(oob[:oobn])
+		if l.ACL != nil && !l.ACL.AllowUnixgram(uid, gid, ok) {
+			continue
 		}
-		l.HandlePacket(buf[:n])
+		l.handlePacket(buf[:n], credentialsSource(uid, ok, l.RateLimiter, l.SourceNamer))
 	}
 }
 
 func (l *StatsDUnixgramListener) HandlePacket(packet []byte) {
+	l.handlePacket(packet, packetSource{})
+}
+
+func (l *StatsDUnixgramListener) handlePacket(packet []byte, source packetSource) {
 	l.UnixgramPackets.Inc()
+	packet, ok := decompressPacket(l.Decompressor, "unixgram", packet, l.Logger)
+	if !ok {
+		return
+	}
 	lines := strings.Split(string(packet), "\n")
 	for _, line := range lines {
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "unixgram", "line", line)
 		l.LinesReceived.Inc()
+		if !allow(l.RateLimiter, source, line) {
+			continue
+		}
 		if l.Relay != nil && len(line) > 0 {
 			l.Relay.RelayLine(line)
 		}
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		l.EventHandler.Queue(withSource(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger), source))
 	}
 }
@@ -0,0 +1,844 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/statsd_exporter/pkg/acl"
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/compression"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+func newCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+}
+
+func expectEvent(t *testing.T, c <-chan event.Events, name string) {
+	t.Helper()
+	select {
+	case events := <-c:
+		if len(events) != 1 || events[0].MetricName() != name {
+			t.Fatalf("expected an event for %s, got %v", name, events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for %s received", name)
+	}
+}
+
+// start runs listen in the background. The returned function waits for it
+// to return, and fails the test if it returned an error.
+func start(t *testing.T, ctx context.Context, listen func(context.Context) error) (wait func()) {
+	errc := make(chan error, 1)
+	go func() { errc <- listen(ctx) }()
+	return func() {
+		t.Helper()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("expected listener to stop cleanly, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener did not stop")
+		}
+	}
+}
+
+func TestUDPListenerRestart(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDUDPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UDPPackets:      newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+	}
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Stopping by canceling the context keeps the connection open, so the
+	// listener can be started again.
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := start(t, ctx, l.Listen)
+	client.Write([]byte("first:1|c"))
+	expectEvent(t, c, "first")
+	cancel()
+	wait()
+
+	wait = start(t, context.Background(), l.Listen)
+	client.Write([]byte("second:1|c"))
+	expectEvent(t, c, "second")
+
+	// Closing the connection stops the listener as well.
+	conn.Close()
+	wait()
+}
+
+func TestTCPListenerRestart(t *testing.T) {
+	conn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDTCPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		TCPConnections:  newCounter(),
+		TCPErrors:       newCounter(),
+		TCPLineTooLong:  newCounter(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := start(t, ctx, l.Listen)
+	client, err := net.Dial("tcp", conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("first:1|c\n"))
+	expectEvent(t, c, "first")
+
+	// Stopping waits for the handler of the open connection.
+	cancel()
+	wait()
+	if n := testutil.ToFloat64(l.TCPErrors); n != 0 {
+		t.Fatalf("expected stopping not to count as an error, got %v errors", n)
+	}
+
+	wait = start(t, context.Background(), l.Listen)
+	client2, err := net.Dial("tcp", conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+	client2.Write([]byte("second:1|c\n"))
+	expectEvent(t, c, "second")
+
+	conn.Close()
+	wait()
+}
+
+func TestReverseDNSSourceNamer(t *testing.T) {
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	// Lookups wait until they are released.
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	n := NewReverseDNSSourceNamer(time.Minute, 2)
+	n.MaxLookups = 2
+	n.LookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		started <- addr
+		<-release
+		if addr == "10.0.0.1" {
+			return []string{"host1.example.com."}, nil
+		}
+		return []string{"host-" + addr + "."}, nil
+	}
+	expectLookups := func(addrs ...string) {
+		t.Helper()
+		// The lookups run concurrently, in any order.
+		expected := map[string]bool{}
+		for _, addr := range addrs {
+			expected[addr] = true
+		}
+		for range addrs {
+			select {
+			case a := <-started:
+				if !expected[a] {
+					t.Fatalf("expected a lookup of %v, got %s", addrs, a)
+				}
+				delete(expected, a)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected a lookup of %v", expected)
+			}
+		}
+		select {
+		case a := <-started:
+			t.Fatalf("unexpected lookup of %s", a)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	expectName := func(ip, name string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got := n.SourceName(net.ParseIP(ip))
+			if got == name {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("%s: expected %s, got %s", ip, name, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Senders are named by their IP address until the lookup is done, and
+	// concurrent lookups of an address are merged.
+	for i := 0; i < 3; i++ {
+		if name := n.SourceName(net.ParseIP("10.0.0.1")); name != "10.0.0.1" {
+			t.Fatalf("expected the IP address during the lookup, got %s", name)
+		}
+	}
+	n.SourceName(net.ParseIP("10.0.0.2"))
+	// Beyond MaxLookups, senders are looked up later.
+	n.SourceName(net.ParseIP("10.0.0.3"))
+	expectLookups("10.0.0.1", "10.0.0.2")
+	close(release)
+	expectName("10.0.0.1", "host1.example.com")
+	expectName("10.0.0.2", "host-10.0.0.2")
+	expectName("10.0.0.3", "10.0.0.3")
+	expectLookups("10.0.0.3")
+
+	// The least recently used name is evicted from the full cache, here
+	// 10.0.0.1.
+	expectName("10.0.0.3", "host-10.0.0.3")
+	expectName("10.0.0.2", "host-10.0.0.2")
+	n.SourceName(net.ParseIP("10.0.0.1"))
+	expectLookups("10.0.0.1")
+	expectName("10.0.0.1", "host1.example.com")
+
+	// Expired names are used until they are looked up again.
+	clock.ClockInstance.Instant = time.Unix(60, 0)
+	for _, expected := range []struct{ ip, name string }{{"10.0.0.1", "host1.example.com"}, {"10.0.0.2", "host-10.0.0.2"}} {
+		if name := n.SourceName(net.ParseIP(expected.ip)); name != expected.name {
+			t.Fatalf("expected the expired name %s, got %s", expected.name, name)
+		}
+	}
+	expectLookups("10.0.0.1", "10.0.0.2")
+
+	// Wait for the lookups before the clock is restored.
+	for i := 0; ; i++ {
+		n.mu.Lock()
+		pending := len(n.pending)
+		n.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("lookups did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPListenerSource(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDUDPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UDPPackets:      newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		SourceNamer:     IPSourceNamer{},
+	}
+	wait := start(t, context.Background(), l.Listen)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("foo:1|c"))
+
+	select {
+	case events := <-c:
+		if source := events[0].(event.SourceEvent).Source(); source != "127.0.0.1" {
+			t.Fatalf("expected source 127.0.0.1, got %s", source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	conn.Close()
+	wait()
+}
+
+func TestTCPListenerProxyProtocol(t *testing.T) {
+	// listen starts a listener that trusts the given network.
+	listen := func(trusted *net.IPNet, a *acl.ACL) (addr string, c chan event.Events, proxy *ProxyProtocol, stop func()) {
+		conn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c = make(chan event.Events, 10)
+		proxy = &ProxyProtocol{
+			Trusted:  []*net.IPNet{trusted},
+			Rejected: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"proto", "reason"}),
+			Logger:   log.NewNopLogger(),
+		}
+		l := &StatsDTCPListener{
+			Conn:            conn,
+			EventHandler:    &event.UnbufferedEventHandler{C: c},
+			Logger:          log.NewNopLogger(),
+			LineParser:      line.NewParser(),
+			LinesReceived:   newCounter(),
+			SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+			SamplesReceived: newCounter(),
+			TagErrors:       newCounter(),
+			TagsReceived:    newCounter(),
+			TCPConnections:  newCounter(),
+			TCPErrors:       newCounter(),
+			TCPLineTooLong:  newCounter(),
+			SourceNamer:     IPSourceNamer{},
+			ProxyProtocol:   proxy,
+			ACL:             a,
+		}
+		wait := start(t, context.Background(), l.Listen)
+		return conn.Addr().String(), c, proxy, func() {
+			conn.Close()
+			wait()
+		}
+	}
+	send := func(addr, data string) {
+		t.Helper()
+		client, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte(data))
+	}
+	waitRejected := func(proxy *ProxyProtocol, reason string) {
+		t.Helper()
+		for i := 0; testutil.ToFloat64(proxy.Rejected.WithLabelValues("tcp", reason)) != 1; i++ {
+			if i == 100 {
+				t.Fatalf("expected a connection to be rejected as %s", reason)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	addr, c, proxy, stop := listen(&net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, nil)
+	expectSource := func(source string) {
+		t.Helper()
+		select {
+		case events := <-c:
+			if s := events[0].(event.SourceEvent).Source(); s != source {
+				t.Fatalf("expected source %s, got %s", source, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	send(addr, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 9125\r\nfoo:1|c\n")
+	expectSource("192.0.2.1")
+
+	// Connections without a header are accepted from trusted peers.
+	send(addr, "foo:1|c\n")
+	expectSource("127.0.0.1")
+
+	send(addr, "PROXY TCP4 192.0.2.1\r\nfoo:1|c\n")
+	waitRejected(proxy, "invalid")
+	stop()
+	if len(c) != 0 {
+		t.Fatalf("expected no events from rejected connections, got %d", len(c))
+	}
+
+	// An untrusted peer can't claim an address the ACL allows, the ACL
+	// applies to the peer itself.
+	config, err := acl.ParseConfig("tcp: {deny: [127.0.0.0/8]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := acl.NewMetrics(nil)
+	addr, c, proxy, stop = listen(&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, acl.New(config, m))
+	send(addr, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 9125\r\nfoo:1|c\n")
+	waitRejected(proxy, "untrusted")
+	if n := testutil.ToFloat64(m.Denied.WithLabelValues("tcp")); n != 0 {
+		t.Fatalf("expected rejected headers not to reach the ACL, got %v denied", n)
+	}
+	send(addr, "foo:1|c\n")
+	for i := 0; testutil.ToFloat64(m.Denied.WithLabelValues("tcp")) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the ACL to deny the address of the peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if len(c) != 0 {
+		t.Fatalf("expected no events from untrusted peers, got %d", len(c))
+	}
+}
+
+func TestUDPListenerProxyProtocol(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	proxy := &ProxyProtocol{
+		Trusted:  []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		Rejected: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"proto", "reason"}),
+		Logger:   log.NewNopLogger(),
+	}
+	l := &StatsDUDPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UDPPackets:      newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		SourceNamer:     IPSourceNamer{},
+		ProxyProtocol:   proxy,
+	}
+	wait := start(t, context.Background(), l.Listen)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0c")
+	header = append(header, 192, 0, 2, 1, 127, 0, 0, 1, 0xdc, 0x04, 0x23, 0xa5)
+	client.Write(append(header, "foo:1|c"...))
+	client.Write([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0cfoo:1|c"))
+	client.Write([]byte("bar:1|c"))
+
+	for _, e := range []struct{ name, source string }{{"foo", "192.0.2.1"}, {"bar", "127.0.0.1"}} {
+		select {
+		case events := <-c:
+			if events[0].MetricName() != e.name {
+				t.Fatalf("expected an event for %s, got %s", e.name, events[0].MetricName())
+			}
+			if s := events[0].(event.SourceEvent).Source(); s != e.source {
+				t.Fatalf("expected source %s, got %s", e.source, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+	if n := testutil.ToFloat64(proxy.Rejected.WithLabelValues("udp", "invalid")); n != 1 {
+		t.Fatalf("expected 1 invalid packet, got %v", n)
+	}
+
+	conn.Close()
+	wait()
+}
+
+func TestTCPListenerACL(t *testing.T) {
+	config, err := acl.ParseConfig("tcp: {deny: [127.0.0.0/8]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := acl.NewMetrics(nil)
+	conn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDTCPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		TCPConnections:  newCounter(),
+		TCPErrors:       newCounter(),
+		TCPLineTooLong:  newCounter(),
+		ACL:             acl.New(config, m),
+	}
+	wait := start(t, context.Background(), l.Listen)
+	defer func() {
+		conn.Close()
+		wait()
+	}()
+	send := func() {
+		t.Helper()
+		client, err := net.Dial("tcp", conn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte("foo:1|c\n"))
+	}
+
+	send()
+	for i := 0; testutil.ToFloat64(m.Denied.WithLabelValues("tcp")) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the connection to be denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(l.TCPConnections); n != 0 {
+		t.Fatalf("expected denied connections not to be handled, got %v", n)
+	}
+
+	// A reloaded configuration applies to new connections.
+	config, err = acl.ParseConfig("tcp: {allow: [127.0.0.0/8]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ACL.SetConfig(config)
+	send()
+	expectEvent(t, c, "foo")
+}
+
+func TestReadLine(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		in       string
+		lines    []string
+		tooLong  int
+		finalErr error
+	}{
+		{name: "short lines", in: "a\nbb\r\nccc\n", lines: []string{"a", "bb", "ccc"}, finalErr: io.EOF},
+		{name: "exactly the maximum", in: "0123456789abcdef\r\nx\n", lines: []string{"0123456789abcdef", "x"}, finalErr: io.EOF},
+		{name: "too long", in: "0123456789abcdefg\nx\n", lines: []string{"x"}, tooLong: 1, finalErr: io.EOF},
+		{name: "much too long", in: strings.Repeat("y", 100) + "\nx\n" + strings.Repeat("z", 50) + "\n", lines: []string{"x"}, tooLong: 2, finalErr: io.EOF},
+		{name: "too long at the end", in: "x\n" + strings.Repeat("y", 100), lines: []string{"x"}, tooLong: 1, finalErr: io.EOF},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			go func() {
+				client.Write([]byte(s.in))
+				client.Close()
+			}()
+			defer server.Close()
+
+			r := newLineReader(server, 16)
+			var lines []string
+			tooLong := 0
+			for {
+				line, skipped, err := readLine(r, 16)
+				if skipped {
+					tooLong++
+				}
+				if err != nil {
+					if err != s.finalErr {
+						t.Fatalf("expected %v, got %v", s.finalErr, err)
+					}
+					break
+				}
+				if !skipped {
+					lines = append(lines, string(line))
+				}
+			}
+			if !reflect.DeepEqual(lines, s.lines) {
+				t.Errorf("expected lines %q, got %q", s.lines, lines)
+			}
+			if tooLong != s.tooLong {
+				t.Errorf("expected %d lines to be too long, got %d", s.tooLong, tooLong)
+			}
+		})
+	}
+}
+
+func TestTCPListenerLimits(t *testing.T) {
+	conn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDTCPListener{
+		Conn:                   conn,
+		EventHandler:           &event.UnbufferedEventHandler{C: c},
+		Logger:                 log.NewNopLogger(),
+		LineParser:             line.NewParser(),
+		LinesReceived:          newCounter(),
+		SampleErrors:           *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived:        newCounter(),
+		TagErrors:              newCounter(),
+		TagsReceived:           newCounter(),
+		TCPConnections:         newCounter(),
+		TCPErrors:              newCounter(),
+		TCPLineTooLong:         newCounter(),
+		TCPOpenConnections:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+		TCPConnectionsRejected: newCounter(),
+		TCPIdleTimeouts:        newCounter(),
+		MaxLineLength:          32,
+		MaxConnections:         1,
+		IdleTimeout:            200 * time.Millisecond,
+	}
+	wait := start(t, context.Background(), l.Listen)
+	defer func() {
+		conn.Close()
+		wait()
+	}()
+
+	client, err := net.Dial("tcp", conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// An over-long line is skipped, and the connection stays usable.
+	client.Write([]byte(strings.Repeat("x", 100) + ":1|c\nfoo:1|c\n"))
+	expectEvent(t, c, "foo")
+	if n := testutil.ToFloat64(l.TCPLineTooLong); n != 1 {
+		t.Fatalf("expected 1 line to be too long, got %v", n)
+	}
+	if n := testutil.ToFloat64(l.TCPOpenConnections); n != 1 {
+		t.Fatalf("expected 1 open connection, got %v", n)
+	}
+
+	// A second connection exceeds the limit, and is closed.
+	rejected, err := net.Dial("tcp", conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if n := testutil.ToFloat64(l.TCPConnectionsRejected); n != 1 {
+		t.Fatalf("expected 1 rejected connection, got %v", n)
+	}
+
+	// The first connection is closed once it has been idle.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	for i := 0; testutil.ToFloat64(l.TCPOpenConnections) != 0; i++ {
+		if i == 100 {
+			t.Fatal("expected no open connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(l.TCPIdleTimeouts); n != 1 {
+		t.Fatalf("expected 1 idle timeout, got %v", n)
+	}
+	if n := testutil.ToFloat64(l.TCPErrors); n != 0 {
+		t.Fatalf("expected the idle timeout not to count as an error, got %v", n)
+	}
+}
+
+func TestTCPListenerIdleBeforeProxyHeader(t *testing.T) {
+	conn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan event.Events, 10)
+	l := &StatsDTCPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		TCPConnections:  newCounter(),
+		TCPErrors:       newCounter(),
+		TCPLineTooLong:  newCounter(),
+		TCPIdleTimeouts: newCounter(),
+		MaxConnections:  1,
+		IdleTimeout:     200 * time.Millisecond,
+		ProxyProtocol: &ProxyProtocol{
+			Trusted:  []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+			Rejected: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"proto", "reason"}),
+			Logger:   log.NewNopLogger(),
+		},
+	}
+	wait := start(t, context.Background(), l.Listen)
+	defer func() {
+		conn.Close()
+		wait()
+	}()
+
+	// A client that never sends a header takes the only connection, until
+	// it is closed for being idle.
+	silent, err := net.Dial("tcp", conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if n := testutil.ToFloat64(l.TCPIdleTimeouts); n != 1 {
+		t.Fatalf("expected 1 idle timeout, got %v", n)
+	}
+
+	// The connection is free for the next client.
+	for i := 0; ; i++ {
+		client, err := net.Dial("tcp", conn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 9125\r\nfoo:1|c\n"))
+		client.Close()
+		select {
+		case <-c:
+		case <-time.After(100 * time.Millisecond):
+			if i == 50 {
+				t.Fatal("expected the connection to be accepted after the idle one was closed")
+			}
+			continue
+		}
+		break
+	}
+}
+
+func TestListenersCompression(t *testing.T) {
+	compress := func(s string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(s))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	m := compression.NewMetrics(nil)
+	d := compression.New(1000, 10, m)
+	c := make(chan event.Events, 10)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul := &StatsDUDPListener{
+		Conn:            udpConn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UDPPackets:      newCounter(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		Decompressor:    d,
+	}
+	waitUDP := start(t, context.Background(), ul.Listen)
+	defer func() {
+		udpConn.Close()
+		waitUDP()
+	}()
+
+	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &StatsDTCPListener{
+		Conn:            tcpConn,
+		EventHandler:    &event.UnbufferedEventHandler{C: c},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   newCounter(),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"reason"}),
+		SamplesReceived: newCounter(),
+		TagErrors:       newCounter(),
+		TagsReceived:    newCounter(),
+		TCPConnections:  newCounter(),
+		TCPErrors:       newCounter(),
+		TCPLineTooLong:  newCounter(),
+		Decompressor:    d,
+	}
+	waitTCP := start(t, context.Background(), tl.Listen)
+	defer func() {
+		tcpConn.Close()
+		waitTCP()
+	}()
+
+	for _, addr := range []net.Addr{udpConn.LocalAddr(), tcpConn.Addr()} {
+		client, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		payload := "foo:1|c"
+		if addr.Network() == "tcp" {
+			payload += "\n"
+		}
+		client.Write(compress(payload))
+		expectEvent(t, c, "foo")
+	}
+
+	// A plain stream works alongside compressed ones.
+	client, err := net.Dial("tcp", tcpConn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("bar:1|c\n"))
+	expectEvent(t, c, "bar")
+
+	// An invalid stream is closed, and not counted as a read error.
+	invalid, err := net.Dial("tcp", tcpConn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer invalid.Close()
+	invalid.Write(append(compress("foo:1|c\n")[:10], 0xff, 0xff, 0xff, 0xff))
+	invalid.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := invalid.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if n := testutil.ToFloat64(m.Errors.WithLabelValues("tcp", compression.ReasonInvalid)); n != 1 {
+		t.Fatalf("expected 1 invalid stream, got %v", n)
+	}
+	if n := testutil.ToFloat64(tl.TCPErrors); n != 0 {
+		t.Fatalf("expected no read errors, got %v", n)
+	}
+}
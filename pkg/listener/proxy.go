@@ -0,0 +1,104 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/proxyproto"
+)
+
+// ProxyProtocol makes a listener accept PROXY protocol headers from
+// proxies and load balancers, which carry the address of the client. The
+// client address is then used in place of the address of the proxy. Data
+// without a header is accepted as well, from any address.
+type ProxyProtocol struct {
+	// Trusted are the networks of the proxies. Headers from other
+	// addresses are rejected, so that only the proxies can claim to send on
+	// behalf of another address. If empty, no address is trusted.
+	Trusted []*net.IPNet
+	// Rejected counts the rejected connections and packets, by proto and
+	// reason.
+	Rejected *prometheus.CounterVec
+	Logger   log.Logger
+}
+
+func (p *ProxyProtocol) trusts(ip net.IP) bool {
+	for _, n := range p.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProxyProtocol) reject(proto, reason string, peer net.IP, err error) {
+	p.Rejected.WithLabelValues(proto, reason).Inc()
+	level.Debug(p.Logger).Log("msg", "Rejected PROXY protocol peer", "proto", proto, "reason", reason, "peer", peer, "error", err)
+}
+
+// readHeader reads the header of a stream from peer, and returns the
+// address of the client. It returns false if the stream is rejected, or
+// ends before a complete header was read. The read error is returned in the
+// latter case.
+func (p *ProxyProtocol) readHeader(peer net.IP, r *bufio.Reader) (net.IP, bool, error) {
+	h, err := proxyproto.ReadHeader(r)
+	var netErr net.Error
+	switch {
+	case errors.Is(err, proxyproto.ErrNoHeader):
+		return peer, true, nil
+	case err == io.EOF || errors.As(err, &netErr) || errors.Is(err, net.ErrClosed):
+		// Connections that are closed or time out before sending a
+		// complete header are not rejected, they just end.
+		return nil, false, err
+	case !p.trusts(peer):
+		p.reject("tcp", "untrusted", peer, err)
+		return nil, false, nil
+	case err != nil:
+		p.reject("tcp", "invalid", peer, err)
+		return nil, false, nil
+	case h.SourceIP == nil:
+		return peer, true, nil
+	default:
+		return h.SourceIP, true, nil
+	}
+}
+
+// unwrapDatagram strips the header from a datagram from peer, and returns
+// the rest along with the address of the client. It returns false if the
+// datagram is rejected.
+func (p *ProxyProtocol) unwrapDatagram(peer net.IP, packet []byte) ([]byte, net.IP, bool) {
+	h, rest, err := proxyproto.ParseDatagram(packet)
+	switch {
+	case errors.Is(err, proxyproto.ErrNoHeader):
+		return packet, peer, true
+	case !p.trusts(peer):
+		p.reject("udp", "untrusted", peer, err)
+		return nil, nil, false
+	case err != nil:
+		p.reject("udp", "invalid", peer, err)
+		return nil, nil, false
+	case h.SourceIP == nil:
+		return rest, peer, true
+	default:
+		return rest, h.SourceIP, true
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/ratelimit"
+)
+
+// SourceNamer names the senders of StatsD lines, for the source label of
+// their events.
+type SourceNamer interface {
+	SourceName(ip net.IP) string
+}
+
+// IPSourceNamer names senders by their IP address.
+type IPSourceNamer struct{}
+
+func (IPSourceNamer) SourceName(ip net.IP) string {
+	return ip.String()
+}
+
+// ReverseDNSSourceNamer names senders by their host name. Host names are
+// looked up once per TTL, in the background, so that the listeners never
+// wait for a lookup. Senders are named by their IP address until their host
+// name is known, and if they have none.
+type ReverseDNSSourceNamer struct {
+	// LookupAddr returns the host names of an address. It defaults to the
+	// lookup of net.DefaultResolver, and can be replaced in tests.
+	LookupAddr func(ctx context.Context, addr string) ([]string, error)
+	// Timeout limits how long a lookup may take.
+	Timeout time.Duration
+	// TTL is how long a name is cached. Expired names are used until they
+	// are looked up again.
+	TTL time.Duration
+	// Size is the maximum number of cached names. The least recently used
+	// name is evicted when the cache is full.
+	Size int
+	// MaxLookups is the maximum number of lookups at a time. Senders that
+	// come along while that many are running are looked up later.
+	MaxLookups int
+
+	mu sync.Mutex
+	// cache holds the elements of lru by address.
+	cache map[string]*list.Element
+	// lru holds the cached names, the most recently used first.
+	lru *list.List
+	// pending are the addresses that are being looked up.
+	pending map[string]bool
+}
+
+type cachedName struct {
+	addr    string
+	name    string
+	expires time.Time
+}
+
+// NewReverseDNSSourceNamer returns a ReverseDNSSourceNamer with the given
+// TTL, that caches up to size names.
+func NewReverseDNSSourceNamer(ttl time.Duration, size int) *ReverseDNSSourceNamer {
+	return &ReverseDNSSourceNamer{
+		LookupAddr: net.DefaultResolver.LookupAddr,
+		Timeout:    time.Second,
+		TTL:        ttl,
+		Size:       size,
+		MaxLookups: 16,
+	}
+}
+
+func (n *ReverseDNSSourceNamer) SourceName(ip net.IP) string {
+	addr := ip.String()
+	now := clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := addr
+	if e, ok := n.cache[addr]; ok {
+		n.lru.MoveToFront(e)
+		c := e.Value.(*cachedName)
+		if now.Before(c.expires) {
+			return c.name
+		}
+		name = c.name
+	}
+	n.lookup(addr)
+	return name
+}
+
+// lookup starts looking up the host name of addr, unless it is already
+// being looked up or MaxLookups are running. The caller must hold mu.
+func (n *ReverseDNSSourceNamer) lookup(addr string) {
+	if n.pending[addr] || len(n.pending) >= n.MaxLookups {
+		return
+	}
+	if n.pending == nil {
+		n.pending = map[string]bool{}
+	}
+	n.pending[addr] = true
+
+	go func() {
+		name := addr
+		ctx, cancel := context.WithTimeout(context.Background(), n.Timeout)
+		names, err := n.LookupAddr(ctx, addr)
+		cancel()
+		if err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.pending, addr)
+		n.store(addr, name, clock.Now())
+	}()
+}
+
+// store caches the name of addr, and evicts the least recently used names
+// beyond Size. The caller must hold mu.
+func (n *ReverseDNSSourceNamer) store(addr, name string, now time.Time) {
+	c := &cachedName{addr: addr, name: name, expires: now.Add(n.TTL)}
+	if e, ok := n.cache[addr]; ok {
+		e.Value = c
+		n.lru.MoveToFront(e)
+		return
+	}
+	if n.cache == nil {
+		n.cache = map[string]*list.Element{}
+		n.lru = list.New()
+	}
+	n.cache[addr] = n.lru.PushFront(c)
+	for n.lru.Len() > n.Size {
+		e := n.lru.Back()
+		n.lru.Remove(e)
+		delete(n.cache, e.Value.(*cachedName).addr)
+	}
+}
+
+// packetSource is the sender of a packet or connection.
+type packetSource struct {
+	// key identifies the sender for rate limiting.
+	key string
+	// name is the source of the events, see event.SourceEvent.
+	name string
+}
+
+// ipSource returns the source for an IP address. It only names the sender
+// if needed.
+func ipSource(ip net.IP, limiter *ratelimit.Limiter, namer SourceNamer) packetSource {
+	var s packetSource
+	if limiter != nil {
+		s.key = ip.String()
+	}
+	if namer != nil {
+		s.name = namer.SourceName(ip)
+	}
+	return s
+}
+
+// credentialsSource returns the source for the sender of a Unixgram
+// datagram or Unix connection, identified by its user ID. ok is false if
+// the user ID is unknown.
+func credentialsSource(uid uint32, ok bool, limiter *ratelimit.Limiter, namer SourceNamer) packetSource {
+	var s packetSource
+	if !ok || (limiter == nil && namer == nil) {
+		return s
+	}
+	s.key = "uid:" + strconv.FormatUint(uint64(uid), 10)
+	if namer != nil {
+		s.name = s.key
+	}
+	return s
+}
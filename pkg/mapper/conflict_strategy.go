@@ -0,0 +1,55 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import "fmt"
+
+// ConflictStrategy determines what happens to an event whose metric name is
+// already in use by a metric of a different type.
+type ConflictStrategy string
+
+const (
+	// ConflictStrategyDrop discards the event.
+	ConflictStrategyDrop ConflictStrategy = "drop"
+	// ConflictStrategySuffix appends the type to the metric name.
+	ConflictStrategySuffix ConflictStrategy = "suffix"
+	// ConflictStrategyLabel records the event in the existing metric with a
+	// statsd_type label if that is lossless, and falls back to suffix
+	// otherwise.
+	ConflictStrategyLabel ConflictStrategy = "label"
+	// ConflictStrategyReplace evicts the existing metric.
+	ConflictStrategyReplace ConflictStrategy = "replace"
+	ConflictStrategyDefault ConflictStrategy = ""
+)
+
+func (s *ConflictStrategy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch ConflictStrategy(v) {
+	case ConflictStrategyDrop, ConflictStrategyDefault:
+		*s = ConflictStrategyDrop
+	case ConflictStrategySuffix:
+		*s = ConflictStrategySuffix
+	case ConflictStrategyLabel:
+		*s = ConflictStrategyLabel
+	case ConflictStrategyReplace:
+		*s = ConflictStrategyReplace
+	default:
+		return fmt.Errorf("invalid conflict strategy %q", v)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultCounterInterval is the window of the per_interval counter mode if
+// the mapping does not set one. It matches the default StatsD flush interval.
+const DefaultCounterInterval = 10 * time.Second
+
+// MinCounterInterval is the shortest interval of the per_interval counter
+// mode. The exporter publishes completed intervals once a second, so the
+// rate of a shorter interval would mostly be published as 0.
+const MinCounterInterval = time.Second
+
+// CounterMode determines how StatsD counters are exposed.
+type CounterMode string
+
+const (
+	// CounterModeMonotonic exposes a Prometheus counter. Negative values are
+	// rejected.
+	CounterModeMonotonic CounterMode = "monotonic"
+	// CounterModeDeltaGauge exposes a gauge that accumulates all values,
+	// including negative ones.
+	CounterModeDeltaGauge CounterMode = "delta_gauge"
+	// CounterModePerInterval exposes a gauge with the per-second rate of the
+	// values received in the last complete interval.
+	CounterModePerInterval CounterMode = "per_interval"
+	CounterModeDefault     CounterMode = ""
+)
+
+func (c *CounterMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch CounterMode(v) {
+	case CounterModeMonotonic, CounterModeDefault:
+		*c = CounterModeMonotonic
+	case CounterModeDeltaGauge:
+		*c = CounterModeDeltaGauge
+	case CounterModePerInterval:
+		*c = CounterModePerInterval
+	default:
+		return fmt.Errorf("invalid counter mode %q", v)
+	}
+	return nil
+}
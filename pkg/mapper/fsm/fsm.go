@@ -129,6 +129,18 @@ func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransiti
 // If it finds a match, the final state and the captured strings are returned;
 // if there's no match found, nil and a empty list will be returned.
 func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mappingState, []string) {
+	finalState, captures, _ := f.getMapping(statsdMetric, statsdMetricType, false)
+	return finalState, captures
+}
+
+// GetMappingWithPath is like GetMapping, but also returns the transitions
+// that led to the final state, starting with the metric type. Wildcard
+// transitions are "*". The path is nil if there's no match.
+func (f *FSM) GetMappingWithPath(statsdMetric string, statsdMetricType string) (*mappingState, []string, []string) {
+	return f.getMapping(statsdMetric, statsdMetricType, true)
+}
+
+func (f *FSM) getMapping(statsdMetric string, statsdMetricType string, withPath bool) (*mappingState, []string, []string) {
 	matchFields := strings.Split(statsdMetric, ".")
 	currentState := f.root.transitions[statsdMetricType]
 
@@ -141,6 +153,11 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 
 	captures := make([]string, len(matchFields))
 	finalCaptures := make([]string, len(matchFields))
+	// the transition taken for each field, only kept if withPath is set
+	var path, finalPath []string
+	if withPath {
+		path = make([]string, len(matchFields))
+	}
 	// keep track of captured group so we don't need to do append() on captures
 	captureIdx := 0
 	filedsCount := len(matchFields)
@@ -154,6 +171,7 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 			if !resumeFromBacktrack {
 				if len(currentState.transitions) > 0 {
 					field := matchFields[i]
+					transition := field
 					state, present = currentState.transitions[field]
 					fieldsLeft := filedsCount - i - 1
 					// also compare length upfront to avoid unnecessary loop or backtrack
@@ -164,6 +182,7 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 						} else {
 							captures[captureIdx] = field
 							captureIdx++
+							transition = "*"
 						}
 					} else if f.BacktrackingNeeded {
 						// if backtracking is needed, also check for alternative transition, i.e. *
@@ -182,6 +201,9 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 							backtrackCursor = &newCursor
 						}
 					}
+					if path != nil {
+						path[i] = transition
+					}
 				} else {
 					// no more transitions for this state
 					break
@@ -190,9 +212,12 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 
 			// do we reach a final state?
 			if state.Result != nil && i == filedsCount-1 {
+				if path != nil && (f.OrderingDisabled || finalState == nil || finalState.ResultPriority > state.ResultPriority) {
+					finalPath = append([]string{statsdMetricType}, path[:i+1]...)
+				}
 				if f.OrderingDisabled {
 					finalState = state
-					return finalState, captures
+					return finalState, captures, finalPath
 				} else if finalState == nil || finalState.ResultPriority > state.ResultPriority {
 					// if we care about ordering, try to find a result with highest prioity
 					finalState = state
@@ -221,6 +246,9 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 			captureIdx = backtrackCursor.captureIndex + 1
 			// put the * capture back
 			captures[captureIdx-1] = backtrackCursor.currentCapture
+			if path != nil {
+				path[i] = "*"
+			}
 			backtrackCursor = backtrackCursor.prev
 			if backtrackCursor != nil {
 				// deref for GC
@@ -229,7 +257,7 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 			resumeFromBacktrack = true
 		}
 	}
-	return finalState, finalCaptures
+	return finalState, finalCaptures, finalPath
 }
 
 // TestIfNeedBacktracking tests if backtrack is needed for given list of mappings
@@ -0,0 +1,59 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultGaugeAggregationWindow is the window of a gauge aggregation if the
+// mapping does not set one.
+const DefaultGaugeAggregationWindow = 10 * time.Second
+
+// MinGaugeAggregationWindow is the shortest window of a gauge aggregation.
+// The exporter publishes completed windows once a second, so shorter
+// windows would be merged.
+const MinGaugeAggregationWindow = time.Second
+
+// GaugeAggregation determines how the values of a gauge received within a
+// window are combined.
+type GaugeAggregation string
+
+const (
+	GaugeAggregationLast    GaugeAggregation = "last"
+	GaugeAggregationMin     GaugeAggregation = "min"
+	GaugeAggregationMax     GaugeAggregation = "max"
+	GaugeAggregationSum     GaugeAggregation = "sum"
+	GaugeAggregationAvg     GaugeAggregation = "avg"
+	GaugeAggregationCount   GaugeAggregation = "count"
+	GaugeAggregationDefault GaugeAggregation = ""
+)
+
+func (g *GaugeAggregation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch GaugeAggregation(v) {
+	case GaugeAggregationLast, GaugeAggregationMin, GaugeAggregationMax,
+		GaugeAggregationSum, GaugeAggregationAvg, GaugeAggregationCount,
+		GaugeAggregationDefault:
+		*g = GaugeAggregation(v)
+	default:
+		return fmt.Errorf("invalid gauge aggregation %q", v)
+	}
+	return nil
+}
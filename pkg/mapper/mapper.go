@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -97,6 +98,14 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string) error {
 		n.Defaults.MatchType = MatchTypeGlob
 	}
 
+	n.Defaults.StatsdAggregatesOptions = n.Defaults.StatsdAggregatesOptions.withDefaults()
+	if err := n.Defaults.StatsdAggregatesOptions.validate(); err != nil {
+		return fmt.Errorf("%v in defaults", err)
+	}
+	if n.Defaults.SourceLabel != "" && !labelNameRE.MatchString(n.Defaults.SourceLabel) {
+		return fmt.Errorf("invalid source_label %q in defaults", n.Defaults.SourceLabel)
+	}
+
 	remainingMappingsCount := len(n.Mappings)
 
 	n.FSM = fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeObserver)},
@@ -106,6 +115,7 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string) error {
 		remainingMappingsCount--
 
 		currentMapping := &n.Mappings[i]
+		currentMapping.index = i
 
 		// check that label is correct
 		for k := range currentMapping.Labels {
@@ -225,9 +235,58 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string) error {
 			}
 		}
 
+		if currentMapping.ObserverType == ObserverTypeStatsdAggregates {
+			if currentMapping.SummaryOptions != nil || currentMapping.HistogramOptions != nil {
+				return fmt.Errorf("cannot use statsd_aggregates observer and summary or histogram options at the same time")
+			}
+			if currentMapping.StatsdAggregatesOptions == nil {
+				currentMapping.StatsdAggregatesOptions = &StatsdAggregatesOptions{}
+			}
+			if len(currentMapping.StatsdAggregatesOptions.Percentiles) == 0 {
+				currentMapping.StatsdAggregatesOptions.Percentiles = n.Defaults.StatsdAggregatesOptions.Percentiles
+			}
+			if currentMapping.StatsdAggregatesOptions.FlushInterval == 0 {
+				currentMapping.StatsdAggregatesOptions.FlushInterval = n.Defaults.StatsdAggregatesOptions.FlushInterval
+			}
+			if err := currentMapping.StatsdAggregatesOptions.validate(); err != nil {
+				return fmt.Errorf("%v in %s", err, currentMapping.Match)
+			}
+		}
+
 		if currentMapping.Ttl == 0 && n.Defaults.Ttl > 0 {
 			currentMapping.Ttl = n.Defaults.Ttl
 		}
+
+		if currentMapping.ConflictStrategy == ConflictStrategyDefault {
+			currentMapping.ConflictStrategy = n.Defaults.ConflictStrategy
+		}
+
+		if currentMapping.SourceLabel == "" {
+			currentMapping.SourceLabel = n.Defaults.SourceLabel
+		}
+		if currentMapping.SourceLabel != "" && !labelNameRE.MatchString(currentMapping.SourceLabel) {
+			return fmt.Errorf("invalid source_label %q in %s", currentMapping.SourceLabel, currentMapping.Match)
+		}
+
+		if currentMapping.CounterInterval < 0 {
+			return fmt.Errorf("counter_interval must not be negative in %s", currentMapping.Match)
+		}
+		if currentMapping.CounterMode == CounterModePerInterval && currentMapping.CounterInterval == 0 {
+			currentMapping.CounterInterval = DefaultCounterInterval
+		}
+		if currentMapping.CounterMode == CounterModePerInterval && currentMapping.CounterInterval < MinCounterInterval {
+			return fmt.Errorf("counter_interval must be at least %s in %s", MinCounterInterval, currentMapping.Match)
+		}
+
+		if currentMapping.GaugeAggregationWindow < 0 {
+			return fmt.Errorf("gauge_aggregation_window must not be negative in %s", currentMapping.Match)
+		}
+		if currentMapping.GaugeAggregation != GaugeAggregationDefault && currentMapping.GaugeAggregationWindow == 0 {
+			currentMapping.GaugeAggregationWindow = DefaultGaugeAggregationWindow
+		}
+		if currentMapping.GaugeAggregation != GaugeAggregationDefault && currentMapping.GaugeAggregationWindow < MinGaugeAggregationWindow {
+			return fmt.Errorf("gauge_aggregation_window must be at least %s in %s", MinGaugeAggregationWindow, currentMapping.Match)
+		}
 	}
 
 	m.mutex.Lock()
@@ -296,11 +355,69 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 		}
 	}
 
+	r, _, _ := m.match(statsdMetric, statsdMetricType, false)
+
+	// add match or miss to cache
+	if m.cache != nil {
+		m.cache.Add(formatKey(statsdMetric, statsdMetricType), r)
+	}
+
+	return r.Mapping, r.Labels, r.Matched
+}
+
+// MappingExplanation describes how a StatsD metric is matched against the
+// configured mappings.
+type MappingExplanation struct {
+	MetricMapperCacheResult
+	// Cached is true if GetMapping would currently answer from the cache.
+	Cached bool
+	// Index is the position of the matched mapping in Mappings, or -1.
+	Index int
+	// Captures holds the strings captured by glob wildcards or regex groups.
+	Captures []string
+	// FSMPath lists the transitions the glob FSM took to the matched
+	// mapping, starting with the metric type. Wildcard transitions are "*".
+	// It is empty unless a glob mapping matched.
+	FSMPath []string
+}
+
+// ExplainMapping matches a StatsD metric like GetMapping, but returns details
+// about the match. It bypasses the cache and does not add the result to it.
+func (m *MetricMapper) ExplainMapping(statsdMetric string, statsdMetricType MetricType) MappingExplanation {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	e := MappingExplanation{Index: -1}
+	if m.cache != nil {
+		_, e.Cached = m.cache.Get(formatKey(statsdMetric, statsdMetricType))
+	}
+
+	e.MetricMapperCacheResult, e.Captures, e.FSMPath = m.match(statsdMetric, statsdMetricType, true)
+	if e.Matched {
+		e.Index = e.Mapping.index
+	}
+	return e
+}
+
+// match finds the mapping for a StatsD metric. The captures and the path
+// through the glob FSM are only returned if explain is set. The caller must
+// hold the read lock.
+func (m *MetricMapper) match(statsdMetric string, statsdMetricType MetricType, explain bool) (MetricMapperCacheResult, []string, []string) {
 	// glob matching
 	if m.doFSM {
-		finalState, captures := m.FSM.GetMapping(statsdMetric, string(statsdMetricType))
-		if finalState != nil && finalState.Result != nil {
-			v := finalState.Result.(*MetricMapping)
+		var (
+			found             interface{}
+			captures, fsmPath []string
+		)
+		if explain {
+			if finalState, c, p := m.FSM.GetMappingWithPath(statsdMetric, string(statsdMetricType)); finalState != nil {
+				found, captures, fsmPath = finalState.Result, c, p
+			}
+		} else if finalState, c := m.FSM.GetMapping(statsdMetric, string(statsdMetricType)); finalState != nil {
+			found, captures = finalState.Result, c
+		}
+		if found != nil {
+			v := found.(*MetricMapping)
 			result := copyMetricMapping(v)
 			result.Name = result.nameFormatter.Format(captures)
 
@@ -314,19 +431,13 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 				Matched: true,
 				Labels:  labels,
 			}
-			// add match to cache
-			if m.cache != nil {
-				m.cache.Add(formatKey(statsdMetric, statsdMetricType), r)
+			if explain {
+				return r, captures[:strings.Count(result.Match, "*")], fsmPath
 			}
-
-			return result, labels, true
+			return r, nil, nil
 		} else if !m.doRegex {
 			// if there's no regex match type, return immediately
-			// Add miss to cache
-			if m.cache != nil {
-				m.cache.Add(formatKey(statsdMetric, statsdMetricType), MetricMapperCacheResult{})
-			}
-			return nil, nil, false
+			return MetricMapperCacheResult{}, nil, nil
 		}
 	}
 
@@ -363,19 +474,21 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 			Matched: true,
 			Labels:  labels,
 		}
-		// Add Match to cache
-		if m.cache != nil {
-			m.cache.Add(formatKey(statsdMetric, statsdMetricType), r)
+		if explain {
+			var captures []string
+			for i := 2; i+1 < len(matches); i += 2 {
+				if matches[i] < 0 {
+					captures = append(captures, "")
+					continue
+				}
+				captures = append(captures, statsdMetric[matches[i]:matches[i+1]])
+			}
+			return r, captures, nil
 		}
-
-		return &mapping, labels, true
+		return r, nil, nil
 	}
 
-	// Add Miss to cache
-	if m.cache != nil {
-		m.cache.Add(formatKey(statsdMetric, statsdMetricType), MetricMapperCacheResult{})
-	}
-	return nil, nil, false
+	return MetricMapperCacheResult{}, nil, nil
 }
 
 // make a shallow copy so that we do not overwrite name
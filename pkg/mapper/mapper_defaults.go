@@ -22,6 +22,10 @@ type mapperConfigDefaults struct {
 	Ttl                 time.Duration    `yaml:"ttl"`
 	SummaryOptions      SummaryOptions   `yaml:"summary_options"`
 	HistogramOptions    HistogramOptions `yaml:"histogram_options"`
+	ConflictStrategy    ConflictStrategy `yaml:"conflict_strategy"`
+
+	StatsdAggregatesOptions StatsdAggregatesOptions `yaml:"statsd_aggregates_options"`
+	SourceLabel             string                  `yaml:"source_label"`
 }
 
 // mapperConfigDefaultsAlias is used to unmarshal the yaml config into mapperConfigDefaults and allows deprecated fields
@@ -35,6 +39,10 @@ type mapperConfigDefaultsAlias struct {
 	Ttl                 time.Duration     `yaml:"ttl"`
 	SummaryOptions      SummaryOptions    `yaml:"summary_options"`
 	HistogramOptions    HistogramOptions  `yaml:"histogram_options"`
+	ConflictStrategy    ConflictStrategy  `yaml:"conflict_strategy"`
+
+	StatsdAggregatesOptions StatsdAggregatesOptions `yaml:"statsd_aggregates_options"`
+	SourceLabel             string                  `yaml:"source_label"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
@@ -52,6 +60,9 @@ func (d *mapperConfigDefaults) UnmarshalYAML(unmarshal func(interface{}) error)
 	d.Ttl = tmp.Ttl
 	d.SummaryOptions = tmp.SummaryOptions
 	d.HistogramOptions = tmp.HistogramOptions
+	d.ConflictStrategy = tmp.ConflictStrategy
+	d.StatsdAggregatesOptions = tmp.StatsdAggregatesOptions
+	d.SourceLabel = tmp.SourceLabel
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
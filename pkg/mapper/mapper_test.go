@@ -14,9 +14,11 @@
 package mapper
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/statsd_exporter/pkg/mappercache/lru"
@@ -35,6 +37,8 @@ type mappings []struct {
 	ageBuckets   uint32
 	bufCap       uint32
 	buckets      []float64
+
+	conflictStrategy ConflictStrategy
 }
 
 func newTestMapperWithCache(cacheType string, size int) *MetricMapper {
@@ -488,6 +492,27 @@ mappings:
 - match: test.*.*
   name: "0foo"
   labels: {}
+  `,
+			configBad: true,
+		},
+		{
+			testName: "Config with bad source label",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "foo"
+  source_label: "source-host"
+  `,
+			configBad: true,
+		},
+		{
+			testName: "Config with bad default source label",
+			config: `---
+defaults:
+  source_label: "0source"
+mappings:
+- match: test.*.*
+  name: "foo"
   `,
 			configBad: true,
 		},
@@ -1480,6 +1505,197 @@ mappings:
 				},
 			},
 		},
+		{
+			testName: "Config with a valid value conversion",
+			config: `---
+mappings:
+- match: test.*
+  name: "test_seconds"
+  value_conversion: us_to_s
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.a",
+					name:         "test_seconds",
+				},
+			},
+		},
+		{
+			testName: "Config with an unknown value conversion unit",
+			config: `---
+mappings:
+- match: test.*
+  name: "test_seconds"
+  value_conversion: fortnights_to_s
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a value conversion between dimensions",
+			config: `---
+mappings:
+- match: test.*
+  name: "test_seconds"
+  value_conversion: ms_to_mb
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with conflict strategies",
+			config: `---
+defaults:
+  conflict_strategy: suffix
+mappings:
+- match: test.a
+  name: "test_a"
+- match: test.b
+  name: "test_b"
+  conflict_strategy: replace
+`,
+			mappings: mappings{
+				{
+					statsdMetric:     "test.a",
+					name:             "test_a",
+					conflictStrategy: ConflictStrategySuffix,
+				},
+				{
+					statsdMetric:     "test.b",
+					name:             "test_b",
+					conflictStrategy: ConflictStrategyReplace,
+				},
+			},
+		},
+		{
+			testName: "Config with an invalid conflict strategy",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  conflict_strategy: merge
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with an invalid counter mode",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  counter_mode: reset
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a negative counter interval",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  counter_mode: per_interval
+  counter_interval: -10s
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a counter interval shorter than a second",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  counter_mode: per_interval
+  counter_interval: 500ms
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with an invalid gauge aggregation",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  gauge_aggregation: median
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a gauge aggregation window shorter than a second",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  gauge_aggregation: avg
+  gauge_aggregation_window: 500ms
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with statsd_aggregates options",
+			config: `---
+defaults:
+  statsd_aggregates_options:
+    percentiles: [95]
+mappings:
+- match: test.*
+  name: "test"
+  observer_type: statsd_aggregates
+  statsd_aggregates_options:
+    flush_interval: 1m
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.a",
+					name:         "test",
+				},
+			},
+		},
+		{
+			testName: "Config with an invalid statsd_aggregates percentile",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  observer_type: statsd_aggregates
+  statsd_aggregates_options:
+    percentiles: [150]
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a statsd_aggregates flush interval shorter than a second",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  observer_type: statsd_aggregates
+  statsd_aggregates_options:
+    flush_interval: 500ms
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with a default statsd_aggregates flush interval shorter than a second",
+			config: `---
+defaults:
+  statsd_aggregates_options:
+    flush_interval: 500ms
+mappings:
+- match: test.*
+  name: "test"
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with statsd_aggregates and histogram options",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  observer_type: statsd_aggregates
+  histogram_options:
+    buckets: [1, 2]
+`,
+			configBad: true,
+		},
 	}
 
 	mapper := MetricMapper{}
@@ -1524,6 +1740,9 @@ mappings:
 				if mapping.ttl > 0 && mapping.ttl != m.Ttl {
 					t.Fatalf("%d.%q: Expected ttl of %s, got %s", i, metric, mapping.ttl.String(), m.Ttl.String())
 				}
+				if mapping.conflictStrategy != "" && mapping.conflictStrategy != m.ConflictStrategy {
+					t.Fatalf("%d.%q: Expected conflict strategy %q, got %q", i, metric, mapping.conflictStrategy, m.ConflictStrategy)
+				}
 				if mapping.metricType != "" && mapType != m.MatchMetricType {
 					t.Fatalf("%d.%q: Expected match metric of %s, got %s", i, metric, mapType, m.MatchMetricType)
 				}
@@ -1708,3 +1927,105 @@ mappings:
 		}
 	}
 }
+
+func TestExplainMapping(t *testing.T) {
+	config := `---
+mappings:
+- match: test.dispatcher.*.*.*
+  name: "dispatcher_events_total"
+  labels:
+    processor: "$1"
+    action: "$2"
+    outcome: "$3"
+- match: 'request_(\w+)_(\d+)'
+  match_type: regex
+  name: "request_total"
+  labels:
+    method: "$1"
+    code: "$2"
+- match: test.other.*.fail
+  name: "other_failures_total"
+- match: test.*.send.ok
+  name: "sent_total"
+`
+	scenarios := []struct {
+		name     string
+		metric   string
+		matched  bool
+		index    int
+		captures []string
+		fsmPath  []string
+		labels   map[string]string
+	}{
+		{
+			name:     "glob",
+			metric:   "test.dispatcher.FooProcessor.send.success",
+			matched:  true,
+			index:    0,
+			captures: []string{"FooProcessor", "send", "success"},
+			fsmPath:  []string{"counter", "test", "dispatcher", "*", "*", "*"},
+			labels:   map[string]string{"processor": "FooProcessor", "action": "send", "outcome": "success"},
+		},
+		{
+			// The FSM follows "other" first, and has to backtrack to the
+			// wildcard.
+			name:     "glob with backtracking",
+			metric:   "test.other.send.ok",
+			matched:  true,
+			index:    3,
+			captures: []string{"other"},
+			fsmPath:  []string{"counter", "test", "*", "send", "ok"},
+			labels:   map[string]string{},
+		},
+		{
+			name:     "regex",
+			metric:   "request_get_200",
+			matched:  true,
+			index:    1,
+			captures: []string{"get", "200"},
+			labels:   map[string]string{"method": "get", "code": "200"},
+		},
+		{
+			name:   "unmatched",
+			metric: "test.unmatched",
+			index:  -1,
+		},
+	}
+
+	mapper := newTestMapperWithCache("lru", 1000)
+	// The mappings need backtracking, which is logged.
+	mapper.Logger = log.NewNopLogger()
+	if err := mapper.InitFromYAMLString(config); err != nil {
+		t.Fatalf("config load error: %s ", err)
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			e := mapper.ExplainMapping(s.metric, MetricTypeCounter)
+			if e.Matched != s.matched {
+				t.Fatalf("expected matched %v, got %v", s.matched, e.Matched)
+			}
+			if e.Cached {
+				t.Fatalf("expected result not to be cached")
+			}
+			if e.Index != s.index {
+				t.Fatalf("expected index %d, got %d", s.index, e.Index)
+			}
+			if !reflect.DeepEqual(e.Captures, s.captures) {
+				t.Fatalf("expected captures %v, got %v", s.captures, e.Captures)
+			}
+			if !reflect.DeepEqual(e.FSMPath, s.fsmPath) {
+				t.Fatalf("expected FSM path %v, got %v", s.fsmPath, e.FSMPath)
+			}
+			if s.matched && !reflect.DeepEqual(map[string]string(e.Labels), s.labels) {
+				t.Fatalf("expected labels %v, got %v", s.labels, e.Labels)
+			}
+
+			// Explaining must not populate the cache, but a regular lookup does.
+			mapper.GetMapping(s.metric, MetricTypeCounter)
+			if e := mapper.ExplainMapping(s.metric, MetricTypeCounter); !e.Cached {
+				t.Fatalf("expected result to be cached after GetMapping")
+			}
+		})
+	}
+}
@@ -41,6 +41,24 @@ type MetricMapping struct {
 	Ttl              time.Duration     `yaml:"ttl"`
 	SummaryOptions   *SummaryOptions   `yaml:"summary_options"`
 	HistogramOptions *HistogramOptions `yaml:"histogram_options"`
+	index            int
+
+	ValueScale             float64          `yaml:"value_scale"`
+	ValueOffset            float64          `yaml:"value_offset"`
+	ValueConversion        ValueConversion  `yaml:"value_conversion"`
+	DisableTimerConversion bool             `yaml:"disable_timer_conversion"`
+	TypeOverride           MetricType       `yaml:"type_override"`
+	ConflictStrategy       ConflictStrategy `yaml:"conflict_strategy"`
+	CounterMode            CounterMode      `yaml:"counter_mode"`
+	CounterInterval        time.Duration    `yaml:"counter_interval"`
+	GaugeAggregation       GaugeAggregation `yaml:"gauge_aggregation"`
+	GaugeAggregationWindow time.Duration    `yaml:"gauge_aggregation_window"`
+
+	StatsdAggregatesOptions *StatsdAggregatesOptions `yaml:"statsd_aggregates_options"`
+
+	// SourceLabel is the name of the label with the sender of a metric, if
+	// the listeners record it.
+	SourceLabel string `yaml:"source_label"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
@@ -66,6 +84,18 @@ func (m *MetricMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	m.Ttl = tmp.Ttl
 	m.SummaryOptions = tmp.SummaryOptions
 	m.HistogramOptions = tmp.HistogramOptions
+	m.ValueScale = tmp.ValueScale
+	m.ValueOffset = tmp.ValueOffset
+	m.ValueConversion = tmp.ValueConversion
+	m.DisableTimerConversion = tmp.DisableTimerConversion
+	m.TypeOverride = tmp.TypeOverride
+	m.ConflictStrategy = tmp.ConflictStrategy
+	m.CounterMode = tmp.CounterMode
+	m.CounterInterval = tmp.CounterInterval
+	m.GaugeAggregation = tmp.GaugeAggregation
+	m.GaugeAggregationWindow = tmp.GaugeAggregationWindow
+	m.StatsdAggregatesOptions = tmp.StatsdAggregatesOptions
+	m.SourceLabel = tmp.SourceLabel
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
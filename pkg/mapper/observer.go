@@ -20,7 +20,10 @@ type ObserverType string
 const (
 	ObserverTypeHistogram ObserverType = "histogram"
 	ObserverTypeSummary   ObserverType = "summary"
-	ObserverTypeDefault   ObserverType = ""
+	// ObserverTypeStatsdAggregates exposes the timer statistics of the
+	// original StatsD daemon as gauges.
+	ObserverTypeStatsdAggregates ObserverType = "statsd_aggregates"
+	ObserverTypeDefault          ObserverType = ""
 )
 
 func (t *ObserverType) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -34,6 +37,8 @@ func (t *ObserverType) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		*t = ObserverTypeHistogram
 	case ObserverTypeSummary, ObserverTypeDefault:
 		*t = ObserverTypeSummary
+	case ObserverTypeStatsdAggregates:
+		*t = ObserverTypeStatsdAggregates
 	default:
 		return fmt.Errorf("invalid observer type '%s'", v)
 	}
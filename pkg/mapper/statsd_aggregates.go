@@ -0,0 +1,73 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultStatsdPercentiles matches the default percentThreshold of
+	// StatsD.
+	DefaultStatsdPercentiles = []float64{90}
+	// DefaultStatsdFlushInterval matches the default flushInterval of StatsD.
+	DefaultStatsdFlushInterval = 10 * time.Second
+)
+
+// MinStatsdFlushInterval is the shortest flush interval. The exporter
+// publishes completed intervals once a second, so shorter intervals would
+// be merged, and count_ps would be wrong.
+const MinStatsdFlushInterval = time.Second
+
+// StatsdAggregatesOptions configures the statsd_aggregates observer type.
+type StatsdAggregatesOptions struct {
+	Percentiles   []float64     `yaml:"percentiles"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// withDefaults returns the options with unset fields filled in with the
+// StatsD defaults.
+func (o StatsdAggregatesOptions) withDefaults() StatsdAggregatesOptions {
+	if len(o.Percentiles) == 0 {
+		o.Percentiles = DefaultStatsdPercentiles
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = DefaultStatsdFlushInterval
+	}
+	return o
+}
+
+func (o StatsdAggregatesOptions) validate() error {
+	for _, p := range o.Percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("percentile %v is not in (0, 100]", p)
+		}
+	}
+	if o.FlushInterval < MinStatsdFlushInterval {
+		return fmt.Errorf("flush_interval must be at least %s", MinStatsdFlushInterval)
+	}
+	return nil
+}
+
+// StatsdAggregates returns the options of the statsd_aggregates observer type
+// for a mapping, falling back to the defaults.
+func (m *MetricMapper) StatsdAggregates(mapping *MetricMapping) StatsdAggregatesOptions {
+	if mapping != nil && mapping.StatsdAggregatesOptions != nil {
+		return *mapping.StatsdAggregatesOptions
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.Defaults.StatsdAggregatesOptions.withDefaults()
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+type unitDimension int
+
+const (
+	unitDimensionTime unitDimension = iota
+	unitDimensionData
+)
+
+type unit struct {
+	dimension unitDimension
+	factor    float64
+}
+
+// units maps unit names to their size in the base unit of their dimension,
+// seconds or bytes.
+var units = map[string]unit{
+	"ns":  {unitDimensionTime, 1e-9},
+	"us":  {unitDimensionTime, 1e-6},
+	"ms":  {unitDimensionTime, 1e-3},
+	"s":   {unitDimensionTime, 1},
+	"m":   {unitDimensionTime, 60},
+	"h":   {unitDimensionTime, 3600},
+	"b":   {unitDimensionData, 1},
+	"kb":  {unitDimensionData, 1e3},
+	"mb":  {unitDimensionData, 1e6},
+	"gb":  {unitDimensionData, 1e9},
+	"tb":  {unitDimensionData, 1e12},
+	"kib": {unitDimensionData, 1 << 10},
+	"mib": {unitDimensionData, 1 << 20},
+	"gib": {unitDimensionData, 1 << 30},
+	"tib": {unitDimensionData, 1 << 40},
+}
+
+// ValueConversion is a named unit conversion of the form "<from>_to_<to>",
+// for example "us_to_s" or "b_to_mb".
+type ValueConversion string
+
+const ValueConversionNone ValueConversion = ""
+
+func (c *ValueConversion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	if _, err := ValueConversion(v).factor(); err != nil {
+		return err
+	}
+	*c = ValueConversion(v)
+	return nil
+}
+
+// Factor returns the number a value has to be multiplied with to convert it.
+func (c ValueConversion) Factor() float64 {
+	f, err := c.factor()
+	if err != nil {
+		return 1
+	}
+	return f
+}
+
+func (c ValueConversion) factor() (float64, error) {
+	if c == ValueConversionNone {
+		return 1, nil
+	}
+	parts := strings.Split(string(c), "_to_")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid value conversion %q, must be of the form <from>_to_<to>", c)
+	}
+	from, ok := units[parts[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid value conversion %q: unknown unit %q", c, parts[0])
+	}
+	to, ok := units[parts[1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid value conversion %q: unknown unit %q", c, parts[1])
+	}
+	if from.dimension != to.dimension {
+		return 0, fmt.Errorf("invalid value conversion %q: cannot convert between %s and %s", c, parts[0], parts[1])
+	}
+	return from.factor / to.factor, nil
+}
+
+// TransformValue applies the value transformations of the mapping.
+// StatsD timers are sent in milliseconds and converted to seconds while
+// parsing; fromTimer undoes this if the mapping disables that conversion.
+// The offset only applies to absolute values, not to counter increments
+// or relative gauge changes.
+func (m *MetricMapping) TransformValue(value float64, fromTimer bool, absolute bool) float64 {
+	if fromTimer && m.DisableTimerConversion {
+		value *= 1000
+	}
+	if m.ValueConversion != ValueConversionNone {
+		value *= m.ValueConversion.Factor()
+	}
+	if m.ValueScale != 0 {
+		value *= m.ValueScale
+	}
+	if absolute {
+		value += m.ValueOffset
+	}
+	return value
+}
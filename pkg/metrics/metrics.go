@@ -52,6 +52,7 @@ type Vector struct {
 
 type Metric struct {
 	MetricType MetricType
+	Help       string
 	// Vectors key is the hash of the label names
 	Vectors map[NameHash]*Vector
 	// Metrics key is a hash of the label names + label values
@@ -64,4 +65,8 @@ type RegisteredMetric struct {
 	TTL              time.Duration
 	Metric           MetricHolder
 	VecKey           NameHash
+	// State holds per-series state kept by the exporter, for example the
+	// last value of a gauge that is exposed as a counter. It is discarded
+	// together with the series.
+	State interface{}
 }
@@ -0,0 +1,196 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto parses the headers of the HAProxy PROXY protocol,
+// versions 1 and 2, which carry the address of a client behind a proxy.
+// See https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLength is the maximum length of a version 1 header, including
+	// the CRLF.
+	v1MaxLength = 107
+	// v2HeaderLength is the length of the fixed part of a version 2
+	// header.
+	v2HeaderLength = 16
+)
+
+// ErrNoHeader is returned for data that doesn't start with a header.
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// SourceIP and SourcePort are the address of the client. SourceIP is
+	// nil if the proxy doesn't know it, or if the connection was not
+	// proxied, for example for health checks.
+	SourceIP   net.IP
+	SourcePort int
+}
+
+// ReadHeader reads a header from a stream. It returns ErrNoHeader, without
+// consuming anything, if the stream doesn't start with one.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := r.Peek(len(v1Prefix))
+		if err != nil || !bytes.Equal(prefix, v1Prefix) {
+			return nil, ErrNoHeader
+		}
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol v1 header: %w", err)
+		}
+		return parseV1(line)
+
+	case v2Signature[0]:
+		fixed, err := r.Peek(v2HeaderLength)
+		if err != nil || !bytes.Equal(fixed[:len(v2Signature)], v2Signature) {
+			return nil, ErrNoHeader
+		}
+		length := v2HeaderLength + int(binary.BigEndian.Uint16(fixed[14:16]))
+		if length > r.Size() {
+			return nil, fmt.Errorf("PROXY protocol v2 header of %d bytes is too long", length)
+		}
+		header, err := r.Peek(length)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol v2 header: %w", err)
+		}
+		h, err := parseV2(header)
+		r.Discard(length)
+		return h, err
+
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// ParseDatagram parses the header at the start of a datagram, and returns
+// it along with the rest of the datagram. It returns ErrNoHeader if the
+// datagram doesn't start with a header.
+func ParseDatagram(packet []byte) (*Header, []byte, error) {
+	switch {
+	case bytes.HasPrefix(packet, v1Prefix):
+		end := bytes.IndexByte(packet, '\n')
+		if end < 0 {
+			return nil, nil, errors.New("invalid PROXY protocol v1 header: missing CRLF")
+		}
+		h, err := parseV1(packet[:end+1])
+		return h, packet[end+1:], err
+
+	case bytes.HasPrefix(packet, v2Signature):
+		if len(packet) < v2HeaderLength {
+			return nil, nil, errors.New("invalid PROXY protocol v2 header: truncated")
+		}
+		length := v2HeaderLength + int(binary.BigEndian.Uint16(packet[14:16]))
+		if len(packet) < length {
+			return nil, nil, errors.New("invalid PROXY protocol v2 header: truncated")
+		}
+		h, err := parseV2(packet[:length])
+		return h, packet[length:], err
+
+	default:
+		return nil, packet, ErrNoHeader
+	}
+}
+
+// parseV1 parses a version 1 header, such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 9125\r\n".
+func parseV1(line []byte) (*Header, error) {
+	if len(line) > v1MaxLength {
+		return nil, errors.New("invalid PROXY protocol v1 header: too long")
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header: missing CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The rest of the line is to be ignored.
+		return &Header{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address in PROXY protocol v1 header %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in PROXY protocol v1 header %q", line)
+	}
+	return &Header{SourceIP: ip, SourcePort: int(port)}, nil
+}
+
+// parseV2 parses a complete version 2 header.
+func parseV2(header []byte) (*Header, error) {
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL, the connection was not proxied.
+		return &Header{}, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", verCmd&0xf)
+	}
+
+	addrs := header[v2HeaderLength:]
+	switch family >> 4 {
+	case 1:
+		// AF_INET
+		if len(addrs) < 12 {
+			return nil, errors.New("invalid PROXY protocol v2 header: truncated IPv4 addresses")
+		}
+		return &Header{
+			SourceIP:   net.IP(append([]byte(nil), addrs[0:4]...)),
+			SourcePort: int(binary.BigEndian.Uint16(addrs[8:10])),
+		}, nil
+	case 2:
+		// AF_INET6
+		if len(addrs) < 36 {
+			return nil, errors.New("invalid PROXY protocol v2 header: truncated IPv6 addresses")
+		}
+		return &Header{
+			SourceIP:   net.IP(append([]byte(nil), addrs[0:16]...)),
+			SourcePort: int(binary.BigEndian.Uint16(addrs[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX don't have an IP address.
+		return &Header{}, nil
+	}
+}
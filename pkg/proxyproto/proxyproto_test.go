@@ -0,0 +1,126 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2 returns a version 2 header with the given command, family and address
+// bytes.
+func v2(verCmd, family byte, addrs ...byte) string {
+	h := append([]byte(nil), v2Signature...)
+	h = append(h, verCmd, family, byte(len(addrs)>>8), byte(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func TestHeaders(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x23, 0xa5}
+	ipv6 := append(append(append([]byte(nil), net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x23, 0xa5)
+	tlv := []byte{0x04, 0x00, 0x02, 'o', 'k'}
+
+	scenarios := []struct {
+		name   string
+		header string
+		ip     string
+		port   int
+		err    bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 9125\r\n", ip: "192.0.2.1", port: 56324},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 9125\r\n", ip: "2001:db8::1", port: 56324},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN ignored\r\n"},
+		{name: "v1 without CRLF", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 9125\n", err: true},
+		{name: "v1 wrong family", header: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 9125\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 99999 9125\r\n", err: true},
+		{name: "v1 missing fields", header: "PROXY TCP4 192.0.2.1\r\n", err: true},
+		{name: "v1 too long", header: "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n", err: true},
+		{name: "v2 TCP4", header: v2(0x21, 0x11, ipv4...), ip: "192.0.2.1", port: 56324},
+		{name: "v2 UDP4", header: v2(0x21, 0x12, ipv4...), ip: "192.0.2.1", port: 56324},
+		{name: "v2 TCP6", header: v2(0x21, 0x21, ipv6...), ip: "2001:db8::1", port: 56324},
+		{name: "v2 with TLV", header: v2(0x21, 0x11, append(append([]byte(nil), ipv4...), tlv...)...), ip: "192.0.2.1", port: 56324},
+		{name: "v2 LOCAL", header: v2(0x20, 0x00)},
+		{name: "v2 UNSPEC", header: v2(0x21, 0x00)},
+		{name: "v2 truncated addresses", header: v2(0x21, 0x11, ipv4[:8]...), err: true},
+		{name: "v2 bad version", header: v2(0x11, 0x11, ipv4...), err: true},
+		{name: "v2 bad command", header: v2(0x22, 0x11, ipv4...), err: true},
+	}
+
+	for _, s := range scenarios {
+		check := func(t *testing.T, h *Header, err error) {
+			t.Helper()
+			if s.err {
+				if err == nil || errors.Is(err, ErrNoHeader) {
+					t.Fatalf("expected an error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s.ip == "" {
+				if h.SourceIP != nil {
+					t.Fatalf("expected no source, got %v", h.SourceIP)
+				}
+				return
+			}
+			if !h.SourceIP.Equal(net.ParseIP(s.ip)) || h.SourcePort != s.port {
+				t.Fatalf("expected source %s:%d, got %s:%d", s.ip, s.port, h.SourceIP, h.SourcePort)
+			}
+		}
+
+		t.Run(s.name+" stream", func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(s.header + "foo:1|c\n"))
+			h, err := ReadHeader(r)
+			check(t, h, err)
+			if err == nil {
+				rest, _ := ioutil.ReadAll(r)
+				if string(rest) != "foo:1|c\n" {
+					t.Fatalf("expected the lines after the header, got %q", rest)
+				}
+			}
+		})
+		t.Run(s.name+" datagram", func(t *testing.T) {
+			h, rest, err := ParseDatagram([]byte(s.header + "foo:1|c"))
+			check(t, h, err)
+			if err == nil && string(rest) != "foo:1|c" {
+				t.Fatalf("expected the lines after the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, data := range []string{"foo:1|c\n", "PROXY_requests:1|c\n", "\r\n"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		if _, err := ReadHeader(r); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("%q: expected ErrNoHeader, got %v", data, err)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != data {
+			t.Errorf("%q: expected nothing to be consumed, got %q", data, rest)
+		}
+
+		_, rest, err := ParseDatagram([]byte(data))
+		if !errors.Is(err, ErrNoHeader) {
+			t.Errorf("%q: expected ErrNoHeader, got %v", data, err)
+		}
+		if string(rest) != data {
+			t.Errorf("%q: expected the whole datagram, got %q", data, rest)
+		}
+	}
+}
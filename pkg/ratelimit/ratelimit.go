@@ -0,0 +1,387 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit limits the rate of StatsD lines per source, with token
+// buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
+)
+
+// KeyType is what lines are told apart by.
+type KeyType string
+
+const (
+	// KeyTypeSource is the IP address of the sender for UDP and TCP, and
+	// "uid:<uid>" of the sending process for Unixgram, if the operating
+	// system supports it.
+	KeyTypeSource KeyType = "source"
+	// KeyTypeTag is the value of the tag configured by Tag, or "" for
+	// lines without it.
+	KeyTypeTag KeyType = "tag"
+)
+
+// maxBuckets is the number of keys the limits are tracked for. Once it is
+// reached, keys that have not sent anything for a while are forgotten, and
+// new keys share one bucket per limit until there is room again.
+const maxBuckets = 10000
+
+const (
+	// topKeys is the number of keys that the dropped lines are broken down
+	// by. The lines of all other keys are counted as "other".
+	topKeys = 20
+	// trackedKeys is the number of keys whose dropped lines are counted.
+	// Tracking more keys than are exposed makes the counts of the top keys
+	// more accurate.
+	trackedKeys = 200
+	// otherKey is the key label of the lines dropped for all other keys.
+	otherKey = "other"
+)
+
+// Config is the rate limit configuration.
+type Config struct {
+	Key KeyType `yaml:"key"`
+	Tag string  `yaml:"tag"`
+	// Default applies to all keys that no limit in Limits matches.
+	Default Limit   `yaml:"default"`
+	Limits  []Limit `yaml:"limits"`
+}
+
+// Limit is the number of lines per second and the burst size allowed for
+// each key matching a glob pattern. A rate of 0 is unlimited.
+type Limit struct {
+	Match string  `yaml:"match"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// ParseConfig parses and validates a rate limit configuration.
+func ParseConfig(s string) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict([]byte(s), &c); err != nil {
+		return nil, err
+	}
+
+	switch c.Key {
+	case KeyTypeSource:
+		if c.Tag != "" {
+			return nil, fmt.Errorf("tag is only valid with key %q", KeyTypeTag)
+		}
+	case KeyTypeTag:
+		if c.Tag == "" {
+			return nil, fmt.Errorf("key %q requires a tag", KeyTypeTag)
+		}
+	case "":
+		c.Key = KeyTypeSource
+	default:
+		return nil, fmt.Errorf("invalid key %q", c.Key)
+	}
+
+	if c.Default.Match != "" {
+		return nil, fmt.Errorf("the default limit must not have a match")
+	}
+	if err := c.Default.init(); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	for i := range c.Limits {
+		l := &c.Limits[i]
+		if l.Match == "" {
+			return nil, fmt.Errorf("limit %d: match is required", i)
+		}
+		if _, err := path.Match(l.Match, ""); err != nil {
+			return nil, fmt.Errorf("limit %q: %w", l.Match, err)
+		}
+		if err := l.init(); err != nil {
+			return nil, fmt.Errorf("limit %q: %w", l.Match, err)
+		}
+	}
+	return &c, nil
+}
+
+// LoadConfig reads a rate limit configuration from a file.
+func LoadConfig(fileName string) (*Config, error) {
+	s, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(string(s))
+}
+
+func (l *Limit) init() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+	return nil
+}
+
+// name is the value of the limit label of the metrics.
+func (l *Limit) name() string {
+	if l.Match == "" {
+		return "default"
+	}
+	return l.Match
+}
+
+// Metrics are the metrics of rate limiters.
+type Metrics struct {
+	// LinesDropped is labeled by limit, the pattern of the limit or
+	// "default", so its cardinality is bounded by the configuration.
+	LinesDropped *prometheus.CounterVec
+	// keys breaks the dropped lines down by key, for the keys with the
+	// most dropped lines.
+	keys *keyCollector
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	var m Metrics
+
+	m.LinesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_rate_limited_lines_total",
+			Help: "The number of StatsD lines dropped because their source exceeded its rate limit.",
+		},
+		[]string{"limit"},
+	)
+
+	m.keys = &keyCollector{
+		desc: prometheus.NewDesc(
+			"statsd_exporter_rate_limited_key_lines",
+			"The estimated number of StatsD lines dropped because their source exceeded its rate limit, by key, for the keys with the most dropped lines. The lines of all other keys are counted with key \"other\".",
+			[]string{"key"}, nil,
+		),
+		tracker: unmapped.NewTracker(trackedKeys),
+		top:     topKeys,
+	}
+
+	if reg != nil {
+		reg.MustRegister(m.LinesDropped, m.keys)
+	}
+	return &m
+}
+
+// keyCollector exposes the number of dropped lines of the keys with the most
+// dropped lines. The keys are tracked with the Space-Saving algorithm, so
+// their cardinality is bounded, and the counts are estimates. As the top
+// keys change, the counts are exposed as gauges.
+type keyCollector struct {
+	desc    *prometheus.Desc
+	tracker *unmapped.Tracker
+	top     int
+	// dropped is the number of all dropped lines.
+	dropped uint64
+}
+
+func (c *keyCollector) observe(key string) {
+	atomic.AddUint64(&c.dropped, 1)
+	c.tracker.Observe(key, "", nil)
+}
+
+func (c *keyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *keyCollector) Collect(ch chan<- prometheus.Metric) {
+	dropped := atomic.LoadUint64(&c.dropped)
+	var top uint64
+	for _, e := range c.tracker.Top(c.top) {
+		// A key called "other" is counted with the other keys, so that
+		// the series don't collide.
+		if e.Name == otherKey {
+			continue
+		}
+		top += e.Count
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(e.Count), e.Name)
+	}
+	// The counts of the tracked keys add up to the number of dropped
+	// lines, unless lines were dropped while they were read.
+	other := float64(0)
+	if dropped > top {
+		other = float64(dropped - top)
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, other, otherKey)
+}
+
+// Limiter decides which lines are within their rate limit. It is safe for
+// concurrent use.
+type Limiter struct {
+	config  *Config
+	dropped []prometheus.Counter
+	keys    *keyCollector
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// shared are the buckets of the keys that don't fit into buckets,
+	// one per limit.
+	shared []*bucket
+}
+
+type bucket struct {
+	limit  int // index in Config.Limits, or -1 for the default
+	tokens float64
+	last   float64 // seconds
+}
+
+// NewLimiter creates a limiter for the given configuration.
+func NewLimiter(c *Config, m *Metrics) *Limiter {
+	l := &Limiter{
+		config:  c,
+		buckets: map[string]*bucket{},
+		shared:  make([]*bucket, len(c.Limits)+1),
+		dropped: make([]prometheus.Counter, len(c.Limits)+1),
+		keys:    m.keys,
+	}
+	for i := range l.dropped {
+		l.dropped[i] = m.LinesDropped.WithLabelValues(l.limit(i - 1).name())
+	}
+	return l
+}
+
+// KeyType returns what the limiter tells lines apart by.
+func (l *Limiter) KeyType() KeyType {
+	return l.config.Key
+}
+
+// Allow takes a token for line, which was sent by source, and reports
+// whether there was one.
+func (l *Limiter) Allow(source, line string) bool {
+	key := source
+	if l.config.Key == KeyTypeTag {
+		key = TagValue(line, l.config.Tag)
+	}
+
+	i := l.match(key)
+	limit := l.limit(i)
+	if limit.Rate == 0 {
+		return true
+	}
+
+	now := float64(clock.Now().UnixNano()) / 1e9
+	l.mu.Lock()
+	b := l.bucket(key, i, now)
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+(now-b.last)*limit.Rate)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	l.mu.Unlock()
+
+	if !allowed {
+		l.dropped[i+1].Inc()
+		l.keys.observe(key)
+	}
+	return allowed
+}
+
+// match returns the index of the first limit matching key, or -1.
+func (l *Limiter) match(key string) int {
+	for i, limit := range l.config.Limits {
+		if ok, _ := path.Match(limit.Match, key); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Limiter) limit(i int) *Limit {
+	if i < 0 {
+		return &l.config.Default
+	}
+	return &l.config.Limits[i]
+}
+
+// bucket returns the bucket of key, which is limited by the limit with index
+// i. It must be called with mu held.
+func (l *Limiter) bucket(key string, i int, now float64) *bucket {
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+	if len(l.buckets) >= maxBuckets {
+		l.forgetFull(now)
+	}
+	if len(l.buckets) >= maxBuckets {
+		if l.shared[i+1] == nil {
+			l.shared[i+1] = l.newBucket(i, now)
+		}
+		return l.shared[i+1]
+	}
+	b := l.newBucket(i, now)
+	l.buckets[key] = b
+	return b
+}
+
+func (l *Limiter) newBucket(i int, now float64) *bucket {
+	return &bucket{limit: i, tokens: float64(l.limit(i).Burst), last: now}
+}
+
+// forgetFull removes the buckets that are full by now. Forgetting them
+// doesn't change anything, as new buckets start out full.
+func (l *Limiter) forgetFull(now float64) {
+	for key, b := range l.buckets {
+		limit := l.limit(b.limit)
+		if b.tokens+(now-b.last)*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// TagValue returns the value of the tag called name in a StatsD line, or ""
+// if it doesn't have one. It understands the tag formats of DogStatsD,
+// InfluxDB, Librato and SignalFX, without parsing the whole line.
+func TagValue(line, name string) string {
+	for i := 0; i < len(line); {
+		j := strings.Index(line[i:], name)
+		if j < 0 {
+			return ""
+		}
+		start := i + j
+		end := start + len(name)
+		i = end
+		if start == 0 || end >= len(line) || !strings.ContainsRune("#,[", rune(line[start-1])) {
+			continue
+		}
+		var stop string
+		switch line[end] {
+		case ':':
+			// DogStatsD
+			stop = ",|"
+		case '=':
+			// InfluxDB, Librato and SignalFX
+			stop = ",:]|#"
+		default:
+			continue
+		}
+		value := line[end+1:]
+		if k := strings.IndexAny(value, stop); k >= 0 {
+			value = value[:k]
+		}
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+func TestParseConfig(t *testing.T) {
+	scenarios := []struct {
+		config string
+		valid  bool
+	}{
+		{config: ``, valid: true},
+		{config: "key: source\ndefault: {rate: 10}", valid: true},
+		{config: "key: tag\ntag: service\nlimits: [{match: 'a*', rate: 1, burst: 5}]", valid: true},
+		{config: "key: tag", valid: false},
+		{config: "key: source\ntag: service", valid: false},
+		{config: "key: address", valid: false},
+		{config: "default: {match: 'a*'}", valid: false},
+		{config: "limits: [{rate: 1}]", valid: false},
+		{config: "limits: [{match: '[', rate: 1}]", valid: false},
+		{config: "default: {rate: -1}", valid: false},
+		{config: "default: {rates: 1}", valid: false},
+	}
+	for _, s := range scenarios {
+		_, err := ParseConfig(s.config)
+		if s.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", s.config, err)
+		}
+		if !s.valid && err == nil {
+			t.Errorf("%q: expected an error", s.config)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	c, err := ParseConfig(`
+key: source
+default:
+  rate: 2
+limits:
+- match: "10.0.0.*"
+  rate: 1
+  burst: 3
+- match: "10.*"
+  rate: 0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics(nil)
+	l := NewLimiter(c, m)
+
+	allowed := func(source string, n int) int {
+		var a int
+		for i := 0; i < n; i++ {
+			if l.Allow(source, "foo:1|c") {
+				a++
+			}
+		}
+		return a
+	}
+
+	// Each source has a bucket of its own, filled up to the burst size.
+	if a := allowed("10.0.0.1", 5); a != 3 {
+		t.Errorf("expected 3 lines to be allowed, got %d", a)
+	}
+	if a := allowed("10.0.0.2", 5); a != 3 {
+		t.Errorf("expected 3 lines to be allowed, got %d", a)
+	}
+	if a := allowed("192.168.0.1", 5); a != 2 {
+		t.Errorf("expected 2 lines to be allowed, got %d", a)
+	}
+	// Unlimited.
+	if a := allowed("10.1.0.1", 100); a != 100 {
+		t.Errorf("expected 100 lines to be allowed, got %d", a)
+	}
+
+	// The buckets are refilled at the rate of their limit.
+	clock.ClockInstance.Instant = time.Unix(2, 0)
+	if a := allowed("10.0.0.1", 5); a != 2 {
+		t.Errorf("expected 2 lines to be allowed, got %d", a)
+	}
+	if a := allowed("192.168.0.1", 5); a != 2 {
+		t.Errorf("expected 2 lines to be allowed, got %d", a)
+	}
+
+	expected := map[string]float64{"10.0.0.*": 7, "10.*": 0, "default": 6}
+	for limit, dropped := range expected {
+		if v := testutil.ToFloat64(m.LinesDropped.WithLabelValues(limit)); v != dropped {
+			t.Errorf("expected %v lines dropped by %s, got %v", dropped, limit, v)
+		}
+	}
+
+	// Only the top keys are exposed, 10.0.0.2 is counted as other.
+	m.keys.top = 2
+	err = testutil.CollectAndCompare(m.keys, strings.NewReader(`
+# HELP statsd_exporter_rate_limited_key_lines The estimated number of StatsD lines dropped because their source exceeded its rate limit, by key, for the keys with the most dropped lines. The lines of all other keys are counted with key "other".
+# TYPE statsd_exporter_rate_limited_key_lines gauge
+statsd_exporter_rate_limited_key_lines{key="10.0.0.1"} 5
+statsd_exporter_rate_limited_key_lines{key="192.168.0.1"} 6
+statsd_exporter_rate_limited_key_lines{key="other"} 2
+`))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimiterByTag(t *testing.T) {
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	c, err := ParseConfig(`
+key: tag
+tag: service
+default:
+  rate: 1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(c, NewMetrics(nil))
+
+	scenarios := []struct {
+		line    string
+		allowed bool
+	}{
+		{line: "foo:1|c|#service:a", allowed: true},
+		{line: "foo,service=b:1|c", allowed: true},
+		{line: "foo:1|c", allowed: true},
+		// Different sources with the same tag share a bucket.
+		{line: "bar:1|c|#env:prod,service:a", allowed: false},
+		{line: "bar#service=b:1|c", allowed: false},
+		{line: "bar:2|g", allowed: false},
+	}
+	for _, s := range scenarios {
+		if allowed := l.Allow("127.0.0.1", s.line); allowed != s.allowed {
+			t.Errorf("%s: expected allowed to be %v", s.line, s.allowed)
+		}
+	}
+}
+
+func TestLimiterBuckets(t *testing.T) {
+	previousClock := clock.ClockInstance
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = previousClock }()
+
+	c, err := ParseConfig("default: {rate: 1}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(c, NewMetrics(nil))
+
+	for i := 0; i < maxBuckets+10; i++ {
+		l.Allow(time.Duration(i).String(), "foo:1|c")
+	}
+	if len(l.buckets) != maxBuckets {
+		t.Fatalf("expected %d buckets, got %d", maxBuckets, len(l.buckets))
+	}
+
+	// Once all buckets have been refilled, they are forgotten to make room
+	// for new keys.
+	clock.ClockInstance.Instant = time.Unix(1, 0)
+	l.Allow("new", "foo:1|c")
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected 1 bucket, got %d", len(l.buckets))
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	scenarios := []struct {
+		line  string
+		value string
+	}{
+		{line: "foo:1|c|#service:a,env:prod", value: "a"},
+		{line: "foo:1|c|#env:prod,service:a|@0.1", value: "a"},
+		{line: "foo,env=prod,service=a:1|c", value: "a"},
+		{line: "foo#service=a,env=prod:1|c", value: "a"},
+		{line: "foo.[service=a,env=prod]bar:1|c", value: "a"},
+		{line: "foo:1|c|#myservice:a", value: ""},
+		{line: "service:1|c", value: ""},
+		{line: "foo.service:1|c", value: ""},
+		{line: "foo:1|c|#service", value: ""},
+		{line: "foo:1|c|#service:", value: ""},
+	}
+	for _, s := range scenarios {
+		if value := TagValue(s.line, "service"); value != s.value {
+			t.Errorf("%s: expected %q, got %q", s.line, s.value, value)
+		}
+	}
+}
@@ -33,17 +33,60 @@ import (
 // This allows incoming metrics to have inconsistent label sets
 type uncheckedCollector struct {
 	c prometheus.Collector
+	// baselines, if set, holds restored state that is added to the
+	// collected metrics.
+	baselines *baselines
 }
 
 func (u uncheckedCollector) Describe(_ chan<- *prometheus.Desc) {}
 func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
-	u.c.Collect(c)
+	if u.baselines.empty() {
+		u.c.Collect(c)
+		return
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		u.c.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		c <- u.baselines.apply(m)
+	}
+}
+
+// ConflictError is returned when a metric can't be updated because its name
+// is already in use by a metric of a different type.
+type ConflictError struct {
+	// MetricName is the name of the existing metric. For histograms and
+	// summaries, this may be one of the derived series names.
+	MetricName string
+	// MetricType is the type of the existing metric.
+	MetricType metrics.MetricType
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("metric with name %s is already registered", e.MetricName)
+}
+
+// evictedKey identifies the vectors of an evicted metric.
+type evictedKey struct {
+	name       string
+	metricType metrics.MetricType
 }
 
 type Registry struct {
 	Registerer prometheus.Registerer
 	Metrics    map[string]metrics.Metric
 	Mapper     *mapper.MetricMapper
+	// evicted keeps the vectors of evicted metrics. They can't be
+	// unregistered, so they are reused if the metric comes back.
+	evicted map[evictedKey]map[metrics.NameHash]*metrics.Vector
+	// baselines holds the restored state of histograms and summaries.
+	baselines *baselines
+	// summaryOptions holds the options of the summary vectors, for
+	// snapshots.
+	summaryOptions map[metrics.VectorHolder]prometheus.SummaryOpts
 	// The below value and label variables are allocated in the registry struct
 	// so that we don't have to allocate them every time have to compute a label
 	// hash.
@@ -55,6 +98,8 @@ func NewRegistry(reg prometheus.Registerer, mapper *mapper.MetricMapper) *Regist
 	return &Registry{
 		Registerer: reg,
 		Metrics:    make(map[string]metrics.Metric),
+		evicted:    make(map[evictedKey]map[metrics.NameHash]*metrics.Vector),
+		baselines:  newBaselines(),
 		Mapper:     mapper,
 		Hasher:     fnv.New64a(),
 	}
@@ -78,6 +123,39 @@ func (r *Registry) MetricConflicts(metricName string, metricType metrics.MetricT
 	return true
 }
 
+// conflict returns a *ConflictError if any of the given names is in use by a
+// metric of a different type.
+func (r *Registry) conflict(metricType metrics.MetricType, metricNames ...string) error {
+	for _, metricName := range metricNames {
+		if r.MetricConflicts(metricName, metricType) {
+			return &ConflictError{MetricName: metricName, MetricType: r.Metrics[metricName].MetricType}
+		}
+	}
+	return nil
+}
+
+// Evict removes all series of a metric, so that its name can be used by a
+// metric of a different type.
+func (r *Registry) Evict(metricName string) {
+	metric, ok := r.Metrics[metricName]
+	if !ok {
+		return
+	}
+	for hash, rm := range metric.Metrics {
+		metric.Vectors[rm.VecKey].Holder.Delete(rm.Labels)
+		r.baselines.remove(rm.Metric)
+		delete(metric.Metrics, hash)
+	}
+	for _, v := range metric.Vectors {
+		v.RefCount = 0
+	}
+	if r.evicted == nil {
+		r.evicted = make(map[evictedKey]map[metrics.NameHash]*metrics.Vector)
+	}
+	r.evicted[evictedKey{metricName, metric.MetricType}] = metric.Vectors
+	delete(r.Metrics, metricName)
+}
+
 func (r *Registry) StoreCounter(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.CounterVec, c prometheus.Counter, ttl time.Duration) {
 	r.Store(metricName, hash, labels, vec, c, metrics.CounterMetricType, ttl)
 }
@@ -97,8 +175,13 @@ func (r *Registry) StoreSummary(metricName string, hash metrics.LabelHash, label
 func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vh metrics.VectorHolder, mh metrics.MetricHolder, metricType metrics.MetricType, ttl time.Duration) {
 	metric, hasMetrics := r.Metrics[metricName]
 	if !hasMetrics {
+		key := evictedKey{metricName, metricType}
 		metric.MetricType = metricType
 		metric.Vectors = make(map[metrics.NameHash]*metrics.Vector)
+		if vectors, ok := r.evicted[key]; ok {
+			metric.Vectors = vectors
+			delete(r.evicted, key)
+		}
 		metric.Metrics = make(map[metrics.ValueHash]*metrics.RegisteredMetric)
 
 		r.Metrics[metricName] = metric
@@ -129,10 +212,23 @@ func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prome
 	rm.TTL = ttl
 }
 
+// setHelp records the help text of a metric, which is needed to recreate it
+// from a snapshot.
+func (r *Registry) setHelp(metricName, help string) {
+	if metric, ok := r.Metrics[metricName]; ok && metric.Help == "" {
+		metric.Help = help
+		r.Metrics[metricName] = metric
+	}
+}
+
 func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType metrics.MetricType) (metrics.VectorHolder, metrics.MetricHolder) {
 	metric, hasMetric := r.Metrics[metricName]
 
 	if !hasMetric {
+		// Vectors of an evicted metric are still registered, reuse them.
+		if vector, ok := r.evicted[evictedKey{metricName, metricType}][hash.Names]; ok {
+			return vector.Holder, nil
+		}
 		return nil, nil
 	}
 	if metric.MetricType != metricType {
@@ -154,6 +250,17 @@ func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType met
 	return nil, nil
 }
 
+// GetRegisteredMetric returns the bookkeeping entry of an existing series, or
+// nil if there is none.
+func (r *Registry) GetRegisteredMetric(metricName string, labels prometheus.Labels) *metrics.RegisteredMetric {
+	metric, hasMetric := r.Metrics[metricName]
+	if !hasMetric {
+		return nil
+	}
+	hash, _ := r.HashLabels(labels)
+	return metric.Metrics[hash.Values]
+}
+
 func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Counter, error) {
 	hash, labelNames := r.HashLabels(labels)
 	vh, mh := r.Get(metricName, hash, metrics.CounterMetricType)
@@ -161,8 +268,8 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 		return mh.(prometheus.Counter), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.CounterMetricType) {
-		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
+	if err := r.conflict(metrics.CounterMetricType, metricName); err != nil {
+		return nil, err
 	}
 
 	var counterVec *prometheus.CounterVec
@@ -173,7 +280,7 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 			Help: help,
 		}, labelNames)
 
-		if err := r.Registerer.Register(uncheckedCollector{counterVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{c: counterVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -186,6 +293,7 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 		return nil, err
 	}
 	r.StoreCounter(metricName, hash, labels, counterVec, counter, mapping.Ttl)
+	r.setHelp(metricName, help)
 
 	return counter, nil
 }
@@ -197,8 +305,8 @@ func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help st
 		return mh.(prometheus.Gauge), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.GaugeMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if err := r.conflict(metrics.GaugeMetricType, metricName); err != nil {
+		return nil, err
 	}
 
 	var gaugeVec *prometheus.GaugeVec
@@ -209,7 +317,7 @@ func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help st
 			Help: help,
 		}, labelNames)
 
-		if err := r.Registerer.Register(uncheckedCollector{gaugeVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{c: gaugeVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -222,6 +330,7 @@ func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help st
 		return nil, err
 	}
 	r.StoreGauge(metricName, hash, labels, gaugeVec, gauge, mapping.Ttl)
+	r.setHelp(metricName, help)
 
 	return gauge, nil
 }
@@ -233,17 +342,8 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
-	}
-	if r.MetricConflicts(metricName+"_sum", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
-	}
-	if r.MetricConflicts(metricName+"_count", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
-	}
-	if r.MetricConflicts(metricName+"_bucket", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if err := r.conflict(metrics.HistogramMetricType, metricName, metricName+"_sum", metricName+"_count", metricName+"_bucket"); err != nil {
+		return nil, err
 	}
 
 	var histogramVec *prometheus.HistogramVec
@@ -259,7 +359,7 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 			Buckets: buckets,
 		}, labelNames)
 
-		if err := r.Registerer.Register(uncheckedCollector{histogramVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{histogramVec, r.baselines}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -272,65 +372,46 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 		return nil, err
 	}
 	r.StoreHistogram(metricName, hash, labels, histogramVec, observer, mapping.Ttl)
+	r.setHelp(metricName, help)
 
 	return observer, nil
 }
 
 func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error) {
+	return r.getSummary(metricName, labels, help, mapping, nil, metricsCount)
+}
+
+// getSummary is GetSummary, but if opts is not nil, a new summary is created
+// with the objectives and ages of opts instead of those of the mapping.
+func (r *Registry) getSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, opts *prometheus.SummaryOpts, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error) {
 	hash, labelNames := r.HashLabels(labels)
 	vh, mh := r.Get(metricName, hash, metrics.SummaryMetricType)
 	if mh != nil {
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
-	}
-	if r.MetricConflicts(metricName+"_sum", metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
-	}
-	if r.MetricConflicts(metricName+"_count", metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if err := r.conflict(metrics.SummaryMetricType, metricName, metricName+"_sum", metricName+"_count"); err != nil {
+		return nil, err
 	}
 
 	var summaryVec *prometheus.SummaryVec
 	if vh == nil {
 		metricsCount.WithLabelValues("summary").Inc()
-		quantiles := r.Mapper.Defaults.SummaryOptions.Quantiles
-		if mapping != nil && mapping.SummaryOptions != nil && len(mapping.SummaryOptions.Quantiles) > 0 {
-			quantiles = mapping.SummaryOptions.Quantiles
-		}
-
-		summaryOptions := mapper.SummaryOptions{
-			MaxAge:     r.Mapper.Defaults.SummaryOptions.MaxAge,
-			AgeBuckets: r.Mapper.Defaults.SummaryOptions.AgeBuckets,
-			BufCap:     r.Mapper.Defaults.SummaryOptions.BufCap,
-		}
-
-		if mapping != nil && mapping.SummaryOptions != nil {
-			summaryOptions = *mapping.SummaryOptions
+		if opts == nil {
+			o := r.summaryOpts(mapping)
+			opts = &o
 		}
+		opts.Name = metricName
+		opts.Help = help
+		summaryVec = prometheus.NewSummaryVec(*opts, labelNames)
 
-		objectives := make(map[float64]float64)
-		for _, q := range quantiles {
-			objectives[q.Quantile] = q.Error
-		}
-		// In the case of no mapping file, explicitly define the default quantiles
-		if len(objectives) == 0 {
-			objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
-		}
-		summaryVec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-			Name:       metricName,
-			Help:       help,
-			Objectives: objectives,
-			MaxAge:     summaryOptions.MaxAge,
-			AgeBuckets: summaryOptions.AgeBuckets,
-			BufCap:     summaryOptions.BufCap,
-		}, labelNames)
-
-		if err := r.Registerer.Register(uncheckedCollector{summaryVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{summaryVec, r.baselines}); err != nil {
 			return nil, err
 		}
+		if r.summaryOptions == nil {
+			r.summaryOptions = make(map[metrics.VectorHolder]prometheus.SummaryOpts)
+		}
+		r.summaryOptions[summaryVec] = *opts
 	} else {
 		summaryVec = vh.(*prometheus.SummaryVec)
 	}
@@ -341,10 +422,44 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 		return nil, err
 	}
 	r.StoreSummary(metricName, hash, labels, summaryVec, observer, mapping.Ttl)
+	r.setHelp(metricName, help)
 
 	return observer, nil
 }
 
+// summaryOpts returns the objectives and ages of the summaries of a mapping.
+func (r *Registry) summaryOpts(mapping *mapper.MetricMapping) prometheus.SummaryOpts {
+	quantiles := r.Mapper.Defaults.SummaryOptions.Quantiles
+	if mapping != nil && mapping.SummaryOptions != nil && len(mapping.SummaryOptions.Quantiles) > 0 {
+		quantiles = mapping.SummaryOptions.Quantiles
+	}
+
+	summaryOptions := mapper.SummaryOptions{
+		MaxAge:     r.Mapper.Defaults.SummaryOptions.MaxAge,
+		AgeBuckets: r.Mapper.Defaults.SummaryOptions.AgeBuckets,
+		BufCap:     r.Mapper.Defaults.SummaryOptions.BufCap,
+	}
+
+	if mapping != nil && mapping.SummaryOptions != nil {
+		summaryOptions = *mapping.SummaryOptions
+	}
+
+	objectives := make(map[float64]float64)
+	for _, q := range quantiles {
+		objectives[q.Quantile] = q.Error
+	}
+	// In the case of no mapping file, explicitly define the default quantiles
+	if len(objectives) == 0 {
+		objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+	}
+	return prometheus.SummaryOpts{
+		Objectives: objectives,
+		MaxAge:     summaryOptions.MaxAge,
+		AgeBuckets: summaryOptions.AgeBuckets,
+		BufCap:     summaryOptions.BufCap,
+	}
+}
+
 func (r *Registry) RemoveStaleMetrics() {
 	now := clock.Now()
 	// delete timeseries with expired ttl
@@ -356,6 +471,7 @@ func (r *Registry) RemoveStaleMetrics() {
 			if rm.LastRegisteredAt.Add(rm.TTL).Before(now) {
 				metric.Vectors[rm.VecKey].Holder.Delete(rm.Labels)
 				metric.Vectors[rm.VecKey].RefCount--
+				r.baselines.remove(rm.Metric)
 				delete(metric.Metrics, hash)
 			}
 		}
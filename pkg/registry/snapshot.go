@@ -0,0 +1,265 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+)
+
+// baseline is the restored state of a histogram or summary series. The
+// client library can't set the state of these metrics, so it is added to
+// the live state whenever the series is collected.
+type baseline struct {
+	count uint64
+	sum   float64
+	// buckets maps the upper bounds of a histogram to cumulative counts.
+	buckets map[float64]uint64
+}
+
+// baselines holds the baselines of all restored series, keyed by the
+// series. It is accessed both by the exporter and by scrapes.
+type baselines struct {
+	mu sync.RWMutex
+	m  map[prometheus.Metric]*baseline
+}
+
+func newBaselines() *baselines {
+	return &baselines{m: make(map[prometheus.Metric]*baseline)}
+}
+
+func (b *baselines) empty() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.m) == 0
+}
+
+func (b *baselines) set(m metrics.MetricHolder, bl *baseline) {
+	pm, ok := m.(prometheus.Metric)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.m[pm] = bl
+}
+
+func (b *baselines) remove(m metrics.MetricHolder) {
+	pm, ok := m.(prometheus.Metric)
+	if !ok || b.empty() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.m, pm)
+}
+
+// apply returns the metric with its baseline added. Metrics without a
+// baseline are returned as they are.
+func (b *baselines) apply(m prometheus.Metric) prometheus.Metric {
+	b.mu.RLock()
+	bl, ok := b.m[m]
+	b.mu.RUnlock()
+	if !ok {
+		return m
+	}
+
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return m
+	}
+	labelValues := make([]string, 0, len(pb.Label))
+	for _, l := range pb.Label {
+		labelValues = append(labelValues, l.GetValue())
+	}
+
+	var merged prometheus.Metric
+	var err error
+	switch {
+	case pb.Histogram != nil:
+		buckets := make(map[float64]uint64, len(pb.Histogram.Bucket))
+		for _, bucket := range pb.Histogram.Bucket {
+			buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount() + bl.buckets[bucket.GetUpperBound()]
+		}
+		merged, err = prometheus.NewConstHistogram(m.Desc(), pb.Histogram.GetSampleCount()+bl.count, pb.Histogram.GetSampleSum()+bl.sum, buckets, labelValues...)
+	case pb.Summary != nil:
+		// Quantiles can't be restored, they only reflect the observations
+		// since the restart.
+		quantiles := make(map[float64]float64, len(pb.Summary.Quantile))
+		for _, q := range pb.Summary.Quantile {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		merged, err = prometheus.NewConstSummary(m.Desc(), pb.Summary.GetSampleCount()+bl.count, pb.Summary.GetSampleSum()+bl.sum, quantiles, labelValues...)
+	default:
+		return m
+	}
+	if err != nil {
+		return m
+	}
+	return merged
+}
+
+var snapshotTypes = map[metrics.MetricType]string{
+	metrics.CounterMetricType:   snapshot.TypeCounter,
+	metrics.GaugeMetricType:     snapshot.TypeGauge,
+	metrics.HistogramMetricType: snapshot.TypeHistogram,
+	metrics.SummaryMetricType:   snapshot.TypeSummary,
+}
+
+// Snapshot returns the state of all series in the registry.
+func (r *Registry) Snapshot() []snapshot.Series {
+	var series []snapshot.Series
+	for name, metric := range r.Metrics {
+		for _, rm := range metric.Metrics {
+			pm, ok := rm.Metric.(prometheus.Metric)
+			if !ok {
+				continue
+			}
+			var pb dto.Metric
+			if err := r.baselines.apply(pm).Write(&pb); err != nil {
+				continue
+			}
+
+			s := snapshot.Series{
+				Name:             name,
+				Type:             snapshotTypes[metric.MetricType],
+				Help:             metric.Help,
+				Labels:           rm.Labels,
+				TTL:              rm.TTL,
+				LastRegisteredAt: rm.LastRegisteredAt,
+			}
+			switch {
+			case pb.Counter != nil:
+				s.Value = pb.Counter.GetValue()
+			case pb.Gauge != nil:
+				s.Value = pb.Gauge.GetValue()
+			case pb.Histogram != nil:
+				s.Count = pb.Histogram.GetSampleCount()
+				s.Sum = pb.Histogram.GetSampleSum()
+				for _, b := range pb.Histogram.Bucket {
+					s.Buckets = append(s.Buckets, snapshot.Bucket{UpperBound: b.GetUpperBound(), CumulativeCount: b.GetCumulativeCount()})
+				}
+			case pb.Summary != nil:
+				s.Count = pb.Summary.GetSampleCount()
+				s.Sum = pb.Summary.GetSampleSum()
+				if opts, ok := r.summaryOptions[metric.Vectors[rm.VecKey].Holder]; ok {
+					for q, e := range opts.Objectives {
+						s.Objectives = append(s.Objectives, snapshot.Objective{Quantile: q, Error: e})
+					}
+					sort.Slice(s.Objectives, func(i, j int) bool { return s.Objectives[i].Quantile < s.Objectives[j].Quantile })
+					s.MaxAge = opts.MaxAge
+					s.AgeBuckets = opts.AgeBuckets
+					s.BufCap = opts.BufCap
+				}
+			}
+			series = append(series, s)
+		}
+	}
+	return series
+}
+
+// Restore recreates the series of a snapshot. Series that have expired in
+// the meantime are skipped, as are series that can't be created, for
+// example because of a conflict. It returns the number of restored series.
+func (r *Registry) Restore(series []snapshot.Series, metricsCount *prometheus.GaugeVec) (int, error) {
+	now := clock.Now()
+	restored := 0
+	var firstErr error
+	for _, s := range series {
+		if s.TTL > 0 && s.LastRegisteredAt.Add(s.TTL).Before(now) {
+			continue
+		}
+		if err := r.restoreSeries(s, metricsCount); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("restoring %s: %w", s.Name, err)
+			}
+			continue
+		}
+		if rm := r.GetRegisteredMetric(s.Name, s.Labels); rm != nil {
+			rm.LastRegisteredAt = s.LastRegisteredAt
+		}
+		restored++
+	}
+	return restored, firstErr
+}
+
+func (r *Registry) restoreSeries(s snapshot.Series, metricsCount *prometheus.GaugeVec) error {
+	labels := prometheus.Labels(s.Labels)
+	if labels == nil {
+		labels = prometheus.Labels{}
+	}
+	mapping := &mapper.MetricMapping{Ttl: s.TTL}
+
+	switch s.Type {
+	case snapshot.TypeCounter:
+		counter, err := r.GetCounter(s.Name, labels, s.Help, mapping, metricsCount)
+		if err != nil {
+			return err
+		}
+		counter.Add(s.Value)
+	case snapshot.TypeGauge:
+		gauge, err := r.GetGauge(s.Name, labels, s.Help, mapping, metricsCount)
+		if err != nil {
+			return err
+		}
+		gauge.Set(s.Value)
+	case snapshot.TypeHistogram:
+		bl := &baseline{count: s.Count, sum: s.Sum, buckets: make(map[float64]uint64, len(s.Buckets))}
+		mapping.HistogramOptions = &mapper.HistogramOptions{}
+		for _, b := range s.Buckets {
+			mapping.HistogramOptions.Buckets = append(mapping.HistogramOptions.Buckets, b.UpperBound)
+			bl.buckets[b.UpperBound] = b.CumulativeCount
+		}
+		histogram, err := r.GetHistogram(s.Name, labels, s.Help, mapping, metricsCount)
+		if err != nil {
+			return err
+		}
+		r.baselines.set(histogram, bl)
+	case snapshot.TypeSummary:
+		// A summary is restored with the options it was created with, which
+		// may differ from the defaults.
+		var opts *prometheus.SummaryOpts
+		if len(s.Objectives) > 0 {
+			opts = &prometheus.SummaryOpts{
+				Objectives: make(map[float64]float64, len(s.Objectives)),
+				MaxAge:     s.MaxAge,
+				AgeBuckets: s.AgeBuckets,
+				BufCap:     s.BufCap,
+			}
+			for _, o := range s.Objectives {
+				opts.Objectives[o.Quantile] = o.Error
+			}
+		}
+		summary, err := r.getSummary(s.Name, labels, s.Help, mapping, opts, metricsCount)
+		if err != nil {
+			return err
+		}
+		r.baselines.set(summary, &baseline{count: s.Count, sum: s.Sum})
+	default:
+		return fmt.Errorf("unknown metric type %q", s.Type)
+	}
+	return nil
+}
@@ -18,12 +18,12 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/statsd_exporter/pkg/level"
 )
 
@@ -33,31 +33,62 @@ type Relay struct {
 	conn          *net.UDPConn
 	logger        log.Logger
 	packetLength  uint
+	// done is closed when relayOutput has returned.
+	done chan struct{}
 
 	packetsTotal   prometheus.Counter
 	longLinesTotal prometheus.Counter
 }
 
-var (
-	relayPacketsTotal = promauto.NewCounterVec(
+// Metrics are the metrics of relays. They can be shared by several relays,
+// which are told apart by the target label.
+type Metrics struct {
+	PacketsTotal   *prometheus.CounterVec
+	LongLinesTotal *prometheus.CounterVec
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	var m Metrics
+
+	m.PacketsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_relay_packets_total",
 			Help: "The number of StatsD packets relayed.",
 		},
 		[]string{"target"},
 	)
-	relayLongLinesTotal = promauto.NewCounterVec(
+	m.LongLinesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_relay_long_lines_total",
 			Help: "The number lines that were too long to relay.",
 		},
 		[]string{"target"},
 	)
+
+	if reg != nil {
+		reg.MustRegister(m.PacketsTotal)
+		reg.MustRegister(m.LongLinesTotal)
+	}
+	return &m
+}
+
+var (
+	defaultMetrics     *Metrics
+	defaultMetricsOnce sync.Once
 )
 
 // NewRelay creates a statsd UDP relay. It can be used to send copies of statsd raw
-// lines to a separate service.
+// lines to a separate service. Its metrics are registered with the default
+// registry.
 func NewRelay(l log.Logger, target string, packetLength uint) (*Relay, error) {
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics = NewMetrics(prometheus.DefaultRegisterer)
+	})
+	return NewRelayWithMetrics(l, target, packetLength, defaultMetrics)
+}
+
+// NewRelayWithMetrics creates a statsd UDP relay that records its metrics in m.
+func NewRelayWithMetrics(l log.Logger, target string, packetLength uint, m *Metrics) (*Relay, error) {
 	addr, err := net.ResolveUDPAddr("udp", target)
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve target %s, err: %w", target, err)
@@ -75,9 +106,10 @@ func NewRelay(l log.Logger, target string, packetLength uint) (*Relay, error) {
 		conn:          conn,
 		logger:        l,
 		packetLength:  packetLength,
+		done:          make(chan struct{}),
 
-		packetsTotal:   relayPacketsTotal.WithLabelValues(target),
-		longLinesTotal: relayLongLinesTotal.WithLabelValues(target),
+		packetsTotal:   m.PacketsTotal.WithLabelValues(target),
+		longLinesTotal: m.LongLinesTotal.WithLabelValues(target),
 	}
 
 	// Startup the UDP sender.
@@ -91,6 +123,9 @@ func (r *Relay) relayOutput() {
 	var buffer bytes.Buffer
 	var err error
 
+	defer close(r.done)
+	defer r.conn.Close()
+
 	relayInterval := time.NewTicker(1 * time.Second)
 	defer relayInterval.Stop()
 
@@ -104,7 +139,15 @@ func (r *Relay) relayOutput() {
 			}
 			// Clear out the buffer.
 			buffer.Reset()
-		case b := <-r.bufferChannel:
+		case b, ok := <-r.bufferChannel:
+			if !ok {
+				// The relay is closed, send what is left.
+				err = r.sendPacket(buffer.Bytes())
+				if err != nil {
+					level.Error(r.logger).Log("msg", "Error sending UDP packet", "error", err)
+				}
+				return
+			}
 			if uint(len(b)+buffer.Len()) > r.packetLength {
 				level.Debug(r.logger).Log("msg", "Buffer full, sending packet", "length", buffer.Len())
 				err = r.sendPacket(buffer.Bytes())
@@ -153,3 +196,10 @@ func (r *Relay) RelayLine(l string) {
 	}
 	r.bufferChannel <- []byte(l)
 }
+
+// Close sends the lines that are still buffered to the relay target and stops
+// the relay. Lines must not be relayed after Close.
+func (r *Relay) Close() {
+	close(r.bufferChannel)
+	<-r.done
+}
@@ -0,0 +1,255 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus/statsd_exporter/pkg/acl"
+	"github.com/prometheus/statsd_exporter/pkg/compression"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/ratelimit"
+	"github.com/prometheus/statsd_exporter/pkg/relay"
+)
+
+// metrics are the metrics the server exposes about itself.
+type metrics struct {
+	eventStats             *prometheus.CounterVec
+	eventsFlushed          prometheus.Counter
+	eventQueue             event.QueueMetrics
+	eventQueueLength       prometheus.GaugeFunc
+	eventsUnmapped         prometheus.Counter
+	udpPackets             prometheus.Counter
+	tcpConnections         prometheus.Counter
+	tcpErrors              prometheus.Counter
+	tcpLineTooLong         prometheus.Counter
+	tcpOpenConnections     prometheus.Gauge
+	tcpConnectionsRejected prometheus.Counter
+	tcpIdleTimeouts        prometheus.Counter
+	proxyProtocolRejected  *prometheus.CounterVec
+	unixgramPackets        prometheus.Counter
+	unixConnections        prometheus.Counter
+	unixErrors             prometheus.Counter
+	unixLineTooLong        prometheus.Counter
+	linesReceived          prometheus.Counter
+	samplesReceived        prometheus.Counter
+	sampleErrors           *prometheus.CounterVec
+	tagsReceived           prometheus.Counter
+	tagErrors              prometheus.Counter
+	mappingsCount          prometheus.Gauge
+	conflictingEventStats  *prometheus.CounterVec
+	conflictsResolved      *prometheus.CounterVec
+	errorEventStats        *prometheus.CounterVec
+	eventsActions          *prometheus.CounterVec
+	metricsCount           *prometheus.GaugeVec
+	relay                  *relay.Metrics
+	rateLimit              *ratelimit.Metrics
+	acl                    *acl.Metrics
+	compression            *compression.Metrics
+}
+
+// newMetrics creates the metrics of a server. queueLength returns the
+// number of event batches waiting for the exporter.
+func newMetrics(reg prometheus.Registerer, queueLength func() float64) *metrics {
+	f := promauto.With(reg)
+	return &metrics{
+		eventStats: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_total",
+				Help: "The total number of StatsD events seen.",
+			},
+			[]string{"type"},
+		),
+		eventsFlushed: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_event_queue_flushed_total",
+				Help: "Number of times events were flushed to exporter",
+			},
+		),
+		eventQueue: event.QueueMetrics{
+			BlockedSeconds: f.NewCounter(
+				prometheus.CounterOpts{
+					Name: "statsd_exporter_event_queue_blocked_seconds_total",
+					Help: "Time spent waiting for the exporter to accept events.",
+				},
+			),
+			EventsDropped: f.NewCounter(
+				prometheus.CounterOpts{
+					Name: "statsd_exporter_event_queue_dropped_events_total",
+					Help: "Number of events dropped by the event queue overflow policy.",
+				},
+			),
+		},
+		eventQueueLength: f.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_event_queue_length",
+				Help: "Number of event batches waiting for the exporter.",
+			},
+			queueLength,
+		),
+		eventsUnmapped: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_unmapped_total",
+				Help: "The total number of StatsD events no mapping was found for.",
+			}),
+		udpPackets: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_udp_packets_total",
+				Help: "The total number of StatsD packets received over UDP.",
+			},
+		),
+		tcpConnections: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connections_total",
+				Help: "The total number of TCP connections handled.",
+			},
+		),
+		tcpErrors: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connection_errors_total",
+				Help: "The number of errors encountered reading from TCP.",
+			},
+		),
+		tcpLineTooLong: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_too_long_lines_total",
+				Help: "The number of lines discarded due to being too long.",
+			},
+		),
+		tcpOpenConnections: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_tcp_open_connections",
+				Help: "The number of open TCP connections.",
+			},
+		),
+		tcpConnectionsRejected: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connections_rejected_total",
+				Help: "The number of TCP connections closed because the maximum number of connections was open.",
+			},
+		),
+		tcpIdleTimeouts: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_idle_timeouts_total",
+				Help: "The number of TCP connections closed for being idle.",
+			},
+		),
+		proxyProtocolRejected: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_proxy_protocol_rejected_total",
+				Help: "The number of connections and packets rejected by the PROXY protocol handling.",
+			},
+			[]string{"proto", "reason"},
+		),
+		unixgramPackets: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unixgram_packets_total",
+				Help: "The total number of StatsD packets received over Unixgram.",
+			},
+		),
+		unixConnections: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_connections_total",
+				Help: "The total number of Unix stream connections handled.",
+			},
+		),
+		unixErrors: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_connection_errors_total",
+				Help: "The number of errors encountered reading from Unix stream connections.",
+			},
+		),
+		unixLineTooLong: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_too_long_lines_total",
+				Help: "The number of lines from Unix stream connections discarded due to being too long.",
+			},
+		),
+		linesReceived: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_lines_total",
+				Help: "The total number of StatsD lines received.",
+			},
+		),
+		samplesReceived: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_samples_total",
+				Help: "The total number of StatsD samples received.",
+			},
+		),
+		sampleErrors: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_sample_errors_total",
+				Help: "The total number of errors parsing StatsD samples.",
+			},
+			[]string{"reason"},
+		),
+		tagsReceived: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tags_total",
+				Help: "The total number of DogStatsD tags processed.",
+			},
+		),
+		tagErrors: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tag_errors_total",
+				Help: "The number of errors parsing DogStatsD tags.",
+			},
+		),
+		mappingsCount: f.NewGauge(prometheus.GaugeOpts{
+			Name: "statsd_exporter_loaded_mappings",
+			Help: "The current number of configured metric mappings.",
+		}),
+		conflictingEventStats: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_conflict_total",
+				Help: "The total number of StatsD events with conflicting names.",
+			},
+			[]string{"type"},
+		),
+		conflictsResolved: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_conflict_resolved_total",
+				Help: "The total number of StatsD events with conflicting names recorded by a conflict strategy.",
+			},
+			[]string{"strategy"},
+		),
+		errorEventStats: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_error_total",
+				Help: "The total number of StatsD events discarded due to errors.",
+			},
+			[]string{"reason"},
+		),
+		eventsActions: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_actions_total",
+				Help: "The total number of StatsD events by action.",
+			},
+			[]string{"action"},
+		),
+		metricsCount: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_metrics_total",
+				Help: "The total number of metrics.",
+			},
+			[]string{"type"},
+		),
+		relay:       relay.NewMetrics(reg),
+		rateLimit:   ratelimit.NewMetrics(reg),
+		acl:         acl.NewMetrics(reg),
+		compression: compression.NewMetrics(reg),
+	}
+}
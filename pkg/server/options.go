@@ -0,0 +1,334 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// Options configure a Server. The defaults match the defaults of the
+// statsd_exporter command line flags.
+type Options struct {
+	// Registerer registers the metrics translated from StatsD as well as
+	// the metrics about the server itself.
+	Registerer prometheus.Registerer
+	Logger     log.Logger
+
+	// UDPAddress, TCPAddress, UnixgramPath and UnixPath are where StatsD
+	// lines are received. An empty value disables the listener, but at
+	// least one has to be set.
+	UDPAddress   string
+	TCPAddress   string
+	UnixgramPath string
+	UnixPath     string
+	// UnixSocketMode is the permission mode of the Unixgram and Unix
+	// stream sockets.
+	UnixSocketMode os.FileMode
+	// ListenerFiles are sockets that were opened for the server, for
+	// example by systemd socket activation, by the listener they are for:
+	// "udp", "tcp", "unixgram" or "unix". They take the place of the
+	// address or path of that listener, and are closed by Start. Inherited
+	// Unix sockets are not removed on shutdown.
+	ListenerFiles map[string]*os.File
+	// ListenerFilesOwned is set if ListenerFiles were handed over by a
+	// previous process of the exporter. Unix sockets among them that are at
+	// the configured path of their listener are then removed on shutdown,
+	// like the sockets the server creates itself.
+	ListenerFilesOwned bool
+	// ReadBuffer is the size of the operating system's read buffer for the
+	// UDP and Unixgram sockets. 0 keeps the operating system's default.
+	ReadBuffer int
+	// MaxLineLength is the maximum length of lines on TCP and Unix stream
+	// connections. Longer lines are skipped.
+	MaxLineLength int
+
+	// TCPMaxConnections, if positive, limits the number of open TCP
+	// connections. TCPIdleTimeout, if positive, closes TCP connections that
+	// send nothing for that long. TCPKeepAlive is the period of TCP
+	// keepalive probes, 0 keeps Go's default and a negative value disables
+	// them.
+	TCPMaxConnections int
+	TCPIdleTimeout    time.Duration
+	TCPKeepAlive      time.Duration
+
+	// ProxyProtocolTCP and ProxyProtocolUDP make the TCP and UDP listeners
+	// accept PROXY protocol headers from the networks in
+	// ProxyProtocolTrusted, in CIDR notation, which must not be empty.
+	// Connections and packets with a header from other addresses are
+	// rejected.
+	ProxyProtocolTCP     bool
+	ProxyProtocolUDP     bool
+	ProxyProtocolTrusted []string
+
+	// Compression makes all listeners accept gzip compressed payloads. A
+	// compressed datagram may decompress to at most CompressionMaxSize
+	// bytes. A compressed stream may decompress to at most
+	// CompressionMaxSize bytes plus CompressionMaxRatio times its
+	// compressed size.
+	Compression         bool
+	CompressionMaxSize  int
+	CompressionMaxRatio float64
+
+	// ACLConfig is the name of the ACL configuration file, which restricts
+	// who may send to the listeners. If empty, everyone may.
+	ACLConfig string
+
+	// RateLimitConfig is the name of the rate limit configuration file. If
+	// empty, lines are not rate limited.
+	RateLimitConfig string
+
+	// SourceLabels is how the senders of events are named for the
+	// source_label of mappings: "ip" by their IP address, "hostname" by
+	// their host name, or "" or "none" to not record senders at all.
+	// Unixgram senders are named by their user ID, as "uid:1000", on Linux.
+	SourceLabels string
+
+	// Parser parses the received lines into events.
+	Parser listener.Parser
+
+	// MappingConfig is the name of the mapping configuration file. If empty,
+	// all metrics are unmapped.
+	MappingConfig string
+	// CacheSize is the size of the mapping cache, 0 disables it. CacheType
+	// is "lru" or "random".
+	CacheSize int
+	CacheType string
+
+	// EventQueueSize is the number of event batches that can wait for the
+	// exporter. Events are flushed to it in batches of FlushThreshold, or
+	// every FlushInterval.
+	EventQueueSize      uint
+	EventFlushThreshold int
+	EventFlushInterval  time.Duration
+	// EventQueueOverflow is what happens to events when the queue is full.
+	EventQueueOverflow event.OverflowPolicy
+
+	// Shards is the number of workers that map and record events in
+	// parallel, each owning a partition of the metrics.
+	Shards int
+
+	// UnmappedTrackerSize is the number of most frequent unmapped metrics
+	// to keep track of. 0 disables tracking.
+	UnmappedTrackerSize int
+
+	// SnapshotFile, if set, is where the state of all metrics is persisted
+	// every SnapshotInterval and on shutdown, and restored from on start.
+	SnapshotFile     string
+	SnapshotInterval time.Duration
+
+	// RelayAddress, if set, is the UDP address all received lines are
+	// relayed to, in packets of at most RelayPacketLength bytes.
+	RelayAddress      string
+	RelayPacketLength uint
+}
+
+// Option changes the Options of a Server.
+type Option func(*Options)
+
+// DefaultOptions returns the options of a Server that no Option is applied
+// to.
+func DefaultOptions() Options {
+	return Options{
+		Registerer:          prometheus.DefaultRegisterer,
+		Logger:              log.NewNopLogger(),
+		UDPAddress:          ":9125",
+		TCPAddress:          ":9125",
+		UnixSocketMode:      0755,
+		MaxLineLength:       listener.DefaultMaxLineLength,
+		CacheSize:           1000,
+		CacheType:           "lru",
+		EventQueueSize:      10000,
+		EventFlushThreshold: 1000,
+		EventFlushInterval:  200 * time.Millisecond,
+		EventQueueOverflow:  event.OverflowBlock,
+		Shards:              1,
+		UnmappedTrackerSize: 100,
+		SnapshotInterval:    time.Minute,
+		RelayPacketLength:   1400,
+		CompressionMaxSize:  1 << 20,
+		CompressionMaxRatio: 100,
+	}
+}
+
+// WithRegisterer sets the registerer for all metrics of the server.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *Options) { o.Registerer = reg }
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// WithUDPAddress sets the UDP listen address. "" disables the listener.
+func WithUDPAddress(addr string) Option {
+	return func(o *Options) { o.UDPAddress = addr }
+}
+
+// WithTCPAddress sets the TCP listen address. "" disables the listener.
+func WithTCPAddress(addr string) Option {
+	return func(o *Options) { o.TCPAddress = addr }
+}
+
+// WithUnixgramPath sets the path and permission mode of the Unixgram socket.
+// An empty path disables the listener.
+func WithUnixgramPath(path string, mode os.FileMode) Option {
+	return func(o *Options) {
+		o.UnixgramPath = path
+		o.UnixSocketMode = mode
+	}
+}
+
+// WithUnixPath sets the path and permission mode of the Unix stream socket.
+// An empty path disables the listener.
+func WithUnixPath(path string, mode os.FileMode) Option {
+	return func(o *Options) {
+		o.UnixPath = path
+		o.UnixSocketMode = mode
+	}
+}
+
+// WithListenerFiles sets the inherited sockets of the listeners.
+func WithListenerFiles(files map[string]*os.File) Option {
+	return func(o *Options) { o.ListenerFiles = files }
+}
+
+// WithListenerFilesOwned sets whether the inherited sockets were handed
+// over by a previous process of the exporter.
+func WithListenerFilesOwned(owned bool) Option {
+	return func(o *Options) { o.ListenerFilesOwned = owned }
+}
+
+// WithReadBuffer sets the read buffer size of the UDP and Unixgram sockets.
+func WithReadBuffer(size int) Option {
+	return func(o *Options) { o.ReadBuffer = size }
+}
+
+// WithMaxLineLength sets the maximum length of lines on TCP and Unix stream
+// connections.
+func WithMaxLineLength(n int) Option {
+	return func(o *Options) { o.MaxLineLength = n }
+}
+
+// WithTCPLimits sets the maximum number of open TCP connections, the idle
+// timeout and the keepalive period of TCP connections.
+func WithTCPLimits(maxConnections int, idleTimeout, keepAlive time.Duration) Option {
+	return func(o *Options) {
+		o.TCPMaxConnections = maxConnections
+		o.TCPIdleTimeout = idleTimeout
+		o.TCPKeepAlive = keepAlive
+	}
+}
+
+// WithCompression makes the listeners accept compressed payloads, within
+// the given limits.
+func WithCompression(enabled bool, maxSize int, maxRatio float64) Option {
+	return func(o *Options) {
+		o.Compression = enabled
+		o.CompressionMaxSize = maxSize
+		o.CompressionMaxRatio = maxRatio
+	}
+}
+
+// WithProxyProtocol makes the TCP and UDP listeners accept PROXY protocol
+// headers from the trusted networks.
+func WithProxyProtocol(tcp, udp bool, trusted []string) Option {
+	return func(o *Options) {
+		o.ProxyProtocolTCP = tcp
+		o.ProxyProtocolUDP = udp
+		o.ProxyProtocolTrusted = trusted
+	}
+}
+
+// WithACLConfig sets the ACL configuration file.
+func WithACLConfig(fileName string) Option {
+	return func(o *Options) { o.ACLConfig = fileName }
+}
+
+// WithRateLimitConfig sets the rate limit configuration file.
+func WithRateLimitConfig(fileName string) Option {
+	return func(o *Options) { o.RateLimitConfig = fileName }
+}
+
+// WithSourceLabels sets how the senders of events are named, "ip" or
+// "hostname".
+func WithSourceLabels(naming string) Option {
+	return func(o *Options) { o.SourceLabels = naming }
+}
+
+// WithParser sets the line parser.
+func WithParser(p listener.Parser) Option {
+	return func(o *Options) { o.Parser = p }
+}
+
+// WithMappingConfig sets the mapping configuration file.
+func WithMappingConfig(fileName string) Option {
+	return func(o *Options) { o.MappingConfig = fileName }
+}
+
+// WithCache sets the size and type of the mapping cache.
+func WithCache(size int, cacheType string) Option {
+	return func(o *Options) {
+		o.CacheSize = size
+		o.CacheType = cacheType
+	}
+}
+
+// WithEventQueue sets the size and flush behaviour of the event queue.
+func WithEventQueue(size uint, flushThreshold int, flushInterval time.Duration) Option {
+	return func(o *Options) {
+		o.EventQueueSize = size
+		o.EventFlushThreshold = flushThreshold
+		o.EventFlushInterval = flushInterval
+	}
+}
+
+// WithEventQueueOverflow sets what happens to events when the event queue
+// is full.
+func WithEventQueueOverflow(policy event.OverflowPolicy) Option {
+	return func(o *Options) { o.EventQueueOverflow = policy }
+}
+
+// WithShards sets the number of workers that handle events in parallel.
+func WithShards(n int) Option {
+	return func(o *Options) { o.Shards = n }
+}
+
+// WithUnmappedTracker sets the number of unmapped metrics to keep track of.
+func WithUnmappedTracker(size int) Option {
+	return func(o *Options) { o.UnmappedTrackerSize = size }
+}
+
+// WithSnapshot persists the state of all metrics to fileName.
+func WithSnapshot(fileName string, interval time.Duration) Option {
+	return func(o *Options) {
+		o.SnapshotFile = fileName
+		o.SnapshotInterval = interval
+	}
+}
+
+// WithRelay relays all received lines to the UDP address addr.
+func WithRelay(addr string, packetLength uint) Option {
+	return func(o *Options) {
+		o.RelayAddress = addr
+		o.RelayPacketLength = packetLength
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server assembles the listeners, the event queue, the mapper and the
+// exporter into a StatsD server that can be embedded into other programs.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/acl"
+	"github.com/prometheus/statsd_exporter/pkg/address"
+	"github.com/prometheus/statsd_exporter/pkg/compression"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/exporter"
+	"github.com/prometheus/statsd_exporter/pkg/level"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/mappercache/lru"
+	"github.com/prometheus/statsd_exporter/pkg/mappercache/randomreplacement"
+	"github.com/prometheus/statsd_exporter/pkg/ratelimit"
+	"github.com/prometheus/statsd_exporter/pkg/relay"
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+	"github.com/prometheus/statsd_exporter/pkg/unmapped"
+)
+
+// Server receives StatsD lines and exposes them as Prometheus metrics.
+type Server struct {
+	options  Options
+	metrics  *metrics
+	mapper   *mapper.MetricMapper
+	exporter *exporter.Exporter
+	// acl is nil without an ACL configuration.
+	acl *acl.ACL
+	// rateLimiter is nil without a rate limit configuration.
+	rateLimiter *ratelimit.Limiter
+	// sourceNamer is nil if the senders of events are not recorded.
+	sourceNamer listener.SourceNamer
+	// proxyProtocol is nil if no listener accepts PROXY protocol headers.
+	proxyProtocol *listener.ProxyProtocol
+	// decompressor is nil if compressed payloads are not accepted.
+	decompressor *compression.Decompressor
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+
+	events       chan event.Events
+	eventQueue   *event.EventQueue
+	relay        *relay.Relay
+	exporterDone chan struct{}
+
+	// listeners tracks the goroutines reading from listenerConns, which
+	// are keyed by listener. They run until stopListeners is called, or
+	// fail with an error sent to listenerErrors.
+	listeners      sync.WaitGroup
+	listenerConns  map[string]listenerConn
+	stopListeners  context.CancelFunc
+	listenerErrors chan error
+	// unixgramPath is the Unixgram socket to remove on shutdown.
+	unixgramPath string
+	// keepSockets is set if the sockets were handed over to another
+	// process, which still uses them after shutdown.
+	keepSockets bool
+	// initialSnapshot, if set, is restored on start instead of the
+	// snapshot file.
+	initialSnapshot *snapshot.Snapshot
+}
+
+// New creates a server and loads its mapping configuration. It does not
+// receive any StatsD traffic until it is started.
+func New(opts ...Option) (*Server, error) {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultOptions().Logger
+	}
+	if o.Parser == nil {
+		p := line.NewParser()
+		p.EnableDogstatsdParsing()
+		p.EnableInfluxdbParsing()
+		p.EnableLibratoParsing()
+		p.EnableSignalFXParsing()
+		o.Parser = p
+	}
+
+	if _, err := event.ParseOverflowPolicy(string(o.EventQueueOverflow)); err != nil {
+		return nil, err
+	}
+	if err := validateListenerFiles(o.ListenerFiles); err != nil {
+		return nil, err
+	}
+	if o.MaxLineLength <= 0 {
+		return nil, fmt.Errorf("invalid maximum line length %d", o.MaxLineLength)
+	}
+
+	s := &Server{
+		options: o,
+		events:  make(chan event.Events, o.EventQueueSize),
+		// Each of the up to four listeners fails at most once.
+		listenerErrors: make(chan error, 4),
+	}
+	s.metrics = newMetrics(o.Registerer, func() float64 { return float64(len(s.events)) })
+
+	s.mapper = &mapper.MetricMapper{Registerer: o.Registerer, MappingsCount: s.metrics.mappingsCount, Logger: o.Logger}
+	cache, err := newCache(o.CacheSize, o.CacheType, o.Registerer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup metric mapper cache: %w", err)
+	}
+	s.mapper.UseCache(cache)
+	if o.MappingConfig != "" {
+		if err := s.mapper.InitFromFile(o.MappingConfig); err != nil {
+			return nil, fmt.Errorf("error loading config: %w", err)
+		}
+	}
+
+	if o.ACLConfig != "" {
+		c, err := acl.LoadConfig(o.ACLConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ACL config: %w", err)
+		}
+		s.acl = acl.New(c, s.metrics.acl)
+	}
+
+	if o.RateLimitConfig != "" {
+		c, err := ratelimit.LoadConfig(o.RateLimitConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error loading rate limit config: %w", err)
+		}
+		s.rateLimiter = ratelimit.NewLimiter(c, s.metrics.rateLimit)
+	}
+
+	if o.ProxyProtocolTCP || o.ProxyProtocolUDP {
+		trusted, err := address.NetworksFromStrings(o.ProxyProtocolTrusted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol trusted networks: %w", err)
+		}
+		if len(trusted) == 0 {
+			return nil, errors.New("the PROXY protocol requires at least one trusted network")
+		}
+		s.proxyProtocol = &listener.ProxyProtocol{
+			Trusted:  trusted,
+			Rejected: s.metrics.proxyProtocolRejected,
+			Logger:   o.Logger,
+		}
+	}
+
+	if o.Compression {
+		if o.CompressionMaxSize <= 0 || o.CompressionMaxRatio < 0 {
+			return nil, fmt.Errorf("invalid decompression limits: maximum size %d, maximum ratio %v", o.CompressionMaxSize, o.CompressionMaxRatio)
+		}
+		s.decompressor = compression.New(o.CompressionMaxSize, o.CompressionMaxRatio, s.metrics.compression)
+	}
+
+	switch o.SourceLabels {
+	case "", "none":
+	case "ip":
+		s.sourceNamer = listener.IPSourceNamer{}
+	case "hostname":
+		s.sourceNamer = listener.NewReverseDNSSourceNamer(5*time.Minute, 10000)
+	default:
+		return nil, fmt.Errorf("unsupported source label value %q", o.SourceLabels)
+	}
+
+	m := s.metrics
+	s.exporter = exporter.NewExporter(o.Registerer, s.mapper, o.Logger, m.eventsActions, m.eventsUnmapped, m.errorEventStats, m.eventStats, m.conflictingEventStats, m.metricsCount)
+	s.exporter.ConflictsResolved = m.conflictsResolved
+	s.exporter.Shards = o.Shards
+	if o.UnmappedTrackerSize > 0 {
+		s.exporter.Unmapped = unmapped.NewTracker(o.UnmappedTrackerSize)
+	}
+	s.exporter.SnapshotFile = o.SnapshotFile
+	s.exporter.SnapshotInterval = o.SnapshotInterval
+
+	return s, nil
+}
+
+func newCache(cacheSize int, cacheType string, registerer prometheus.Registerer) (mapper.MetricMapperCache, error) {
+	if cacheSize == 0 {
+		return nil, nil
+	}
+	switch cacheType {
+	case "lru":
+		return lru.NewMetricMapperLRUCache(registerer, cacheSize)
+	case "random":
+		return randomreplacement.NewMetricMapperRRCache(registerer, cacheSize)
+	default:
+		return nil, fmt.Errorf("unsupported cache type %q", cacheType)
+	}
+}
+
+// Mapper returns the mapper of the server, for example to reload its
+// configuration.
+func (s *Server) Mapper() *mapper.MetricMapper {
+	return s.mapper
+}
+
+// ACL returns the ACL of the listeners, or nil if there is no ACL
+// configuration.
+func (s *Server) ACL() *acl.ACL {
+	return s.acl
+}
+
+// LoadACL loads the ACL configuration from its file, without applying it,
+// so that it can be applied along with other configuration with
+// ACL().SetConfig. It returns nil if there is no ACL configuration.
+func (s *Server) LoadACL() (*acl.Config, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+	c, err := acl.LoadConfig(s.options.ACLConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ACL config: %w", err)
+	}
+	return c, nil
+}
+
+// ListenerFiles returns duplicates of the listening sockets of the started
+// server, by listener, for example to hand them over to another process.
+// The caller has to close them.
+func (s *Server) ListenerFiles() (map[string]*os.File, error) {
+	files := make(map[string]*os.File, len(s.listenerConns))
+	for name, conn := range s.listenerConns {
+		f, err := conn.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("%s listener: %w", name, err)
+		}
+		files[name] = f
+	}
+	return files, nil
+}
+
+// KeepSockets makes Shutdown leave the Unix sockets in place, for another
+// process that took them over.
+func (s *Server) KeepSockets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepSockets = true
+}
+
+// UseSnapshot makes Start restore snap instead of the snapshot file, for
+// example the state handed over by the process that is upgraded.
+func (s *Server) UseSnapshot(snap *snapshot.Snapshot) {
+	s.initialSnapshot = snap
+}
+
+// Exporter returns the exporter that translates the events into metrics.
+func (s *Server) Exporter() *exporter.Exporter {
+	return s.exporter
+}
+
+// Parser returns the parser of the received lines.
+func (s *Server) Parser() listener.Parser {
+	return s.options.Parser
+}
+
+// Errors returns a channel that receives the error of every listener that
+// stops receiving StatsD traffic because of it. The other listeners keep
+// running until the server is shut down.
+func (s *Server) Errors() <-chan error {
+	return s.listenerErrors
+}
+
+// Start restores the snapshot, if any, and starts receiving StatsD traffic.
+// It returns once all listeners are bound. The context limits how long
+// binding them may take. If a listener can't be started, everything that
+// has been started is shut down again.
+func (s *Server) Start(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	s.started = true
+	defer func() {
+		// A server that failed to start has nothing left to shut down.
+		s.stopped = err != nil
+	}()
+
+	o := s.options
+	if o.UDPAddress == "" && o.TCPAddress == "" && o.UnixgramPath == "" && o.UnixPath == "" && len(o.ListenerFiles) == 0 {
+		return errors.New("at least one of UDP/TCP/Unixgram/Unix listeners must be specified")
+	}
+
+	// Restore the snapshot before any listener starts, so that no event
+	// can race with it.
+	if s.initialSnapshot != nil {
+		restored, err := s.exporter.Restore(s.initialSnapshot)
+		level.Info(o.Logger).Log("msg", "Restored handed over state", "series", restored, "skipped", len(s.initialSnapshot.Series)-restored)
+		if err != nil {
+			level.Warn(o.Logger).Log("msg", "Some series could not be restored", "error", err)
+		}
+	} else if err := s.exporter.RestoreSnapshot(); err != nil {
+		level.Error(o.Logger).Log("msg", "Unable to restore snapshot, starting without it", "file", o.SnapshotFile, "error", err)
+	}
+
+	if o.RelayAddress != "" {
+		r, err := relay.NewRelayWithMetrics(o.Logger, o.RelayAddress, o.RelayPacketLength, s.metrics.relay)
+		if err != nil {
+			return fmt.Errorf("unable to create relay: %w", err)
+		}
+		s.relay = r
+	}
+
+	s.eventQueue = event.NewEventQueueWithPolicy(s.events, o.EventFlushThreshold, o.EventFlushInterval, s.metrics.eventsFlushed, o.EventQueueOverflow, s.metrics.eventQueue)
+	s.exporterDone = make(chan struct{})
+	go func() {
+		defer close(s.exporterDone)
+		s.exporter.Listen(s.events)
+	}()
+
+	if err := s.startListeners(ctx); err != nil {
+		s.shutdown(false)
+		return err
+	}
+
+	level.Info(o.Logger).Log("msg", "Accepting StatsD Traffic", "udp", o.UDPAddress, "tcp", o.TCPAddress, "unixgram", o.UnixgramPath, "unix", o.UnixPath)
+	return nil
+}
+
+func (s *Server) startListeners(ctx context.Context) error {
+	var (
+		o  = s.options
+		m  = s.metrics
+		lc net.ListenConfig
+	)
+
+	// The listeners outlive ctx, which only limits how long binding them
+	// may take.
+	listenCtx, cancel := context.WithCancel(context.Background())
+	s.stopListeners = cancel
+	s.listenerConns = map[string]listenerConn{}
+
+	uconn, err := s.udpConn(ctx, &lc)
+	if err != nil {
+		return err
+	}
+	if uconn != nil {
+		s.listenerConns["udp"] = uconn
+
+		if o.ReadBuffer != 0 {
+			if err := uconn.SetReadBuffer(o.ReadBuffer); err != nil {
+				return fmt.Errorf("error setting UDP read buffer: %w", err)
+			}
+		}
+
+		ul := &listener.StatsDUDPListener{
+			Conn:            uconn,
+			EventHandler:    s.eventQueue,
+			Logger:          o.Logger,
+			LineParser:      o.Parser,
+			UDPPackets:      m.udpPackets,
+			LinesReceived:   m.linesReceived,
+			EventsFlushed:   m.eventsFlushed,
+			Relay:           s.relay,
+			SampleErrors:    *m.sampleErrors,
+			SamplesReceived: m.samplesReceived,
+			TagErrors:       m.tagErrors,
+			TagsReceived:    m.tagsReceived,
+			RateLimiter:     s.rateLimiter,
+			SourceNamer:     s.sourceNamer,
+			ACL:             s.acl,
+			Decompressor:    s.decompressor,
+		}
+		if o.ProxyProtocolUDP {
+			ul.ProxyProtocol = s.proxyProtocol
+		}
+		s.startListener(listenCtx, "udp", ul.Listen)
+	}
+
+	tconn, err := s.tcpListener(ctx, &lc)
+	if err != nil {
+		return err
+	}
+	if tconn != nil {
+		s.listenerConns["tcp"] = tconn
+
+		tl := &listener.StatsDTCPListener{
+			Conn:            tconn,
+			EventHandler:    s.eventQueue,
+			Logger:          o.Logger,
+			LineParser:      o.Parser,
+			LinesReceived:   m.linesReceived,
+			EventsFlushed:   m.eventsFlushed,
+			Relay:           s.relay,
+			SampleErrors:    *m.sampleErrors,
+			SamplesReceived: m.samplesReceived,
+			TagErrors:       m.tagErrors,
+			TagsReceived:    m.tagsReceived,
+			TCPConnections:  m.tcpConnections,
+			TCPErrors:       m.tcpErrors,
+			TCPLineTooLong:  m.tcpLineTooLong,
+			RateLimiter:     s.rateLimiter,
+			SourceNamer:     s.sourceNamer,
+			ACL:             s.acl,
+			Decompressor:    s.decompressor,
+
+			TCPOpenConnections:     m.tcpOpenConnections,
+			TCPConnectionsRejected: m.tcpConnectionsRejected,
+			TCPIdleTimeouts:        m.tcpIdleTimeouts,
+			MaxLineLength:          o.MaxLineLength,
+			MaxConnections:         o.TCPMaxConnections,
+			IdleTimeout:            o.TCPIdleTimeout,
+			KeepAlive:              o.TCPKeepAlive,
+		}
+		if o.ProxyProtocolTCP {
+			tl.ProxyProtocol = s.proxyProtocol
+		}
+		s.startListener(listenCtx, "tcp", tl.Listen)
+	}
+
+	uxgconn, err := s.unixgramConn(ctx, &lc)
+	if err != nil {
+		return err
+	}
+	if uxgconn != nil {
+		s.listenerConns["unixgram"] = uxgconn
+
+		if o.ReadBuffer != 0 {
+			if err := uxgconn.SetReadBuffer(o.ReadBuffer); err != nil {
+				return fmt.Errorf("error setting Unixgram read buffer: %w", err)
+			}
+		}
+
+		if s.acl != nil || (s.rateLimiter != nil && s.rateLimiter.KeyType() == ratelimit.KeyTypeSource) || s.sourceNamer != nil {
+			if err := listener.EnablePeerCredentials(uxgconn); err != nil {
+				level.Warn(o.Logger).Log("msg", "Unable to identify Unixgram senders by user", "error", err)
+			}
+		}
+
+		ul := &listener.StatsDUnixgramListener{
+			Conn:            uxgconn,
+			EventHandler:    s.eventQueue,
+			Logger:          o.Logger,
+			LineParser:      o.Parser,
+			UnixgramPackets: m.unixgramPackets,
+			LinesReceived:   m.linesReceived,
+			EventsFlushed:   m.eventsFlushed,
+			Relay:           s.relay,
+			SampleErrors:    *m.sampleErrors,
+			SamplesReceived: m.samplesReceived,
+			TagErrors:       m.tagErrors,
+			TagsReceived:    m.tagsReceived,
+			RateLimiter:     s.rateLimiter,
+			SourceNamer:     s.sourceNamer,
+			ACL:             s.acl,
+			Decompressor:    s.decompressor,
+		}
+		s.startListener(listenCtx, "unixgram", ul.Listen)
+	}
+
+	uxconn, err := s.unixListener(ctx, &lc)
+	if err != nil {
+		return err
+	}
+	if uxconn != nil {
+		s.listenerConns["unix"] = uxconn
+
+		ul := &listener.StatsDUnixListener{
+			Conn:            uxconn,
+			EventHandler:    s.eventQueue,
+			Logger:          o.Logger,
+			LineParser:      o.Parser,
+			LinesReceived:   m.linesReceived,
+			EventsFlushed:   m.eventsFlushed,
+			Relay:           s.relay,
+			SampleErrors:    *m.sampleErrors,
+			SamplesReceived: m.samplesReceived,
+			TagErrors:       m.tagErrors,
+			TagsReceived:    m.tagsReceived,
+			UnixConnections: m.unixConnections,
+			UnixErrors:      m.unixErrors,
+			UnixLineTooLong: m.unixLineTooLong,
+			MaxLineLength:   o.MaxLineLength,
+			Decompressor:    s.decompressor,
+			RateLimiter:     s.rateLimiter,
+			SourceNamer:     s.sourceNamer,
+			ACL:             s.acl,
+		}
+		s.startListener(listenCtx, "unix", ul.Listen)
+	}
+
+	return nil
+}
+
+// startListener runs listen until the listeners are stopped on shutdown.
+func (s *Server) startListener(ctx context.Context, proto string, listen func(context.Context) error) {
+	s.listeners.Add(1)
+	go func() {
+		defer s.listeners.Done()
+		if err := listen(ctx); err != nil {
+			level.Error(s.options.Logger).Log("msg", "Listener failed", "proto", proto, "error", err)
+			s.listenerErrors <- fmt.Errorf("%s listener: %w", proto, err)
+		}
+	}()
+}
+
+// Shutdown stops receiving StatsD traffic and waits until all events that
+// have been received are exported, the final snapshot is written, and the
+// relay is flushed. If the context expires first, Shutdown returns its
+// error, and the shutdown continues in the background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started || s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	keepSockets := s.keepSockets
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.shutdown(keepSockets)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops everything Start has started, in the order in which no
+// event is lost. If keepSockets is set, the Unix sockets are left in place.
+func (s *Server) shutdown(keepSockets bool) {
+	// Stop accepting StatsD traffic, and wait until everything that has been
+	// received is queued.
+	if s.stopListeners != nil {
+		s.stopListeners()
+	}
+	s.listeners.Wait()
+	if ul, ok := s.listenerConns["unix"].(*net.UnixListener); ok && keepSockets {
+		ul.SetUnlinkOnClose(false)
+	}
+	for _, conn := range s.listenerConns {
+		conn.Close()
+	}
+	if s.unixgramPath != "" && !keepSockets {
+		os.Remove(s.unixgramPath)
+	}
+
+	// Hand the remaining events to the exporter, and wait until it has
+	// processed them. It writes the final snapshot before returning.
+	s.eventQueue.Close()
+	close(s.events)
+	<-s.exporterDone
+
+	if s.relay != nil {
+		s.relay.Close()
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+	streamSocket := filepath.Join(dir, "statsd_stream.sock")
+
+	reg := prometheus.NewRegistry()
+	s, err := New(
+		WithRegisterer(reg),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+		WithUnixgramPath(socket, 0700),
+		WithUnixPath(streamSocket, 0700),
+		// Events are only flushed to the exporter by Shutdown.
+		WithEventQueue(10, 1000, time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("foo:3|c\nbar:2|g")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if fi, err := os.Stat(streamSocket); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("expected the stream socket to have mode 0700, got %v", err)
+	}
+	conn, err = net.Dial("unix", streamSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("baz:1|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Datagrams that are still in the socket buffer are lost on shutdown,
+	// so wait until the lines are queued.
+	for i := 0; testutil.ToFloat64(s.metrics.linesReceived) < 3; i++ {
+		if i == 100 {
+			t.Fatal("lines were not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The lines have not been flushed to the exporter yet, Shutdown has to
+	// process them.
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{socket, streamSocket} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, mf := range metrics {
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.Counter != nil:
+				values[mf.GetName()] += m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[mf.GetName()] += m.GetGauge().GetValue()
+			}
+		}
+	}
+	expected := map[string]float64{
+		"foo":                                    3,
+		"bar":                                    2,
+		"baz":                                    1,
+		"statsd_exporter_unixgram_packets_total": 1,
+		"statsd_exporter_unix_connections_total": 1,
+		"statsd_exporter_lines_total":            3,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, values[name])
+		}
+	}
+}
+
+func TestServerStartErrors(t *testing.T) {
+	s, err := New(
+		WithRegisterer(prometheus.NewRegistry()),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected an error without listeners")
+	}
+	// There is nothing to shut down.
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithCache(10, "unknown")); err == nil {
+		t.Fatal("expected an error for an unknown cache type")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithEventQueueOverflow("unknown")); err == nil {
+		t.Fatal("expected an error for an unknown overflow policy")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithSourceLabels("dns")); err == nil {
+		t.Fatal("expected an error for an unknown source label value")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithProxyProtocol(true, false, []string{"10.0.0.0/33"})); err == nil {
+		t.Fatal("expected an error for an invalid trusted network")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithProxyProtocol(true, false, nil)); err == nil {
+		t.Fatal("expected an error for the PROXY protocol without trusted networks")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithMaxLineLength(0)); err == nil {
+		t.Fatal("expected an error for an invalid maximum line length")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithCompression(true, 0, 100)); err == nil {
+		t.Fatal("expected an error for an invalid maximum decompressed size")
+	}
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithACLConfig("/nonexistent/acl.yml")); err == nil {
+		t.Fatal("expected an error for a missing ACL config")
+	}
+}
+
+func TestServerListenerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	// Open the sockets like systemd would, and only keep their files.
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.Close()
+	unixgramConn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixgramFile, err := unixgramConn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixgramConn.Close()
+
+	reg := prometheus.NewRegistry()
+	s, err := New(
+		WithRegisterer(reg),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+		WithListenerFiles(map[string]*os.File{"udp": udpFile, "unixgram": unixgramFile}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []struct{ network, address string }{{"udp", udpConn.LocalAddr().String()}, {"unixgram", socket}} {
+		conn, err := net.Dial(addr.network, addr.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("foo:1|c")); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	for i := 0; testutil.ToFloat64(s.metrics.linesReceived) < 2; i++ {
+		if i == 100 {
+			t.Fatal("lines were not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The inherited socket belongs to whoever passed it.
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("expected the inherited socket to be kept, got %v", err)
+	}
+}
+
+func TestServerHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	send := func() {
+		t.Helper()
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("foo:1|c")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForLine := func(s *Server) {
+		t.Helper()
+		for i := 0; testutil.ToFloat64(s.metrics.linesReceived) < 1; i++ {
+			if i == 100 {
+				t.Fatal("line was not received")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	old, err := New(
+		WithRegisterer(prometheus.NewRegistry()),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+		WithUnixgramPath(socket, 0o755),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	waitForLine(old)
+
+	files, err := old.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["unixgram"] == nil {
+		t.Fatalf("expected the unixgram socket, got %v", files)
+	}
+	old.KeepSockets()
+	if err := old.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("expected the handed over socket to be kept, got %v", err)
+	}
+	// Traffic is buffered by the socket until the new server starts.
+	send()
+
+	s, err := New(
+		WithRegisterer(prometheus.NewRegistry()),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+		WithUnixgramPath(socket, 0o755),
+		WithListenerFiles(files),
+		WithListenerFilesOwned(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseSnapshot(old.Exporter().Snapshot())
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitForLine(s)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	state := s.Exporter().Snapshot()
+	if len(state.Series) != 1 || state.Series[0].Value != 2 {
+		t.Fatalf("expected foo to be 2, got %+v", state.Series)
+	}
+	// The socket at the configured path belongs to the new server.
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestServerListenerFilesErrors(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	file := func() *os.File {
+		t.Helper()
+		f, err := l.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	if _, err := New(WithRegisterer(prometheus.NewRegistry()), WithListenerFiles(map[string]*os.File{"http": file()})); err == nil {
+		t.Fatal("expected an error for an unknown listener name")
+	}
+
+	s, err := New(
+		WithRegisterer(prometheus.NewRegistry()),
+		WithUDPAddress(""),
+		WithTCPAddress(""),
+		WithListenerFiles(map[string]*os.File{"udp": file()}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected an error for a TCP socket passed as the UDP socket")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/prometheus/statsd_exporter/pkg/address"
+	"github.com/prometheus/statsd_exporter/pkg/level"
+)
+
+// listenerConn is a listening socket.
+type listenerConn interface {
+	Close() error
+	File() (*os.File, error)
+}
+
+// listenerRoles are the names of the listeners that inherited sockets can
+// be passed for.
+var listenerRoles = []string{"udp", "tcp", "unixgram", "unix"}
+
+func validateListenerFiles(files map[string]*os.File) error {
+	for name := range files {
+		valid := false
+		for _, role := range listenerRoles {
+			valid = valid || name == role
+		}
+		if !valid {
+			return fmt.Errorf("inherited socket %q: the name must be one of %v", name, listenerRoles)
+		}
+	}
+	return nil
+}
+
+// inheritedPacketConn returns the inherited packet socket for role, or nil
+// if there is none. The file itself is closed.
+func (s *Server) inheritedPacketConn(role string) (net.PacketConn, error) {
+	f := s.options.ListenerFiles[role]
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited %s socket: %w", role, err)
+	}
+	return pc, nil
+}
+
+// inheritedListener returns the inherited stream socket for role, or nil if
+// there is none. The file itself is closed.
+func (s *Server) inheritedListener(role string) (net.Listener, error) {
+	f := s.options.ListenerFiles[role]
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited %s socket: %w", role, err)
+	}
+	return l, nil
+}
+
+// udpConn returns the inherited UDP socket, or opens one on UDPAddress. It
+// returns nil if the listener is disabled.
+func (s *Server) udpConn(ctx context.Context, lc *net.ListenConfig) (*net.UDPConn, error) {
+	o := s.options
+	pc, err := s.inheritedPacketConn("udp")
+	switch {
+	case err != nil:
+		return nil, err
+	case pc != nil:
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, errors.New("inherited udp socket is not a UDP socket")
+		}
+		return conn, nil
+	case o.UDPAddress == "":
+		return nil, nil
+	}
+
+	udpListenAddr, err := address.UDPAddrFromString(o.UDPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP listen address %q: %w", o.UDPAddress, err)
+	}
+	pc, err = lc.ListenPacket(ctx, "udp", udpListenAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// tcpListener returns the inherited TCP socket, or opens one on TCPAddress.
+// It returns nil if the listener is disabled.
+func (s *Server) tcpListener(ctx context.Context, lc *net.ListenConfig) (*net.TCPListener, error) {
+	o := s.options
+	l, err := s.inheritedListener("tcp")
+	switch {
+	case err != nil:
+		return nil, err
+	case l != nil:
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, errors.New("inherited tcp socket is not a TCP socket")
+		}
+		return tl, nil
+	case o.TCPAddress == "":
+		return nil, nil
+	}
+
+	tcpListenAddr, err := address.TCPAddrFromString(o.TCPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TCP listen address %q: %w", o.TCPAddress, err)
+	}
+	l, err = lc.Listen(ctx, "tcp", tcpListenAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start TCP listener: %w", err)
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// unixgramConn returns the inherited Unixgram socket, or creates one at
+// UnixgramPath. It returns nil if the listener is disabled. Only a socket
+// that it created, or that is owned according to ListenerFilesOwned, is
+// removed on shutdown.
+func (s *Server) unixgramConn(ctx context.Context, lc *net.ListenConfig) (*net.UnixConn, error) {
+	o := s.options
+	pc, err := s.inheritedPacketConn("unixgram")
+	switch {
+	case err != nil:
+		return nil, err
+	case pc != nil:
+		conn, ok := pc.(*net.UnixConn)
+		if addr, _ := pc.LocalAddr().(*net.UnixAddr); !ok || addr == nil || addr.Net != "unixgram" {
+			pc.Close()
+			return nil, errors.New("inherited unixgram socket is not a Unixgram socket")
+		} else if o.ListenerFilesOwned && addr.Name == o.UnixgramPath {
+			s.unixgramPath = o.UnixgramPath
+		}
+		return conn, nil
+	case o.UnixgramPath == "":
+		return nil, nil
+	}
+
+	if _, err := os.Stat(o.UnixgramPath); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unixgram socket %s already exists", o.UnixgramPath)
+	}
+	pc, err = lc.ListenPacket(ctx, "unixgram", o.UnixgramPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on Unixgram socket: %w", err)
+	}
+
+	// if it's an abstract unix domain socket, it won't exist on fs
+	// so we can't chmod it either
+	if _, err := os.Stat(o.UnixgramPath); !os.IsNotExist(err) {
+		s.unixgramPath = o.UnixgramPath
+		if err := os.Chmod(o.UnixgramPath, o.UnixSocketMode); err != nil {
+			level.Warn(o.Logger).Log("msg", "Failed to change unixgram socket permission", "error", err)
+		}
+	}
+	return pc.(*net.UnixConn), nil
+}
+
+// unixListener returns the inherited Unix stream socket, or creates one at
+// UnixPath. It returns nil if the listener is disabled. Only a socket that
+// it created, or that is owned according to ListenerFilesOwned, is removed
+// when it is closed.
+func (s *Server) unixListener(ctx context.Context, lc *net.ListenConfig) (*net.UnixListener, error) {
+	o := s.options
+	l, err := s.inheritedListener("unix")
+	switch {
+	case err != nil:
+		return nil, err
+	case l != nil:
+		ul, ok := l.(*net.UnixListener)
+		if !ok {
+			l.Close()
+			return nil, errors.New("inherited unix socket is not a Unix stream socket")
+		}
+		if addr, _ := ul.Addr().(*net.UnixAddr); o.ListenerFilesOwned && addr != nil && addr.Name == o.UnixPath {
+			ul.SetUnlinkOnClose(true)
+		}
+		return ul, nil
+	case o.UnixPath == "":
+		return nil, nil
+	}
+
+	if _, err := os.Stat(o.UnixPath); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unix socket %s already exists", o.UnixPath)
+	}
+	l, err = lc.Listen(ctx, "unix", o.UnixPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on Unix socket: %w", err)
+	}
+
+	// Abstract sockets don't exist on the file system.
+	if _, err := os.Stat(o.UnixPath); !os.IsNotExist(err) {
+		if err := os.Chmod(o.UnixPath, o.UnixSocketMode); err != nil {
+			level.Warn(o.Logger).Log("msg", "Failed to change unix socket permission", "error", err)
+		}
+	}
+	return l.(*net.UnixListener), nil
+}
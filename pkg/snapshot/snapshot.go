@@ -0,0 +1,192 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot implements the on-disk format used to persist the state
+// of the exported metrics across restarts.
+//
+// A snapshot file starts with a fixed header: the magic string "STATSDSN",
+// the format version, the CRC-32 (Castagnoli) checksum and the length of the
+// payload, all big endian. The payload is the gob encoding of a Snapshot.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the version of the format written by this package.
+const Version = 1
+
+const magic = "STATSDSN"
+
+// maxPayloadSize protects against allocating huge buffers for a corrupted
+// length.
+const maxPayloadSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when a snapshot fails the integrity checks.
+var ErrCorrupt = errors.New("snapshot is corrupt")
+
+// Metric types of a Series.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+	TypeSummary   = "summary"
+)
+
+// Bucket is a histogram bucket.
+type Bucket struct {
+	UpperBound      float64
+	CumulativeCount uint64
+}
+
+// Objective is a quantile of a summary and its allowed error.
+type Objective struct {
+	Quantile float64
+	Error    float64
+}
+
+// Series is the state of a single time series.
+type Series struct {
+	Name             string
+	Type             string
+	Help             string
+	Labels           map[string]string
+	TTL              time.Duration
+	LastRegisteredAt time.Time
+
+	// Value is the value of a counter or gauge.
+	Value float64
+	// Count, Sum and Buckets are the state of a histogram or summary.
+	// Summaries have no buckets.
+	Count   uint64
+	Sum     float64
+	Buckets []Bucket
+
+	// Objectives, MaxAge, AgeBuckets and BufCap are the options of a
+	// summary, which it is restored with. Summaries of older snapshots,
+	// which lack them, are restored with the default options.
+	Objectives []Objective
+	MaxAge     time.Duration
+	AgeBuckets uint32
+	BufCap     uint32
+}
+
+// Snapshot is the state of all metrics at a point in time.
+type Snapshot struct {
+	CreatedAt time.Time
+	Series    []Series
+}
+
+type header struct {
+	Magic    [8]byte
+	Version  uint32
+	Checksum uint32
+	Length   uint64
+}
+
+// Write encodes a snapshot to w.
+func Write(w io.Writer, s *Snapshot) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(s); err != nil {
+		return err
+	}
+
+	h := header{
+		Version:  Version,
+		Checksum: crc32.Checksum(payload.Bytes(), crcTable),
+		Length:   uint64(payload.Len()),
+	}
+	copy(h.Magic[:], magic)
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+// Read decodes a snapshot from r. It returns an error wrapping ErrCorrupt if
+// the data is not a valid snapshot.
+func Read(r io.Reader) (*Snapshot, error) {
+	var h header
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %v", ErrCorrupt, err)
+	}
+	if string(h.Magic[:]) != magic {
+		return nil, fmt.Errorf("%w: not a snapshot file", ErrCorrupt)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d", h.Version)
+	}
+	if h.Length > maxPayloadSize {
+		return nil, fmt.Errorf("%w: payload length %d is too large", ErrCorrupt, h.Length)
+	}
+
+	payload := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: reading payload: %v", ErrCorrupt, err)
+	}
+	if crc32.Checksum(payload, crcTable) != h.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	var s Snapshot
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %v", ErrCorrupt, err)
+	}
+	return &s, nil
+}
+
+// WriteFile writes a snapshot to a file. The file is replaced atomically, so
+// that a crash while writing never leaves a partial snapshot behind.
+func WriteFile(fileName string, s *Snapshot) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := Write(tmp, s); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// ReadFile reads a snapshot from a file.
+func ReadFile(fileName string) (*Snapshot, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testSnapshot() *Snapshot {
+	return &Snapshot{
+		CreatedAt: time.Unix(1600000000, 0).UTC(),
+		Series: []Series{
+			{
+				Name:             "requests_total",
+				Type:             TypeCounter,
+				Help:             "Requests.",
+				Labels:           map[string]string{"code": "200"},
+				TTL:              time.Minute,
+				LastRegisteredAt: time.Unix(1599999990, 0).UTC(),
+				Value:            42,
+			},
+			{
+				Name:  "temperature",
+				Type:  TypeGauge,
+				Value: math.Inf(-1),
+			},
+			{
+				Name:    "latency_seconds",
+				Type:    TypeHistogram,
+				Count:   3,
+				Sum:     1.5,
+				Buckets: []Bucket{{0.1, 1}, {1, 3}},
+			},
+			{
+				Name:       "size_bytes",
+				Type:       TypeSummary,
+				Count:      2,
+				Sum:        300,
+				Objectives: []Objective{{0.5, 0.05}, {0.99, 0.001}},
+				MaxAge:     time.Minute,
+				AgeBuckets: 3,
+				BufCap:     100,
+			},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testSnapshot()) {
+		t.Fatalf("expected %+v, got %+v", testSnapshot(), got)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	scenarios := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{
+			name:   "empty",
+			mutate: func(b []byte) []byte { return nil },
+		},
+		{
+			name:   "bad magic",
+			mutate: func(b []byte) []byte { b[0] = 'X'; return b },
+		},
+		{
+			name:   "flipped payload bit",
+			mutate: func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		},
+		{
+			name:   "truncated payload",
+			mutate: func(b []byte) []byte { return b[:len(b)-1] },
+		},
+		{
+			name: "huge length",
+			mutate: func(b []byte) []byte {
+				binary.BigEndian.PutUint64(b[16:24], math.MaxUint64)
+				return b
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			data := s.mutate(append([]byte(nil), valid...))
+			_, err := Read(bytes.NewReader(data))
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[8:12], Version+1)
+	if _, err := Read(bytes.NewReader(data)); err == nil || errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "state")
+	for i := 0; i < 2; i++ {
+		if err := WriteFile(fileName, testSnapshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testSnapshot()) {
+		t.Fatalf("expected %+v, got %+v", testSnapshot(), got)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected only the snapshot file, got %d files", len(files))
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unmapped keeps track of the most frequent StatsD metrics that did
+// not match any mapping.
+package unmapped
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+type key struct {
+	name       string
+	metricType mapper.MetricType
+}
+
+// Entry describes one unmapped StatsD metric.
+type Entry struct {
+	Name       string            `json:"name"`
+	MetricType mapper.MetricType `json:"type"`
+	// Count is an upper bound of the number of events seen. It overestimates
+	// the true count by at most Error.
+	Count     uint64            `json:"count"`
+	Error     uint64            `json:"error"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Tags      map[string]string `json:"sample_tags"`
+	// Rate is the average number of events per second since FirstSeen.
+	Rate float64 `json:"rate"`
+
+	index int
+}
+
+// Tracker is a bounded top-K sketch of unmapped metric names, using the
+// Space-Saving algorithm. It is safe for concurrent use.
+type Tracker struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[key]*Entry
+	heap     entryHeap
+}
+
+// NewTracker returns a Tracker that keeps at most capacity metrics.
+func NewTracker(capacity int) *Tracker {
+	return &Tracker{
+		capacity: capacity,
+		entries:  make(map[key]*Entry, capacity),
+		heap:     make(entryHeap, 0, capacity),
+	}
+}
+
+// Observe records an event for a metric that no mapping matched.
+func (t *Tracker) Observe(name string, metricType mapper.MetricType, tags map[string]string) {
+	if t.capacity <= 0 {
+		return
+	}
+	now := clock.Now()
+	k := key{name: name, metricType: metricType}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e, ok := t.entries[k]; ok {
+		e.Count++
+		e.LastSeen = now
+		heap.Fix(&t.heap, e.index)
+		return
+	}
+
+	e := &Entry{
+		Name:       name,
+		MetricType: metricType,
+		Count:      1,
+		FirstSeen:  now,
+		LastSeen:   now,
+		Tags:       copyTags(tags),
+	}
+	if len(t.heap) >= t.capacity {
+		// Replace the least frequent metric. The newcomer inherits its count,
+		// which bounds the error of the estimate.
+		min := t.heap[0]
+		delete(t.entries, key{name: min.Name, metricType: min.MetricType})
+		e.Count += min.Count
+		e.Error = min.Count
+		e.index = 0
+		t.heap[0] = e
+		heap.Fix(&t.heap, 0)
+	} else {
+		heap.Push(&t.heap, e)
+	}
+	t.entries[k] = e
+}
+
+// Top returns up to n entries ordered by descending count. If n is not
+// positive, all entries are returned.
+func (t *Tracker) Top(n int) []Entry {
+	now := clock.Now()
+
+	t.mutex.Lock()
+	result := make([]Entry, 0, len(t.heap))
+	for _, e := range t.heap {
+		c := *e
+		c.Tags = copyTags(e.Tags)
+		result = append(result, c)
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	for i := range result {
+		if d := now.Sub(result[i].FirstSeen).Seconds(); d > 0 {
+			result[i].Rate = float64(result[i].Count) / d
+		}
+	}
+	return result
+}
+
+// Reset forgets all tracked metrics, e.g. after the mappings were reloaded.
+func (t *Tracker) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = make(map[key]*Entry, t.capacity)
+	t.heap = make(entryHeap, 0, t.capacity)
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+// entryHeap is a min-heap of entries ordered by count.
+type entryHeap []*Entry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*Entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Proposal is a glob mapping that would cover a group of unmapped metrics.
+type Proposal struct {
+	Match           string            `json:"match" yaml:"match"`
+	MatchMetricType mapper.MetricType `json:"match_metric_type" yaml:"match_metric_type"`
+	Name            string            `json:"name" yaml:"name"`
+	Labels          map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// Covers lists the metric names the proposal was derived from.
+	Covers []string `json:"covers" yaml:"-"`
+}
+
+// Propose groups entries of the same type that share their first component
+// and number of components, and suggests one glob mapping per group. Components
+// that differ within a group become wildcards, each captured into a label.
+// The proposals are a starting point and need a human to pick label names.
+func Propose(entries []Entry) []Proposal {
+	type group struct {
+		metricType mapper.MetricType
+		components [][]string
+		names      []string
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, e := range entries {
+		components := strings.Split(e.Name, ".")
+		k := string(e.MetricType) + "\xff" + components[0] + "\xff" + strings.Repeat(".", len(components))
+		g, ok := groups[k]
+		if !ok {
+			g = &group{metricType: e.MetricType}
+			groups[k] = g
+			order = append(order, k)
+		}
+		g.components = append(g.components, components)
+		g.names = append(g.names, e.Name)
+	}
+
+	proposals := make([]Proposal, 0, len(order))
+	for _, k := range order {
+		g := groups[k]
+		first := g.components[0]
+		match := make([]string, len(first))
+		var nameParts []string
+		labels := map[string]string{}
+		capture := 0
+		for i := range first {
+			same := true
+			for _, c := range g.components[1:] {
+				if c[i] != first[i] {
+					same = false
+					break
+				}
+			}
+			if same {
+				match[i] = first[i]
+				nameParts = append(nameParts, first[i])
+				continue
+			}
+			match[i] = "*"
+			capture++
+			labels["label"+strconv.Itoa(capture)] = "$" + strconv.Itoa(capture)
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		name := mapper.EscapeMetricName(strings.Join(nameParts, "_"))
+		if g.metricType == mapper.MetricTypeCounter && !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		proposals = append(proposals, Proposal{
+			Match:           strings.Join(match, "."),
+			MatchMetricType: g.metricType,
+			Name:            name,
+			Labels:          labels,
+			Covers:          g.names,
+		})
+	}
+	return proposals
+}
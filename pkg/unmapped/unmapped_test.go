@@ -0,0 +1,93 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unmapped
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+func TestTracker(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	tracker := NewTracker(2)
+	for i := 0; i < 5; i++ {
+		tracker.Observe("a", mapper.MetricTypeCounter, map[string]string{"env": "prod"})
+	}
+	for i := 0; i < 3; i++ {
+		tracker.Observe("b", mapper.MetricTypeGauge, nil)
+	}
+	// The same name with a different type is tracked separately and evicts
+	// the least frequent entry.
+	tracker.Observe("a", mapper.MetricTypeGauge, nil)
+
+	clock.ClockInstance.Instant = time.Unix(10, 0)
+	top := tracker.Top(0)
+	if len(top) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(top))
+	}
+	if top[0].Name != "a" || top[0].MetricType != mapper.MetricTypeCounter || top[0].Count != 5 || top[0].Error != 0 {
+		t.Fatalf("unexpected first entry %+v", top[0])
+	}
+	if top[0].Rate != 0.5 {
+		t.Fatalf("expected rate 0.5, got %v", top[0].Rate)
+	}
+	if !reflect.DeepEqual(top[0].Tags, map[string]string{"env": "prod"}) {
+		t.Fatalf("unexpected sample tags %v", top[0].Tags)
+	}
+	if top[1].Name != "a" || top[1].MetricType != mapper.MetricTypeGauge || top[1].Count != 4 || top[1].Error != 3 {
+		t.Fatalf("unexpected second entry %+v", top[1])
+	}
+
+	if top := tracker.Top(1); len(top) != 1 {
+		t.Fatalf("expected 1 entry with limit, got %d", len(top))
+	}
+
+	tracker.Reset()
+	if top := tracker.Top(0); len(top) != 0 {
+		t.Fatalf("expected no entries after reset, got %d", len(top))
+	}
+}
+
+func TestPropose(t *testing.T) {
+	entries := []Entry{
+		{Name: "app.web01.requests", MetricType: mapper.MetricTypeCounter},
+		{Name: "app.web02.requests", MetricType: mapper.MetricTypeCounter},
+		{Name: "app.web02.latency", MetricType: mapper.MetricTypeCounter},
+		{Name: "db.queries", MetricType: mapper.MetricTypeGauge},
+	}
+	expected := []Proposal{
+		{
+			Match:           "app.*.*",
+			MatchMetricType: mapper.MetricTypeCounter,
+			Name:            "app_total",
+			Labels:          map[string]string{"label1": "$1", "label2": "$2"},
+			Covers:          []string{"app.web01.requests", "app.web02.requests", "app.web02.latency"},
+		},
+		{
+			Match:           "db.queries",
+			MatchMetricType: mapper.MetricTypeGauge,
+			Name:            "db_queries",
+			Covers:          []string{"db.queries"},
+		},
+	}
+	if got := Propose(entries); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package upgrade hands the listening sockets and the state of the metrics
+// over to a new process, so that the exporter can be upgraded without
+// dropping traffic.
+//
+// The old process, the parent, starts the new one, the child, with one end
+// of a Unix socket pair, and sends it the listening sockets. The child
+// loads its configuration and reports that it is ready. Only then does the
+// parent stop reading from the sockets, which buffer the traffic in the
+// meantime, and hands over the state of the metrics. The child restores it,
+// starts reading, and reports that it has started, upon which the parent
+// exits.
+package upgrade
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+)
+
+// envFD is the environment variable with the file descriptor of the
+// connection to the parent.
+const envFD = "STATSD_EXPORTER_UPGRADE_FD"
+
+// maxFiles is the maximum number of sockets that can be handed over.
+const maxFiles = 16
+
+// The lines exchanged after the sockets.
+const (
+	msgFiles   = "files"
+	msgReady   = "ready"
+	msgState   = "state"
+	msgNoState = "nostate"
+	msgStarted = "started"
+)
+
+// ErrNotSupported is returned on platforms that can't pass sockets between
+// processes.
+var ErrNotSupported = errors.New("upgrades are not supported on this platform")
+
+// Parent is the side of the process being upgraded.
+type Parent struct {
+	cmd  *exec.Cmd
+	conn *net.UnixConn
+	r    *bufio.Reader
+	// exited is closed once the child has exited.
+	exited chan struct{}
+}
+
+// Start starts the child with cmd, usually the running executable with the
+// same arguments, and hands it files, the listening sockets by name. It
+// returns once the child is ready to take over, which the parent then
+// completes with Finish. If the child exits or is not ready within timeout,
+// it is killed and an error is returned.
+func Start(cmd *exec.Cmd, files map[string]*os.File, timeout time.Duration) (*Parent, error) {
+	if len(files) > maxFiles {
+		return nil, fmt.Errorf("cannot hand over more than %d sockets", maxFiles)
+	}
+	parentFile, childFile, err := socketpair()
+	if err != nil {
+		return nil, err
+	}
+	defer childFile.Close()
+	conn, err := fileConn(parentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, envFD+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, childFile)
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starting the new process: %w", err)
+	}
+
+	p := &Parent{cmd: cmd, conn: conn, r: bufio.NewReader(conn), exited: make(chan struct{})}
+	go func() {
+		// The connection is closed once the child has exited, which ends
+		// reads that are waiting for it.
+		cmd.Wait()
+		close(p.exited)
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := p.sendFiles(files); err != nil {
+		p.Abort()
+		return nil, fmt.Errorf("handing over the sockets: %w", err)
+	}
+	if err := p.expect(msgReady); err != nil {
+		p.Abort()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Parent) sendFiles(files map[string]*os.File) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fds := make([]int, len(names))
+	for i, name := range names {
+		fds[i] = int(files[name].Fd())
+	}
+
+	// The sockets are passed along with a single byte, so that the child
+	// can receive them before it reads any further.
+	if _, _, err := p.conn.WriteMsgUnix([]byte{0}, unixRights(fds), nil); err != nil {
+		return err
+	}
+	return writeLine(p.conn, msgFiles, names...)
+}
+
+// expect waits for the line msg from the child.
+func (p *Parent) expect(msg string) error {
+	line, _, err := readLine(p.r)
+	if err != nil {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("the new process exited: %s", p.cmd.ProcessState)
+		default:
+			return fmt.Errorf("waiting for the new process: %w", err)
+		}
+	}
+	if line != msg {
+		return fmt.Errorf("unexpected message %q from the new process", line)
+	}
+	return nil
+}
+
+// Finish hands state, which may be nil, over to the child, and waits until
+// the child reads from the sockets. The parent must have stopped reading
+// from them before. If the child doesn't start within timeout, an error is
+// returned, but the child is left running, as the parent can't resume.
+func (p *Parent) Finish(state *snapshot.Snapshot, timeout time.Duration) error {
+	defer p.conn.Close()
+	p.conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(p.conn)
+	if state == nil {
+		writeLine(w, msgNoState)
+	} else {
+		writeLine(w, msgState)
+		if err := snapshot.Write(w, state); err != nil {
+			return fmt.Errorf("handing over the state: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("handing over the state: %w", err)
+	}
+	return p.expect(msgStarted)
+}
+
+// Pid returns the process ID of the child.
+func (p *Parent) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Abort kills the child, and waits until it has exited.
+func (p *Parent) Abort() {
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+// Child is the side of the new process.
+type Child struct {
+	// Files are the listening sockets, by name.
+	Files map[string]*os.File
+
+	conn *net.UnixConn
+	r    *bufio.Reader
+}
+
+// Inherited returns the connection to the parent if the process was started
+// by Start, and nil otherwise. It receives the listening sockets.
+func Inherited() (*Child, error) {
+	env := os.Getenv(envFD)
+	if env == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envFD)
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", envFD, env)
+	}
+	conn, err := fileConn(os.NewFile(uintptr(fd), "upgrade"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Child{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.receiveFiles(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("receiving the sockets: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Child) receiveFiles() error {
+	oob := make([]byte, rightsSize(maxFiles))
+	_, oobn, _, _, err := c.conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return err
+	}
+	fds, err := parseRights(oob[:oobn])
+	if err != nil {
+		return err
+	}
+
+	line, names, err := readLine(c.r)
+	if err != nil {
+		return err
+	}
+	if line != msgFiles || len(names) != len(fds) {
+		return fmt.Errorf("unexpected message %q with %d sockets", line, len(fds))
+	}
+	c.Files = make(map[string]*os.File, len(names))
+	for i, name := range names {
+		c.Files[name] = os.NewFile(uintptr(fds[i]), name)
+	}
+	return nil
+}
+
+// Ready tells the parent that the child is ready to take over, and waits
+// until the parent has stopped reading from the sockets. It returns the
+// state handed over by the parent, or nil if there is none.
+func (c *Child) Ready() (*snapshot.Snapshot, error) {
+	if err := writeLine(c.conn, msgReady); err != nil {
+		return nil, err
+	}
+	line, _, err := readLine(c.r)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for the old process: %w", err)
+	}
+	switch line {
+	case msgNoState:
+		return nil, nil
+	case msgState:
+		return snapshot.Read(c.r)
+	default:
+		return nil, fmt.Errorf("unexpected message %q from the old process", line)
+	}
+}
+
+// Started tells the parent that the child reads from the sockets, and
+// closes the connection to it.
+func (c *Child) Started() error {
+	defer c.conn.Close()
+	return writeLine(c.conn, msgStarted)
+}
+
+func writeLine(w io.Writer, msg string, args ...string) error {
+	_, err := io.WriteString(w, strings.Join(append([]string{msg}, args...), " ")+"\n")
+	return err
+}
+
+func readLine(r *bufio.Reader) (string, []string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, errors.New("empty message")
+	}
+	return fields[0], fields[1:], nil
+}
+
+func fileConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("the upgrade connection is not a Unix socket")
+	}
+	return conn, nil
+}
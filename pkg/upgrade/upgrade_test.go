@@ -0,0 +1,118 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/snapshot"
+)
+
+const childEnv = "STATSD_EXPORTER_UPGRADE_TEST_CHILD"
+
+// TestChildProcess is the new process of TestUpgrade. It prints the state
+// it was handed over, and the first packet it reads.
+func TestChildProcess(t *testing.T) {
+	if os.Getenv(childEnv) == "" {
+		t.Skip("only runs as the new process of TestUpgrade")
+	}
+	c, err := Inherited()
+	if err != nil || c == nil {
+		t.Fatalf("expected a connection to the parent, got %v", err)
+	}
+	conn, err := net.FilePacketConn(c.Files["udp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := c.Ready()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Started(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("state=%s packet=%s\n", state.Series[0].Name, buf[:n])
+}
+
+func TestUpgrade(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChildProcess$", "-test.v")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	p, err := Start(cmd, map[string]*os.File{"udp": f}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent stops reading. Packets sent in the meantime wait in the
+	// socket for the child.
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	f.Close()
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("foo:1|c")); err != nil {
+		t.Fatal(err)
+	}
+
+	state := &snapshot.Snapshot{Series: []snapshot.Series{{Name: "restored", Type: snapshot.TypeCounter, Value: 1}}}
+	if err := p.Finish(state, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(10 * time.Second):
+		p.Abort()
+		t.Fatal("the new process did not exit")
+	}
+	if !strings.Contains(out.String(), "state=restored packet=foo:1|c") {
+		t.Fatalf("expected the new process to receive the state and the packet, got:\n%s", out.String())
+	}
+}
+
+func TestUpgradeChildExits(t *testing.T) {
+	// The test binary exits right away without running any test.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if _, err := Start(cmd, nil, 10*time.Second); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expected an error for a new process that exits, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package upgrade
+
+import "os"
+
+// Signal triggers an upgrade. There is none on Windows.
+var Signal os.Signal
+
+func socketpair() (parent, child *os.File, err error) {
+	return nil, nil, ErrNotSupported
+}
+
+func unixRights(fds []int) []byte {
+	return nil
+}
+
+func rightsSize(n int) int {
+	return 0
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	return nil, ErrNotSupported
+}
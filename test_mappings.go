@@ -0,0 +1,408 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/exporter"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Exit codes of the test-mappings command.
+const (
+	mappingTestsPassed  = 0
+	mappingTestsFailed  = 1
+	mappingTestsInvalid = 2
+)
+
+// mappingTestFile is the format of a file consumed by the test-mappings
+// command.
+type mappingTestFile struct {
+	// MappingConfig is the mapping configuration under test. A relative path
+	// is resolved against the directory of the test file. If empty, the file
+	// given with --statsd.mapping-config is used.
+	MappingConfig string            `yaml:"mapping_config"`
+	Tests         []mappingTestCase `yaml:"tests"`
+}
+
+type mappingTestCase struct {
+	Name string `yaml:"name"`
+	// Line is a single StatsD line in any of the supported formats.
+	Line string `yaml:"line"`
+	// Source is the name of the sender of the line, as given by
+	// --statsd.source-labels, for mappings with a source_label. Without
+	// it, the exporter doesn't add the label either.
+	Source string `yaml:"source"`
+	// Metrics lists the Prometheus metrics the line is expected to update,
+	// in the order of the samples on the line.
+	Metrics []expectedMetric `yaml:"metrics"`
+	// Dropped expects every sample on the line to hit a drop action.
+	Dropped bool `yaml:"dropped"`
+}
+
+type expectedMetric struct {
+	Name   string            `yaml:"name" json:"name"`
+	Type   string            `yaml:"type" json:"type"`
+	Labels map[string]string `yaml:"labels" json:"labels"`
+}
+
+func (m expectedMetric) String() string {
+	return fmt.Sprintf("%s%v (%s)", m.Name, m.Labels, m.Type)
+}
+
+// mappingResult is what the exporter would do with a single event.
+type mappingResult struct {
+	// metrics are the metrics the event updates. It is empty if the event
+	// is discarded because of a metric type conflict.
+	metrics []expectedMetric
+	dropped bool
+	err     error
+}
+
+// lineResolver determines the metrics that the events of a line update, the
+// same way Exporter.mapEvent and Exporter.recordEvent do, without touching
+// any registry. It keeps track of the metrics of the previous events, so
+// that type conflicts between them are resolved like the exporter would
+// starting from an empty registry.
+type lineResolver struct {
+	m *mapper.MetricMapper
+	// source is the name of the sender, or "" if it is unknown.
+	source string
+	// types holds the type of each metric name in use.
+	types map[string]string
+}
+
+func newLineResolver(m *mapper.MetricMapper, source string) *lineResolver {
+	return &lineResolver{m: m, source: source, types: map[string]string{}}
+}
+
+// resolveEvent looks up the mapping of an event, and resolves it.
+func (r *lineResolver) resolveEvent(e event.Event) mappingResult {
+	mapping, labels, present := r.m.GetMapping(e.MetricName(), e.MetricType())
+	return r.resolveMapping(e, mapping, labels, present)
+}
+
+// resolveMapping derives the resulting metrics from the outcome of a mapping
+// lookup for an event.
+func (r *lineResolver) resolveMapping(e event.Event, mapping *mapper.MetricMapping, labels prometheus.Labels, present bool) mappingResult {
+	if mapping == nil {
+		mapping = &mapper.MetricMapping{
+			ConflictStrategy: r.m.Defaults.ConflictStrategy,
+			SourceLabel:      r.m.Defaults.SourceLabel,
+		}
+	}
+	if mapping.Action == mapper.ActionTypeDrop {
+		return mappingResult{dropped: true}
+	}
+
+	u := metricUpdate{labels: map[string]string{}}
+	for k, v := range e.Labels() {
+		u.labels[k] = v
+	}
+
+	if present {
+		if mapping.Name == "" {
+			return mappingResult{err: fmt.Errorf("mapping %q generates an empty metric name", mapping.Match)}
+		}
+		u.name = mapper.EscapeMetricName(mapping.Name)
+		for k, v := range labels {
+			u.labels[k] = v
+		}
+	} else {
+		u.name = mapper.EscapeMetricName(e.MetricName())
+	}
+	if mapping.SourceLabel != "" && r.source != "" {
+		u.labels[mapping.SourceLabel] = r.source
+	}
+
+	metricType := e.MetricType()
+	if mapping.TypeOverride != "" {
+		metricType = mapping.TypeOverride
+	}
+
+	switch metricType {
+	case mapper.MetricTypeCounter:
+		u.eventType, u.metricType, u.typeSuffix = "counter", "counter", "counter"
+		switch {
+		case e.MetricType() == mapper.MetricTypeGauge:
+			// A gauge exposed as a counter can't be recorded in a gauge.
+		case e.MetricType() == mapper.MetricTypeCounter && mapping.CounterMode != mapper.CounterModeDefault && mapping.CounterMode != mapper.CounterModeMonotonic:
+			u.metricType, u.typeSuffix = "gauge", "gauge"
+		default:
+			u.asGauge = true
+		}
+	case mapper.MetricTypeGauge:
+		u.eventType, u.metricType, u.typeSuffix = "gauge", "gauge", "gauge"
+	case mapper.MetricTypeObserver:
+		t := mapping.ObserverType
+		if t == mapper.ObserverTypeDefault {
+			t = r.m.Defaults.ObserverType
+		}
+		if t == mapper.ObserverTypeDefault {
+			t = mapper.ObserverTypeSummary
+		}
+		u.eventType, u.metricType, u.typeSuffix = "observer", string(t), string(t)
+		if t == mapper.ObserverTypeStatsdAggregates {
+			return r.resolveStatsdAggregates(u, mapping)
+		}
+	}
+
+	name, labels, ok := r.record(u, mapping.ConflictStrategy)
+	if !ok {
+		return mappingResult{}
+	}
+	return mappingResult{metrics: []expectedMetric{{Name: name, Type: u.metricType, Labels: labels}}}
+}
+
+// resolveStatsdAggregates returns the gauges of a statsd_aggregates observer
+// once the interval of the value is over.
+func (r *lineResolver) resolveStatsdAggregates(u metricUpdate, mapping *mapper.MetricMapping) mappingResult {
+	// The count gauge is created right away, and determines the name of
+	// the other gauges.
+	u.typeSuffix = "statsd"
+	u.metricType = "gauge"
+	u.checkSuffix = "_count"
+	name, labels, ok := r.record(u, mapping.ConflictStrategy)
+	if !ok {
+		return mappingResult{}
+	}
+
+	var result mappingResult
+	for _, stat := range exporter.StatsdAggregatesStats(r.m.StatsdAggregates(mapping).Percentiles) {
+		gauge := name + "_" + stat
+		// Gauges that conflict with another metric are skipped.
+		if _, _, conflict := r.conflict(gauge, "gauge"); conflict {
+			continue
+		}
+		r.types[gauge] = "gauge"
+		result.metrics = append(result.metrics, expectedMetric{Name: gauge, Type: "gauge", Labels: labels})
+	}
+	return result
+}
+
+// metricUpdate is the update of a metric by an event.
+type metricUpdate struct {
+	name   string
+	labels map[string]string
+	// eventType and typeSuffix are those of Exporter.record.
+	eventType  string
+	typeSuffix string
+	metricType string
+	// asGauge is set if the label conflict strategy can record the event in
+	// an existing gauge.
+	asGauge bool
+	// checkSuffix is appended to the name of the metric that is created.
+	checkSuffix string
+}
+
+// record returns the name and labels of the metric an update is recorded
+// in, resolving conflicts with the strategy like Exporter.record. It
+// returns false if the update is discarded.
+func (r *lineResolver) record(u metricUpdate, strategy mapper.ConflictStrategy) (string, map[string]string, bool) {
+	conflictName, conflictType, conflict := r.conflict(u.name+u.checkSuffix, u.metricType)
+	if !conflict {
+		r.types[u.name+u.checkSuffix] = u.metricType
+		return u.name, u.labels, true
+	}
+
+	switch strategy {
+	case mapper.ConflictStrategyLabel:
+		if u.asGauge && conflictName == u.name && conflictType == "gauge" {
+			labels := make(map[string]string, len(u.labels)+1)
+			for k, v := range u.labels {
+				labels[k] = v
+			}
+			labels["statsd_type"] = u.eventType
+			return u.name, labels, true
+		}
+		fallthrough
+	case mapper.ConflictStrategySuffix:
+		name := u.name + "_" + u.typeSuffix
+		if _, _, conflict := r.conflict(name+u.checkSuffix, u.metricType); conflict {
+			return "", nil, false
+		}
+		r.types[name+u.checkSuffix] = u.metricType
+		return name, u.labels, true
+	case mapper.ConflictStrategyReplace:
+		for i := 0; i < 4 && conflict; i++ {
+			delete(r.types, conflictName)
+			conflictName, _, conflict = r.conflict(u.name+u.checkSuffix, u.metricType)
+		}
+		if conflict {
+			return "", nil, false
+		}
+		r.types[u.name+u.checkSuffix] = u.metricType
+		return u.name, u.labels, true
+	}
+	return "", nil, false
+}
+
+// conflict returns the name and type of a metric that a new metric of the
+// given name and type conflicts with, like Registry.conflict does.
+func (r *lineResolver) conflict(name, metricType string) (string, string, bool) {
+	names := []string{name}
+	switch metricType {
+	case "histogram":
+		names = append(names, name+"_sum", name+"_count", name+"_bucket")
+	case "summary":
+		names = append(names, name+"_sum", name+"_count")
+	}
+	for _, n := range names {
+		if t, ok := r.types[n]; ok && t != metricType {
+			return n, t, true
+		}
+	}
+	return "", "", false
+}
+
+// runMappingTest checks a single test case and returns a description of
+// every mismatch.
+func runMappingTest(m *mapper.MetricMapper, parser listener.Parser, tc mappingTestCase, logger log.Logger) []string {
+	sampleErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"})
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "discard"})
+
+	events := parser.LineToEvents(tc.Line, *sampleErrors, counter, counter, counter, logger)
+	if len(events) == 0 {
+		if tc.Dropped || len(tc.Metrics) > 0 {
+			return []string{"line produced no events"}
+		}
+		return nil
+	}
+
+	var failures []string
+	var got []expectedMetric
+	r := newLineResolver(m, tc.Source)
+	for _, e := range events {
+		res := r.resolveEvent(e)
+		switch {
+		case res.err != nil:
+			failures = append(failures, res.err.Error())
+		case res.dropped:
+			if !tc.Dropped {
+				failures = append(failures, fmt.Sprintf("sample for %q was unexpectedly dropped", e.MetricName()))
+			}
+		case len(res.metrics) == 0:
+			failures = append(failures, fmt.Sprintf("sample for %q is discarded because of a metric type conflict", e.MetricName()))
+		default:
+			if tc.Dropped {
+				for _, metric := range res.metrics {
+					failures = append(failures, fmt.Sprintf("expected sample to be dropped, got %s", metric))
+				}
+			}
+			got = append(got, res.metrics...)
+		}
+	}
+	if tc.Dropped {
+		return failures
+	}
+
+	for i := 0; i < len(tc.Metrics) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			failures = append(failures, fmt.Sprintf("expected %s, got nothing", tc.Metrics[i]))
+		case i >= len(tc.Metrics):
+			failures = append(failures, fmt.Sprintf("unexpected %s", got[i]))
+		default:
+			exp := tc.Metrics[i]
+			if exp.Labels == nil {
+				exp.Labels = map[string]string{}
+			}
+			if exp.Name != got[i].Name || exp.Type != got[i].Type || !reflect.DeepEqual(exp.Labels, got[i].Labels) {
+				failures = append(failures, fmt.Sprintf("expected %s, got %s", exp, got[i]))
+			}
+		}
+	}
+	return failures
+}
+
+// runMappingTestFile runs all tests in a single file. It returns whether all
+// tests passed, or an error if the file or its mapping config can't be used.
+func runMappingTestFile(w io.Writer, fileName string, defaultConfig string, parser listener.Parser, logger log.Logger) (bool, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return false, err
+	}
+	var tf mappingTestFile
+	if err := yaml.UnmarshalStrict(content, &tf); err != nil {
+		return false, err
+	}
+
+	configFile := defaultConfig
+	if tf.MappingConfig != "" {
+		configFile = tf.MappingConfig
+		if !filepath.IsAbs(configFile) {
+			configFile = filepath.Join(filepath.Dir(fileName), configFile)
+		}
+	}
+
+	m := &mapper.MetricMapper{Logger: logger}
+	if configFile != "" {
+		if err := m.InitFromFile(configFile); err != nil {
+			return false, fmt.Errorf("error loading mapping config %s: %w", configFile, err)
+		}
+	}
+
+	passed := true
+	for i, tc := range tf.Tests {
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		failures := runMappingTest(m, parser, tc, logger)
+		if len(failures) == 0 {
+			continue
+		}
+		passed = false
+		fmt.Fprintf(w, "  FAILED %s: line %q\n", name, tc.Line)
+		for _, f := range failures {
+			fmt.Fprintf(w, "    %s\n", f)
+		}
+	}
+	return passed, nil
+}
+
+// runMappingTests runs the mapping unit tests in all given files and returns
+// the exit code for the test-mappings command.
+func runMappingTests(w io.Writer, fileNames []string, defaultConfig string, parser listener.Parser, logger log.Logger) int {
+	exitCode := mappingTestsPassed
+	for _, fileName := range fileNames {
+		fmt.Fprintf(w, "Testing mappings: %s\n", fileName)
+		passed, err := runMappingTestFile(w, fileName, defaultConfig, parser, logger)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "  ERROR: %s\n", strings.TrimSpace(err.Error()))
+			exitCode = mappingTestsInvalid
+		case !passed:
+			fmt.Fprintln(w, "  FAILURE")
+			if exitCode == mappingTestsPassed {
+				exitCode = mappingTestsFailed
+			}
+		default:
+			fmt.Fprintln(w, "  SUCCESS")
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+const mappingTestConfig = `
+mappings:
+- match: test.dispatcher.*.*.*
+  name: "dispatcher_events_total"
+  labels:
+    processor: "$1"
+    action: "$2"
+    outcome: "$3"
+- match: test.timer.*
+  observer_type: histogram
+  name: "test_timer_seconds"
+  labels:
+    job: "$1"
+- match: test.drop.*
+  action: drop
+  name: "dropped"
+- match: test.aggregates.*
+  observer_type: statsd_aggregates
+  statsd_aggregates_options:
+    percentiles: [99.9]
+  name: "test_response_ms"
+- match: test.sourced.*
+  name: "test_sourced_total"
+  source_label: host
+- match: test.conflict.*
+  name: "test_conflict"
+  conflict_strategy: suffix
+`
+
+func TestRunMappingTests(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		tests    string
+		exitCode int
+		output   string
+	}{
+		{
+			name: "passing",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- line: "test.dispatcher.FooProcessor.send.success:1|c"
+  metrics:
+  - name: dispatcher_events_total
+    type: counter
+    labels:
+      processor: FooProcessor
+      action: send
+      outcome: success
+- name: histogram with tags
+  line: "test.timer.backup:20|ms|#env:prod"
+  metrics:
+  - name: test_timer_seconds
+    type: histogram
+    labels:
+      job: backup
+      env: prod
+- line: "unmapped.metric:1|g:2|g"
+  metrics:
+  - name: unmapped_metric
+    type: gauge
+  - name: unmapped_metric
+    type: gauge
+- line: "test.drop.me:1|c"
+  dropped: true
+- name: statsd aggregates
+  line: "test.aggregates.a:20|ms"
+  metrics:
+  - {name: test_response_ms_count, type: gauge}
+  - {name: test_response_ms_count_ps, type: gauge}
+  - {name: test_response_ms_sum, type: gauge}
+  - {name: test_response_ms_lower, type: gauge}
+  - {name: test_response_ms_upper, type: gauge}
+  - {name: test_response_ms_mean, type: gauge}
+  - {name: test_response_ms_median, type: gauge}
+  - {name: test_response_ms_std, type: gauge}
+  - {name: test_response_ms_count_99_9, type: gauge}
+  - {name: test_response_ms_sum_99_9, type: gauge}
+  - {name: test_response_ms_mean_99_9, type: gauge}
+  - {name: test_response_ms_upper_99_9, type: gauge}
+- name: source label
+  line: "test.sourced.a:1|c"
+  source: 10.0.0.1
+  metrics:
+  - name: test_sourced_total
+    type: counter
+    labels:
+      host: 10.0.0.1
+- name: source label without a source
+  line: "test.sourced.a:1|c"
+  metrics:
+  - name: test_sourced_total
+    type: counter
+- name: conflict resolved by suffix
+  line: "test.conflict.a:1|c:2|g"
+  metrics:
+  - name: test_conflict
+    type: counter
+  - name: test_conflict_gauge
+    type: gauge
+`,
+			exitCode: mappingTestsPassed,
+			output:   "SUCCESS",
+		},
+		{
+			name: "wrong labels",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- name: wrong outcome
+  line: "test.dispatcher.FooProcessor.send.failure:1|c"
+  metrics:
+  - name: dispatcher_events_total
+    type: counter
+    labels:
+      processor: FooProcessor
+      action: send
+      outcome: success
+`,
+			exitCode: mappingTestsFailed,
+			output:   "FAILED wrong outcome",
+		},
+		{
+			name: "unexpected drop",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- line: "test.drop.me:1|c"
+  metrics:
+  - name: test_drop_me
+    type: counter
+`,
+			exitCode: mappingTestsFailed,
+			output:   "unexpectedly dropped",
+		},
+		{
+			name: "expected drop",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- line: "test.timer.backup:20|ms"
+  dropped: true
+`,
+			exitCode: mappingTestsFailed,
+			output:   "expected sample to be dropped",
+		},
+		{
+			name: "conflict",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- line: "unmapped.metric:1|c:2|g"
+  metrics:
+  - name: unmapped_metric
+    type: counter
+  - name: unmapped_metric
+    type: gauge
+`,
+			exitCode: mappingTestsFailed,
+			output:   "discarded because of a metric type conflict",
+		},
+		{
+			name: "missing mapping config",
+			tests: `
+mapping_config: missing.yml
+tests: []
+`,
+			exitCode: mappingTestsInvalid,
+			output:   "ERROR",
+		},
+		{
+			name: "unknown field",
+			tests: `
+mapping_config: mapping.yml
+tests:
+- line: "test.drop.me:1|c"
+  drop: true
+`,
+			exitCode: mappingTestsInvalid,
+			output:   "ERROR",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "statsd_mapping_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "mapping.yml"), []byte(mappingTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			testFile := filepath.Join(dir, "tests.yml")
+			if err := ioutil.WriteFile(testFile, []byte(s.tests), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			exitCode := runMappingTests(&out, []string{testFile}, "", parser, log.NewNopLogger())
+			if exitCode != s.exitCode {
+				t.Fatalf("expected exit code %d, got %d; output:\n%s", s.exitCode, exitCode, out.String())
+			}
+			if !strings.Contains(out.String(), s.output) {
+				t.Fatalf("expected output to contain %q, got:\n%s", s.output, out.String())
+			}
+		})
+	}
+}